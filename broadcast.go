@@ -0,0 +1,217 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the prefix for the user events used internally by the store
+	internalEventPrefix = "_distrostore:"
+	// the prefix marking a user event as one which can be coalesced
+	coalesceEventPrefix = internalEventPrefix + "c:"
+	// the largest name and payload we send in a user event; serf limits the
+	// encoded event to 512 bytes, which includes consul's own envelope
+	MaxUserEventSize = 384
+	// the period coalescing events are held for before being passed on
+	DEFAULT_COALESCE_PERIOD = (time.Duration(1) * time.Second)
+)
+
+var (
+	// the user event is too large to be gossiped
+	ErrUserEventTooLarge = errors.New("The user event exceeds the maximum size of the gossip message")
+	// the event name is empty or reserved for internal use
+	ErrInvalidEventName = errors.New("The event name is empty or reserved for internal use")
+)
+
+// Check the name of a user event is valid
+//  name:		the name of the event
+func validateEventName(name string) error {
+	if name == "" || strings.HasPrefix(name, internalEventPrefix) {
+		return ErrInvalidEventName
+	}
+	return nil
+}
+
+// Check the user event can be gossiped
+//  name:		the name of the event as sent on the wire
+//  payload:	the payload of the event
+func validateEventSize(name string, payload []byte) error {
+	if len(name)+len(payload) > MaxUserEventSize {
+		return ErrUserEventTooLarge
+	}
+	return nil
+}
+
+// Check a user event from the application, returning the name it is sent under;
+// both stores validate the events here, so they accept and refuse the same ones
+//  name:		the name of the event
+//  payload:	the payload of the event
+//  coalesce:	whether the event can be coalesced
+func validateUserEvent(name string, payload []byte, coalesce bool) (string, error) {
+	if err := validateEventName(name); err != nil {
+		return "", err
+	}
+	if coalesce {
+		name = coalesceEventPrefix + name
+	}
+	return name, validateEventSize(name, payload)
+}
+
+// the listeners for user events, keyed by the event name
+type eventListeners struct {
+	sync.RWMutex
+	// a dispatcher per event name, the empty name receives all events
+	dispatchers map[string]*dispatcher
+	// the buffer size for each listener
+	buffer int
+	// the overflow policy for each listener
+	policy OverflowPolicy
+}
+
+func newEventListeners(buffer int, policy OverflowPolicy) *eventListeners {
+	return &eventListeners{
+		dispatchers: make(map[string]*dispatcher, 0),
+		buffer:      buffer,
+		policy:      policy,
+	}
+}
+
+// Add a listener for the user events
+//  name:		the name of the events, empty for all of them
+//  channel:	the channel to pass the events upon
+func (e *eventListeners) add(name string, channel chan *UserEvent) Listener {
+	e.Lock()
+	defer e.Unlock()
+	d, found := e.dispatchers[name]
+	if !found {
+		d = newDispatcher("event")
+		e.dispatchers[name] = d
+	}
+	return d.add(channel, e.buffer, e.policy, func(event interface{}, done chan struct{}) bool {
+		select {
+		case channel <- event.(*UserEvent):
+			return true
+		case <-done:
+			return false
+		}
+	}, nil)
+}
+
+// Remove the listener from all the events it was added to
+//  channel:	the channel passed to add
+func (e *eventListeners) remove(channel chan *UserEvent) {
+	e.RLock()
+	defer e.RUnlock()
+	for _, d := range e.dispatchers {
+		d.remove(channel)
+	}
+}
+
+// Pass the event to those listening
+//  event:		the user event
+func (e *eventListeners) publish(event *UserEvent) {
+	e.RLock()
+	defer e.RUnlock()
+	if d, found := e.dispatchers[event.Name]; found {
+		d.publish(event)
+	}
+	if d, found := e.dispatchers[""]; found {
+		d.publish(event)
+	}
+}
+
+// Remove all the listeners
+//  err:		the reason the listeners were removed
+func (e *eventListeners) close(err error) {
+	e.Lock()
+	defer e.Unlock()
+	for _, d := range e.dispatchers {
+		d.close(err)
+	}
+	e.dispatchers = make(map[string]*dispatcher, 0)
+}
+
+// holds back coalescing events for a period, passing on only the latest of each name
+type coalescer struct {
+	sync.Mutex
+	// the period to hold the events for
+	period time.Duration
+	// the latest event for each name
+	pending map[string]*UserEvent
+	// the timer for the next flush, nil when nothing is pending
+	timer *time.Timer
+	// called with the events once the period is up
+	publish func(*UserEvent)
+}
+
+func newCoalescer(period time.Duration, publish func(*UserEvent)) *coalescer {
+	return &coalescer{
+		period:  period,
+		pending: make(map[string]*UserEvent, 0),
+		publish: publish,
+	}
+}
+
+// Add an event, replacing any older event of the same name
+//  event:		the user event
+func (c *coalescer) add(event *UserEvent) {
+	c.Lock()
+	defer c.Unlock()
+	if current, found := c.pending[event.Name]; found && current.LTime > event.LTime {
+		return
+	}
+	c.pending[event.Name] = event
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.period, c.flush)
+	}
+}
+
+func (c *coalescer) flush() {
+	c.Lock()
+	events := make([]*UserEvent, 0, len(c.pending))
+	for _, event := range c.pending {
+		events = append(events, event)
+	}
+	c.pending = make(map[string]*UserEvent, 0)
+	c.timer = nil
+	c.Unlock()
+
+	sort.Sort(byLTime(events))
+	for _, event := range events {
+		c.publish(event)
+	}
+}
+
+// Drop anything pending and stop the timer
+func (c *coalescer) stop() {
+	c.Lock()
+	defer c.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.pending = make(map[string]*UserEvent, 0)
+}
+
+type byLTime []*UserEvent
+
+func (b byLTime) Len() int           { return len(b) }
+func (b byLTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLTime) Less(i, j int) bool { return b[i].LTime < b[j].LTime }
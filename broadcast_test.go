@@ -0,0 +1,123 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateEvent(t *testing.T) {
+	assert.Nil(t, validateEventName("invalidate"))
+	assert.Equal(t, ErrInvalidEventName, validateEventName(""))
+	assert.Equal(t, ErrInvalidEventName, validateEventName(internalEventPrefix+"tags"))
+	assert.Nil(t, validateEventSize("invalidate", []byte("cache")))
+	assert.Equal(t, ErrUserEventTooLarge, validateEventSize("invalidate", []byte(strings.Repeat("x", MaxUserEventSize))))
+
+	// step: a coalesced event is sent under a longer name, which counts against the size
+	payload := []byte(strings.Repeat("x", MaxUserEventSize-len("invalidate")))
+	wire, err := validateUserEvent("invalidate", payload, false)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, "invalidate", wire)
+	_, err = validateUserEvent("invalidate", payload, true)
+	assert.Equal(t, ErrUserEventTooLarge, err)
+}
+
+func TestEventListeners(t *testing.T) {
+	listeners := newEventListeners(10, DropOldest)
+	defer listeners.close(nil)
+	named := make(chan *UserEvent, 10)
+	all := make(chan *UserEvent, 10)
+	listeners.add("invalidate", named)
+	listeners.add("", all)
+	listeners.publish(&UserEvent{Name: "other"})
+	listeners.publish(&UserEvent{Name: "invalidate"})
+
+	for _, expected := range []string{"other", "invalidate"} {
+		select {
+		case event := <-all:
+			assert.Equal(t, expected, event.Name)
+		case <-time.After(time.Duration(2) * time.Second):
+			t.Fatalf("we did not recieve the event in time")
+		}
+	}
+	select {
+	case event := <-named:
+		assert.Equal(t, "invalidate", event.Name, "we should only recieve the named events")
+	case <-time.After(time.Duration(2) * time.Second):
+		t.Fatalf("we did not recieve the event in time")
+	}
+
+	listeners.remove(named)
+	listeners.publish(&UserEvent{Name: "invalidate"})
+	select {
+	case event := <-named:
+		t.Fatalf("we should not have recieved an event: %s", event)
+	case <-time.After(time.Duration(100) * time.Millisecond):
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	published := make(chan *UserEvent, 10)
+	c := newCoalescer(time.Duration(50)*time.Millisecond, func(event *UserEvent) {
+		published <- event
+	})
+	c.add(&UserEvent{Name: "a", LTime: 1})
+	c.add(&UserEvent{Name: "a", LTime: 3})
+	c.add(&UserEvent{Name: "a", LTime: 2})
+	c.add(&UserEvent{Name: "b", LTime: 4})
+
+	events := make([]*UserEvent, 0)
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-published:
+			events = append(events, event)
+		case <-time.After(time.Duration(2) * time.Second):
+			t.Fatalf("we did not recieve the event in time")
+		}
+	}
+	assert.Equal(t, "a", events[0].Name)
+	assert.Equal(t, uint64(3), events[0].LTime, "we should only recieve the latest event")
+	assert.Equal(t, "b", events[1].Name)
+	select {
+	case event := <-published:
+		t.Fatalf("we should not have recieved another event: %s", event)
+	case <-time.After(time.Duration(100) * time.Millisecond):
+	}
+}
+
+func TestEventListenersClose(t *testing.T) {
+	listeners := newEventListeners(10, DropOldest)
+	channel := make(chan *UserEvent, 10)
+	named := listeners.add("invalidate", channel)
+	all := listeners.add("", channel)
+	listeners.close(ErrStoreClosed)
+
+	for _, listener := range []Listener{named, all} {
+		select {
+		case <-listener.Done():
+			assert.Equal(t, ErrStoreClosed, listener.Err())
+		case <-time.After(time.Duration(2) * time.Second):
+			t.Fatalf("the listener was not removed in time")
+		}
+	}
+	select {
+	case <-channel:
+		t.Fatalf("the channel belongs to the caller and should not have been closed")
+	default:
+	}
+}
@@ -0,0 +1,343 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// the address of the http api the client talks to by default
+	DEFAULT_CLIENT_ADDRESS = "127.0.0.1:8500"
+)
+
+var (
+	// the wait for a lock was given up before the lock was acquired
+	ErrLockCancelled = errors.New("The wait for the lock was cancelled")
+)
+
+// A client of a running node, talking to the http api of its agent; it lets
+// the keys and members of an embedded cluster be inspected from outside the
+// application embedding it
+type Client struct {
+	// the client to the consul http api
+	client *api.Client
+}
+
+// Create a client for the http api of a node
+//  address:	the address of the http api i.e. 127.0.0.1:8500
+func NewClient(address string) (*Client, error) {
+	if address == "" {
+		address = DEFAULT_CLIENT_ADDRESS
+	}
+	config := api.DefaultConfig()
+	config.Address = address
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client: client}, nil
+}
+
+// Get the value of a key
+//  key:		the key we are interested in
+func (c *Client) Get(key string) (string, bool, error) {
+	pair, _, err := c.client.KV().Get(key, nil)
+	if err != nil {
+		return "", false, err
+	}
+	if pair == nil {
+		return "", false, nil
+	}
+	return string(pair.Value), true, nil
+}
+
+// Set the value of a key
+//  key:		the key you wish to set
+//  data:		the value of the key
+func (c *Client) Set(key, data string) error {
+	_, err := c.client.KV().Put(&api.KVPair{Key: key, Value: []byte(data)}, nil)
+	return err
+}
+
+// Set the key only if it has not been modified since the index
+//  key:		the key you wish to set
+//  data:		the value of the key
+//  index:		the modify index of the key, zero only sets the key if it does not exist
+func (c *Client) CompareAndSet(key, data string, index uint64) (bool, error) {
+	return c.casPair(&KeyPair{Key: key, Value: []byte(data)}, index)
+}
+
+// Delete a key
+//  key:		the key you wish to delete
+func (c *Client) Delete(key string) error {
+	_, err := c.client.KV().Delete(key, nil)
+	return err
+}
+
+// List the keys under the prefix, sorted by key
+//  prefix:		the prefix of the keys
+func (c *Client) List(prefix string) ([]*KeyPair, error) {
+	pairs, _, err := c.listPairs(prefix)
+	return pairs, err
+}
+
+// Watch for changes to the keys under a prefix
+//  prefix:		the prefix of the keys we are interested in
+//  options:	the filter and starting index for the watch, can be nil
+func (c *Client) Watch(prefix string, options *WatchOptions) (Subscription, error) {
+	filter, err := newKeyFilter(prefix, options)
+	if err != nil {
+		return nil, err
+	}
+	var index uint64
+	if options != nil {
+		index = options.Index
+	}
+	subscription := newKeySubscription(filter, options, nil)
+	go watchConsulKeys(c.client.KV(), prefix, index, DEFAULT_EVENT_VALUE_LIMIT,
+		subscription.stopChannel, subscription.send)
+
+	return subscription, nil
+}
+
+// Retrieve the nodes in the cluster, as seen by the node
+func (c *Client) Nodes() ([]*Node, error) {
+	members, err := c.client.Agent().Members(false)
+	if err != nil {
+		return nil, err
+	}
+	// step: find the current leader, we can live without it during an election
+	leader, _ := c.client.Status().Leader()
+	list := make([]*Node, 0, len(members))
+	for _, member := range members {
+		list = append(list, agentMemberToNode(member, leader))
+	}
+	return list, nil
+}
+
+// Convert the member from the http api into a node
+//  member:		the member from the agent
+//  leader:		the raft address of the leader i.e. <IPADDRESS>:<PORT>
+func agentMemberToNode(member *api.AgentMember, leader string) *Node {
+	return memberToNode(serf.Member{
+		Name:   member.Name,
+		Addr:   net.ParseIP(member.Addr),
+		Port:   member.Port,
+		Tags:   member.Tags,
+		Status: serf.MemberStatus(member.Status),
+	}, leader)
+}
+
+// Ask the node to join a member of a cluster
+//  member:		the endpoint address i.e. the <IPADDRESS>:<PORT>
+func (c *Client) Join(member string) error {
+	if !isEndpoint(member) {
+		return ErrInvalidMemberAddress
+	}
+	return c.client.Agent().Join(member, false)
+}
+
+// Write a consistent snapshot of the keys to the writer
+//  w:			the writer for the snapshot
+func (c *Client) Snapshot(w io.Writer) (*SnapshotMeta, error) {
+	pairs, index, err := c.listPairs("")
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &SnapshotMeta{Index: index, Time: time.Now().UTC()}
+	if self, err := c.client.Agent().Self(); err == nil {
+		snapshot.Node, _ = self["Config"]["NodeName"].(string)
+		snapshot.Datacenter, _ = self["Config"]["Datacenter"].(string)
+	}
+	if err := writeSnapshot(w, snapshot, pairs); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Replace the keys with those in a snapshot, once its checksum is verified
+//  reader:		the reader for the snapshot
+func (c *Client) Restore(reader io.Reader) (*SnapshotMeta, error) {
+	return restoreConsulKeys(c.client.KV(), reader)
+}
+
+// Write the keys under the prefix to the writer
+//  prefix:		the prefix of the keys exported
+//  format:		the format of the export, json, yaml or tree
+//  w:			the writer for the export
+func (c *Client) Export(prefix string, format ExportFormat, w io.Writer) error {
+	return exportKeys(c, prefix, format, w)
+}
+
+// Read the keys from an export into the store
+//  reader:		the reader for the export
+//  format:		the format of the export, json, yaml or tree
+//  options:	the options for the import, can be nil
+func (c *Client) Import(reader io.Reader, format ExportFormat, options *ImportOptions) (*ImportSummary, error) {
+	return importKeys(c, reader, format, options)
+}
+
+func (c *Client) listPairs(prefix string) ([]*KeyPair, uint64, error) {
+	return listConsulPairs(c.client.KV(), prefix)
+}
+
+func (c *Client) casPair(pair *KeyPair, index uint64) (bool, error) {
+	return casConsulPair(c.client.KV(), pair, index)
+}
+
+// Acquire a lock on the key, waiting for any holder to release it. The lock is
+// held by a session with the ttl, which is renewed at half the ttl until the
+// lock is released; if the client dies the lock is released once the ttl passes
+//  key:			the key to lock
+//  value:			the value set on the key while it's held
+//  ttl:			the time to live of the session holding the lock
+//  stopChannel:	closed to give up waiting on the lock, can be nil
+func (c *Client) Lock(key, value string, ttl time.Duration, stopChannel chan struct{}) (*Lock, error) {
+	if err := validateKeyTTL(ttl); err != nil {
+		return nil, err
+	}
+	session, _, err := c.client.Session().Create(&api.SessionEntry{
+		Name:      "distrostore-lock:" + key,
+		TTL:       ttl.String(),
+		Behavior:  "release",
+		LockDelay: time.Duration(1) * time.Millisecond,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock{
+		client:      c.client,
+		key:         key,
+		session:     session,
+		lost:        make(chan struct{}),
+		stopChannel: make(chan struct{}),
+	}
+	// step: the session must be kept alive while we wait, as well as once held
+	go lock.renew(ttl / 2)
+
+	var wait_index uint64
+	for {
+		acquired, _, err := c.client.KV().Acquire(&api.KVPair{Key: key, Value: []byte(value), Session: session}, nil)
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+		if acquired {
+			return lock, nil
+		}
+		select {
+		case <-stopChannel:
+			lock.Unlock()
+			return nil, ErrLockCancelled
+		case <-lock.lost:
+			lock.Unlock()
+			return nil, ErrLockCancelled
+		default:
+		}
+		// step: wait for the key to change before trying again, the blocking query is
+		// run aside so a cancel or a lost session doesn't wait out the wait time
+		changed := make(chan error, 1)
+		index := wait_index
+		go func() {
+			_, meta, err := c.client.KV().Get(key, &api.QueryOptions{WaitIndex: index, WaitTime: DEFAULT_WATCH_WAIT_TIME})
+			if err == nil {
+				index = meta.LastIndex
+			}
+			changed <- err
+		}()
+		select {
+		case <-stopChannel:
+			lock.Unlock()
+			return nil, ErrLockCancelled
+		case <-lock.lost:
+			lock.Unlock()
+			return nil, ErrLockCancelled
+		case err := <-changed:
+			if err != nil {
+				lock.Unlock()
+				return nil, err
+			}
+		}
+		wait_index = index
+	}
+}
+
+// a lock held on a key by the client
+type Lock struct {
+	// the client to the consul http api
+	client *api.Client
+	// the key being locked
+	key string
+	// the session holding the lock
+	session string
+	// closed when the session has been lost
+	lost chan struct{}
+	// closed to stop renewing the session
+	stopChannel chan struct{}
+	// ensures we only unlock once
+	once sync.Once
+}
+
+// The channel closed if the session holding the lock expires or is destroyed,
+// after which the lock is no longer held
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release the lock and destroy the session holding it; the session is destroyed
+// even if the release fails, which frees the lock anyway, and the first error is returned
+func (l *Lock) Unlock() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stopChannel)
+		defer func() {
+			if _, destroyErr := l.client.Session().Destroy(l.session, nil); err == nil {
+				err = destroyErr
+			}
+		}()
+		_, _, err = l.client.KV().Release(&api.KVPair{Key: l.key, Session: l.session}, nil)
+	})
+	return err
+}
+
+// Renew the session until the lock is released or the session is lost
+//  interval:	the time between the renewals
+func (l *Lock) renew(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopChannel:
+			return
+		case <-ticker.C:
+		}
+		entry, _, err := l.client.Session().Renew(l.session, nil)
+		if err != nil {
+			// step: we try again on the next tick, the ttl leaves room for one failure
+			continue
+		}
+		if entry == nil {
+			close(l.lost)
+			return
+		}
+	}
+}
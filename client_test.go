@@ -0,0 +1,49 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentMemberToNode(t *testing.T) {
+	member := &api.AgentMember{
+		Name:   "test1",
+		Addr:   "127.0.0.1",
+		Port:   8301,
+		Status: int(serf.StatusAlive),
+		Tags:   map[string]string{"role": "consul", "dc": "dc1", "port": "8300", "zone": "a"},
+	}
+	node := agentMemberToNode(member, "127.0.0.1:8300")
+	assert.Equal(t, "test1", node.ID)
+	assert.Equal(t, "127.0.0.1", node.Address)
+	assert.Equal(t, 8301, node.Port)
+	assert.Equal(t, NodeAlive, node.Status)
+	assert.Equal(t, NodeServer, node.Role)
+	assert.True(t, node.Leader, "the node should be the leader")
+	assert.Equal(t, "a", node.Tags["zone"])
+}
+
+func TestClientValidation(t *testing.T) {
+	client, err := NewClient("")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, ErrInvalidMemberAddress, client.Join("not an address"))
+	_, err = client.Lock("key", "", time.Second, nil)
+	assert.Equal(t, ErrInvalidTTL, err)
+}
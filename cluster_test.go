@@ -0,0 +1,276 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore_test
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/gambol99/distrostore"
+	"github.com/gambol99/distrostore/testcluster"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoining(t *testing.T) {
+	cluster := testcluster.New(t, 2, nil)
+	nodes, err := cluster.Store(0).Nodes()
+	assert.Nil(t, err, "unable to get a list of the node, error: %s", err)
+	assert.NotNil(t, nodes, "the list of node is nil")
+	assert.Equal(t, 2, len(nodes), "the nodes size should be two")
+}
+
+// Start a single node cluster for the integration tests
+//
+//	t:			the test the node belongs to
+//	configure:	called on the context of the node before it is started, can be nil
+func newTestStore(t *testing.T, configure func(cfg *ds.Context)) ds.DistroStore {
+	cluster := testcluster.New(t, 1, &testcluster.Options{
+		Configure: func(index int, cfg *ds.Context) {
+			cfg.Datacenter = "dc1"
+			cfg.NodeTags = map[string]string{"zone": "eu-west-1a"}
+			if configure != nil {
+				configure(cfg)
+			}
+		},
+	})
+	return cluster.Store(0)
+}
+
+// Write the key until the subscription sees it, i.e. the watch has taken its
+// first listing and is waiting on changes
+//
+//	store:			the store being watched
+//	subscription:	the subscription to the keys
+//	key:			a key matched by the subscription
+func waitForWatch(t *testing.T, store ds.DistroStore, subscription ds.Subscription, key string) {
+	testcluster.Eventually(t, 0, func() bool {
+		if err := store.Set(key, "ready"); err != nil {
+			return false
+		}
+		for {
+			select {
+			case event := <-subscription.Events():
+				if event.Key == key {
+					return true
+				}
+			case <-time.After(testcluster.DEFAULT_POLL_INTERVAL):
+				return false
+			}
+		}
+	}, "the watch did not see the key: %s", key)
+}
+
+// Wait for the next event on the subscription which isn't for the skipped key
+//
+//	subscription:	the subscription to the keys
+//	skip:			the key to ignore, i.e. the one from waitForWatch
+func nextKeyEvent(t *testing.T, subscription ds.Subscription, skip string) *ds.KeyAPIEvent {
+	timeout := time.After(testcluster.DEFAULT_TIMEOUT)
+	for {
+		select {
+		case event := <-subscription.Events():
+			if event.Key != skip {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("we did not recieve the key event in time")
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := newTestStore(t, nil)
+	subscription, err := server.Watch("watch/", &ds.WatchOptions{Glob: "watch/*/config"})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.NotNil(t, subscription, "we should have recieved a subscription")
+	defer subscription.Close()
+
+	waitForWatch(t, server, subscription, "watch/ready/config")
+	assert.Nil(t, server.Set("watch/web/port", "80"))
+	assert.Nil(t, server.Set("watch/web/config", "enabled"))
+
+	event := nextKeyEvent(t, subscription, "watch/ready/config")
+	assert.Equal(t, "watch/web/config", event.Key, "we should only see the filtered key")
+	assert.Equal(t, ds.KeySet, event.Status)
+	assert.Equal(t, []byte("enabled"), event.Value)
+}
+
+func TestWatchClose(t *testing.T) {
+	server := newTestStore(t, nil)
+	subscription, err := server.Watch("watch/", nil)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Nil(t, subscription.Close())
+	assert.Nil(t, subscription.Close(), "closing twice should be fine")
+	select {
+	case _, ok := <-subscription.Events():
+		assert.False(t, ok, "the events channel should have been closed")
+	case <-time.After(ds.DEFAULT_WATCH_WAIT_TIME + time.Duration(5)*time.Second):
+		t.Fatalf("the events channel was not closed")
+	}
+}
+
+func TestRemoveKeyListener(t *testing.T) {
+	server := newTestStore(t, nil)
+	removed := make(chan *ds.KeyAPIEvent, 10)
+	channel := make(chan *ds.KeyAPIEvent, 10)
+	server.AddKeyListener(removed)
+	server.AddKeyListener(channel)
+	server.RemoveKeyListener(removed)
+	defer server.RemoveKeyListener(channel)
+
+	// step: once the remaining listener has the event, the removed one would have too
+	testcluster.Eventually(t, 0, func() bool {
+		if err := server.Set("removed", "value"); err != nil {
+			return false
+		}
+		select {
+		case event := <-channel:
+			return event.Key == "removed"
+		case <-time.After(testcluster.DEFAULT_POLL_INTERVAL):
+			return false
+		}
+	}, "the listener did not recieve the key event")
+	select {
+	case event := <-removed:
+		t.Fatalf("we should not have recieved an event: %s", event)
+	default:
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	server := newTestStore(t, nil)
+	subscription, err := server.Watch("resume/", nil)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	waitForWatch(t, server, subscription, "resume/ready")
+	assert.Nil(t, server.Set("resume/first", "1"))
+	event := nextKeyEvent(t, subscription, "resume/ready")
+	assert.Equal(t, "resume/first", event.Key)
+	// step: the index moves on once the event has been handed over
+	testcluster.Eventually(t, 0, func() bool {
+		return subscription.LastIndex() >= event.ModifyIndex
+	}, "the last index should have been set")
+	index := subscription.LastIndex()
+	subscription.Close()
+
+	// step: make a change while we're not watching and resume from the index
+	assert.Nil(t, server.Set("resume/second", "2"))
+	subscription, err = server.Watch("resume/", &ds.WatchOptions{Index: index})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	defer subscription.Close()
+	event = nextKeyEvent(t, subscription, "")
+	assert.Equal(t, "resume/second", event.Key, "we should have replayed the missed change")
+	assert.Equal(t, ds.KeySet, event.Status)
+}
+
+func TestNodeTags(t *testing.T) {
+	server := newTestStore(t, nil)
+	nodes, err := server.Nodes()
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	if assert.Equal(t, 1, len(nodes)) {
+		assert.Equal(t, "eu-west-1a", nodes[0].Tags["zone"], "the node should advertise the serf tag")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	server := newTestStore(t, nil)
+	channel := make(chan *ds.UserEvent, 10)
+	server.AddEventListener("invalidate", channel)
+	defer server.RemoveEventListener(channel)
+
+	assert.Equal(t, ds.ErrUserEventTooLarge, server.Broadcast("invalidate", make([]byte, ds.MaxUserEventSize), false))
+	assert.Equal(t, ds.ErrInvalidEventName, server.Broadcast("", nil, false))
+	// step: the listener only sees the events fired after its first listing
+	testcluster.Eventually(t, 0, func() bool {
+		err := server.Broadcast("invalidate", []byte("cache"), false)
+		assert.Nil(t, err, "we should not recieve an error: %s", err)
+		select {
+		case event := <-channel:
+			assert.Equal(t, "invalidate", event.Name)
+			assert.Equal(t, []byte("cache"), event.Payload)
+			return true
+		case <-time.After(testcluster.DEFAULT_POLL_INTERVAL):
+			return false
+		}
+	}, "we did not recieve the user event in time")
+}
+
+func TestRegisterService(t *testing.T) {
+	server := newTestStore(t, nil)
+	handles, err := server.RegisterService(&ds.Service{Name: "web", Port: 8080, Meta: map[string]string{"version": "1.0"}},
+		&ds.ServiceCheck{Kind: ds.CheckTTL, TTL: time.Duration(10) * time.Second})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, 1, len(handles))
+	defer server.DeregisterService("web")
+
+	// step: the ttl check starts critical, so the service should not be passing
+	services, err := server.Services("web", true)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Empty(t, services)
+
+	err = handles[0].Pass("ready")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	testcluster.Eventually(t, 0, func() bool {
+		services, err = server.Services("web", true)
+		return err == nil && len(services) == 1
+	}, "the service did not become passing")
+	assert.Equal(t, 8080, services[0].Service.Port)
+	assert.Equal(t, "1.0", services[0].Service.Meta["version"])
+	assert.Equal(t, ds.HealthPassing, services[0].Status)
+
+	err = server.DeregisterService("web")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+}
+
+func TestWatchService(t *testing.T) {
+	server := newTestStore(t, nil)
+	subscription, err := server.WatchService("cache", "")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	defer subscription.Close()
+
+	handles, err := server.RegisterService(&ds.Service{Name: "cache", Port: 6379},
+		&ds.ServiceCheck{Kind: ds.CheckTTL, TTL: time.Duration(10) * time.Second})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	defer server.DeregisterService("cache")
+	handles[0].Pass("")
+
+	timeout := time.After(testcluster.DEFAULT_TIMEOUT)
+	for {
+		select {
+		case instances := <-subscription.Instances():
+			if len(instances) == 1 {
+				assert.Equal(t, 6379, instances[0].Service.Port)
+				return
+			}
+		case <-timeout:
+			t.Fatalf("we did not recieve the passing instance in time")
+		}
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	server := newTestStore(t, func(cfg *ds.Context) {
+		cfg.LeaveTimeout = time.Duration(2) * time.Second
+	})
+	channel := make(chan *ds.KeyAPIEvent, 10)
+	listener := server.AddKeyListener(channel)
+	err := server.Close()
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Nil(t, server.Close(), "a second close should not fail")
+	assert.Nil(t, server.Shutdown(true), "a shutdown after close should not fail")
+	<-listener.Done()
+	assert.Equal(t, ds.ErrStoreClosed, listener.Err(), "the listener should have been removed")
+
+	_, err = server.Watch("closed/", nil)
+	assert.Equal(t, ds.ErrStoreClosed, err)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	ds "github.com/gambol99/distrostore"
+	"github.com/gambol99/distrostore/metrics"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	agentCommand = kingpin.Command("agent", "run an embedded node until interrupted")
+	agentConfig  = agentCommand.Flag("config", "a json, yaml or toml config file, later files override earlier ones").Strings()
+	agentOffset  = agentCommand.Flag("port-offset", "add the offset to the ports, a negative offset allocates free ports").Int()
+	agentVerbose = agentCommand.Flag("verbose", "write the logs of the node and the embedded consul to stderr").Bool()
+	agentFormat  = agentCommand.Flag("log-format", "the format of the logs, the consul lines as they are or json records").Default("text").Enum("text", "json")
+	agentMetrics = agentCommand.Flag("metrics-address", "serve the prometheus metrics on /metrics at the address i.e. :9500").String()
+	// the flags for the settings of the context i.e. --bind-address, --members
+	agentFlags = ds.NewContextFlags()
+)
+
+func init() {
+	agentFlags.BindKingpin(agentCommand)
+}
+
+// Load the context from the config files, the environment and the flags
+func agentContext() (*ds.Context, error) {
+	config, err := ds.LoadContext(*agentConfig...)
+	if err != nil {
+		return nil, err
+	}
+	if err := agentFlags.Apply(config); err != nil {
+		return nil, err
+	}
+	if *agentVerbose {
+		config.LogOutput = os.Stderr
+		if *agentFormat == "json" {
+			// step: the records are filtered on the log level before reaching the handler
+			config.Logger = ds.NewSlogLogger(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: ds.LevelTrace}))
+		}
+	}
+	switch {
+	case *agentOffset > 0:
+		config.PortsConfig.ApplyIndex(*agentOffset)
+	case *agentOffset < 0:
+		config.PortsConfig = ds.PortConfig{}
+	}
+	return config, nil
+}
+
+// Run an embedded node until we are signalled, then leave the cluster; a
+// SIGHUP reloads the configuration
+func runAgent() {
+	config, err := agentContext()
+	if err != nil {
+		log.Fatalf("Failed to load the configuration, error: %s", err)
+	}
+	if config.DataDir == "" {
+		dir, err := ioutil.TempDir("", "distrostore")
+		if err != nil {
+			log.Fatalf("Failed to create the data directory, error: %s", err)
+		}
+		config.DataDir = dir
+		defer func() {
+			log.Printf("Removing the data directory: %s", dir)
+			os.RemoveAll(dir)
+		}()
+	}
+
+	// step: the collector is installed first, so it sees the metrics of the agent starting
+	if *agentMetrics != "" {
+		serveMetrics(*agentMetrics)
+	}
+
+	store, err := ds.New(config)
+	if err != nil {
+		log.Fatalf("Failed to create the distributed data store, error: %s", err)
+	}
+	log.Printf("Running the node, http api: %s:%d", config.ClientAddress, store.Config().PortsConfig.HTTP)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	for running := true; running; {
+		select {
+		case <-reload:
+			reloadAgent(store, config)
+		case <-terminate:
+			running = false
+		}
+	}
+	log.Printf("Leaving the cluster")
+	if err := store.Close(); err != nil {
+		log.Printf("Failed to leave the cluster gracefully, error: %s", err)
+	}
+}
+
+// Reload the configuration into the running node
+//  store:		the running node
+//  config:		the context the node was started with
+func reloadAgent(store ds.DistroStore, config *ds.Context) {
+	log.Printf("Reloading the configuration")
+	updated, err := agentContext()
+	if err != nil {
+		log.Printf("Failed to load the configuration, error: %s", err)
+		return
+	}
+	// step: the temporary data directory was made for this run
+	if updated.DataDir == "" {
+		updated.DataDir = config.DataDir
+	}
+	updated.LogOutput = config.LogOutput
+	updated.Logger = config.Logger
+	if err := store.Reload(updated); err != nil {
+		log.Printf("Failed to reload the configuration, error: %s", err)
+	}
+}
+
+// Install the prometheus collector and serve the metrics in the background
+//  address:	the address to listen on i.e. :9500
+func serveMetrics(address string) {
+	collector := metrics.NewCollector()
+	if err := collector.Install(); err != nil {
+		log.Fatalf("Failed to install the metrics collector, error: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector.Handler())
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Fatalf("Failed to serve the metrics on: %s, error: %s", address, err)
+		}
+	}()
+	log.Printf("Serving the metrics on: %s/metrics", address)
+}
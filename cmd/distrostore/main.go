@@ -0,0 +1,327 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The distrostore command runs an embedded node or talks to a running one
+// over its http api, so the cluster can be worked on without installing consul
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	ds "github.com/gambol99/distrostore"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	output  = kingpin.Flag("output", "the format of the output, json or table").Short('o').Default("table").Enum("json", "table")
+	address = kingpin.Flag("address", "the address of the http api of a node").Default(ds.DEFAULT_CLIENT_ADDRESS).Envar("DISTROSTORE_ADDRESS").String()
+
+	getCommand = kingpin.Command("get", "get the value of a key")
+	getKey     = getCommand.Arg("key", "the key to get").Required().String()
+
+	putCommand = kingpin.Command("put", "set the value of a key")
+	putKey     = putCommand.Arg("key", "the key to set").Required().String()
+	putValue   = putCommand.Arg("value", "the value of the key, - reads it from stdin").Required().String()
+	putCAS     = putCommand.Flag("cas", "only set the key if not modified since the index, zero only creates it").PlaceHolder("INDEX").String()
+
+	delCommand = kingpin.Command("del", "delete a key")
+	delKey     = delCommand.Arg("key", "the key to delete").Required().String()
+
+	lsCommand = kingpin.Command("ls", "list the keys under a prefix")
+	lsPrefix  = lsCommand.Arg("prefix", "the prefix of the keys").Default("").String()
+
+	watchCommand = kingpin.Command("watch", "print the changes to the keys under a prefix until interrupted")
+	watchPrefix  = watchCommand.Arg("prefix", "the prefix of the keys").Default("").String()
+	watchGlob    = watchCommand.Flag("glob", "a glob the keys must match").String()
+	watchIndex   = watchCommand.Flag("index", "replay the changes made since the index").Uint64()
+
+	membersCommand = kingpin.Command("members", "list the members of the cluster")
+
+	joinCommand = kingpin.Command("join", "ask the node to join a member of a cluster")
+	joinMember  = joinCommand.Arg("member", "the address of the member i.e. 10.0.0.1:8301").Required().String()
+
+	lockCommand = kingpin.Command("lock", "hold a lock on a key while running a command, or until interrupted")
+	lockKey     = lockCommand.Arg("key", "the key to lock").Required().String()
+	lockCmd     = lockCommand.Arg("command", "the command to run while holding the lock").Strings()
+	lockTTL     = lockCommand.Flag("ttl", "the ttl of the session holding the lock").Default("15s").Duration()
+	lockValue   = lockCommand.Flag("value", "the value set on the key while locked").String()
+
+	snapshotCommand     = kingpin.Command("snapshot", "save and restore snapshots of the keys")
+	snapshotSave        = snapshotCommand.Command("save", "save a snapshot of the keys, compressed if the file ends in .gz")
+	snapshotSaveFile    = snapshotSave.Arg("file", "the file to write the snapshot to").Required().String()
+	snapshotRestore     = snapshotCommand.Command("restore", "replace the keys with those in a snapshot")
+	snapshotRestoreFile = snapshotRestore.Arg("file", "the snapshot to restore").Required().String()
+
+	exportCommand = kingpin.Command("export", "export the keys under a prefix")
+	exportPrefix  = exportCommand.Arg("prefix", "the prefix of the keys").Default("").String()
+	exportFormat  = exportCommand.Flag("format", "the format of the export, json, yaml or tree").Default("json").Enum("json", "yaml", "tree")
+	exportFile    = exportCommand.Flag("file", "the file to write the export to, - for stdout").Default("-").String()
+
+	importCommand   = kingpin.Command("import", "import the keys from an export")
+	importFile      = importCommand.Arg("file", "the export to read, - for stdin").Default("-").String()
+	importFormat    = importCommand.Flag("format", "the format of the export, json, yaml or tree").Default("json").Enum("json", "yaml", "tree")
+	importPrefix    = importCommand.Flag("prefix", "a prefix added to each key imported").String()
+	importOverwrite = importCommand.Flag("overwrite", "replace the keys which already exist").Bool()
+	importDryRun    = importCommand.Flag("dry-run", "show the changes without making them").Bool()
+)
+
+func main() {
+	command := kingpin.Parse()
+	if command == agentCommand.FullCommand() {
+		runAgent()
+		return
+	}
+
+	client, err := ds.NewClient(*address)
+	if err != nil {
+		log.Fatalf("Failed to create the client, error: %s", err)
+	}
+	switch command {
+	case getCommand.FullCommand():
+		value, found, err := client.Get(*getKey)
+		if err != nil {
+			log.Fatalf("Failed to get the key: %s, error: %s", *getKey, err)
+		}
+		if !found {
+			log.Fatalf("The key: %s does not exist", *getKey)
+		}
+		printValue(*getKey, value)
+	case putCommand.FullCommand():
+		put(client)
+	case delCommand.FullCommand():
+		if err := client.Delete(*delKey); err != nil {
+			log.Fatalf("Failed to delete the key: %s, error: %s", *delKey, err)
+		}
+	case lsCommand.FullCommand():
+		pairs, err := client.List(*lsPrefix)
+		if err != nil {
+			log.Fatalf("Failed to list the keys, error: %s", err)
+		}
+		printKeys(pairs)
+	case watchCommand.FullCommand():
+		watch(client)
+	case membersCommand.FullCommand():
+		nodes, err := client.Nodes()
+		if err != nil {
+			log.Fatalf("Failed to list the members, error: %s", err)
+		}
+		printNodes(nodes)
+	case joinCommand.FullCommand():
+		if err := client.Join(*joinMember); err != nil {
+			log.Fatalf("Failed to join the member: %s, error: %s", *joinMember, err)
+		}
+	case lockCommand.FullCommand():
+		lock(client)
+	case snapshotSave.FullCommand():
+		saveSnapshot(client)
+	case snapshotRestore.FullCommand():
+		reader, err := ds.OpenSnapshot(*snapshotRestoreFile)
+		if err != nil {
+			log.Fatalf("Failed to open the snapshot: %s, error: %s", *snapshotRestoreFile, err)
+		}
+		defer reader.Close()
+		meta, err := client.Restore(reader)
+		if err != nil {
+			log.Fatalf("Failed to restore the snapshot, error: %s", err)
+		}
+		printSnapshot(*snapshotRestoreFile, meta)
+	case exportCommand.FullCommand():
+		writer := io.WriteCloser(os.Stdout)
+		if *exportFile != "-" {
+			if writer, err = os.Create(*exportFile); err != nil {
+				log.Fatalf("Failed to create the file: %s, error: %s", *exportFile, err)
+			}
+		}
+		defer writer.Close()
+		if err := client.Export(*exportPrefix, ds.ExportFormat(*exportFormat), writer); err != nil {
+			log.Fatalf("Failed to export the keys, error: %s", err)
+		}
+	case importCommand.FullCommand():
+		reader := io.ReadCloser(os.Stdin)
+		if *importFile != "-" {
+			if reader, err = os.Open(*importFile); err != nil {
+				log.Fatalf("Failed to open the file: %s, error: %s", *importFile, err)
+			}
+		}
+		defer reader.Close()
+		summary, err := client.Import(reader, ds.ExportFormat(*importFormat), &ds.ImportOptions{
+			Prefix:    *importPrefix,
+			Overwrite: *importOverwrite,
+			DryRun:    *importDryRun,
+		})
+		if err != nil {
+			// step: show the keys written or in conflict before the failure
+			if summary != nil {
+				printSummary(summary)
+			}
+			log.Fatalf("Failed to import the keys, error: %s", err)
+		}
+		printSummary(summary)
+	}
+}
+
+// Set the key, reading the value from stdin when it's a '-'
+//  client:		the client for the node
+func put(client *ds.Client) {
+	value := *putValue
+	if value == "-" {
+		content, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Failed to read the value from stdin, error: %s", err)
+		}
+		value = string(content)
+	}
+	if *putCAS == "" {
+		if err := client.Set(*putKey, value); err != nil {
+			log.Fatalf("Failed to set the key: %s, error: %s", *putKey, err)
+		}
+		return
+	}
+	index, err := strconv.ParseUint(*putCAS, 10, 64)
+	if err != nil {
+		log.Fatalf("The cas index: %s is not a valid index", *putCAS)
+	}
+	updated, err := client.CompareAndSet(*putKey, value, index)
+	if err != nil {
+		log.Fatalf("Failed to set the key: %s, error: %s", *putKey, err)
+	}
+	if !updated {
+		log.Fatalf("The key: %s has been modified since the index: %d", *putKey, index)
+	}
+}
+
+// Print the changes to the keys until interrupted
+//  client:		the client for the node
+func watch(client *ds.Client) {
+	subscription, err := client.Watch(*watchPrefix, &ds.WatchOptions{Glob: *watchGlob, Index: *watchIndex})
+	if err != nil {
+		log.Fatalf("Failed to watch the keys, error: %s", err)
+	}
+	defer subscription.Close()
+	signals := notifySignals()
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				log.Fatalf("The watch has been closed, error: %v", subscription.Err())
+			}
+			printEvent(event)
+		case <-signals:
+			return
+		}
+	}
+}
+
+// Hold the lock on the key while the command runs, or until interrupted; the
+// process exits with the exit code of the command
+//  client:		the client for the node
+func lock(client *ds.Client) {
+	signals := notifySignals()
+	stopChannel := make(chan struct{})
+	go func() {
+		<-signals
+		close(stopChannel)
+	}()
+	held, err := client.Lock(*lockKey, *lockValue, *lockTTL, stopChannel)
+	if err != nil {
+		log.Fatalf("Failed to acquire the lock on: %s, error: %s", *lockKey, err)
+	}
+	defer held.Unlock()
+	log.Printf("Acquired the lock on: %s", *lockKey)
+
+	if len(*lockCmd) == 0 {
+		select {
+		case <-stopChannel:
+		case <-held.Lost():
+			log.Printf("The lock on: %s has been lost", *lockKey)
+		}
+		return
+	}
+	command := exec.Command((*lockCmd)[0], (*lockCmd)[1:]...)
+	command.Stdin, command.Stdout, command.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := command.Start(); err != nil {
+		held.Unlock()
+		log.Fatalf("Failed to start the command, error: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-held.Lost():
+		// step: the command must not carry on without the lock
+		log.Printf("The lock on: %s has been lost, stopping the command", *lockKey)
+		command.Process.Signal(syscall.SIGTERM)
+		err = <-done
+	}
+	if err == nil {
+		return
+	}
+	// step: os.Exit skips the deferred unlock, so we release the lock first
+	held.Unlock()
+	log.Printf("The command failed, error: %s", err)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		os.Exit(exitErr.ExitCode())
+	}
+	os.Exit(1)
+}
+
+// Save a snapshot of the keys to the file, compressed if it ends in .gz
+//  client:		the client for the node
+func saveSnapshot(client *ds.Client) {
+	path := *snapshotSaveFile
+	// step: write to a temporary file, so a failed snapshot never replaces a good one
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		log.Fatalf("Failed to create the file: %s, error: %s", path, err)
+	}
+	writer := io.Writer(file)
+	var compressor *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		compressor = gzip.NewWriter(file)
+		writer = compressor
+	}
+	meta, err := client.Snapshot(writer)
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		log.Fatalf("Failed to save the snapshot, error: %s", err)
+	}
+	printSnapshot(path, meta)
+}
+
+// Relay the termination signals onto a channel
+func notifySignals() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	return signals
+}
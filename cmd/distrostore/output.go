@@ -0,0 +1,168 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	ds "github.com/gambol99/distrostore"
+)
+
+// a key in the json output
+type keyOutput struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Flags       uint64 `json:"flags,omitempty"`
+	ModifyIndex uint64 `json:"modify_index,omitempty"`
+}
+
+// a change to a key in the json output
+type eventOutput struct {
+	Key         string `json:"key"`
+	Status      string `json:"status"`
+	Value       string `json:"value,omitempty"`
+	ModifyIndex uint64 `json:"modify_index"`
+}
+
+// a member in the json output
+type nodeOutput struct {
+	Name       string            `json:"name"`
+	Address    string            `json:"address"`
+	Status     string            `json:"status"`
+	Role       string            `json:"role"`
+	Leader     bool              `json:"leader"`
+	Datacenter string            `json:"datacenter"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+func jsonOutput() bool {
+	return *output == "json"
+}
+
+// Write the value as indented json on stdout
+//  value:		the value to write
+func printJSON(value interface{}) {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode the output, error: %s", err)
+	}
+	fmt.Println(string(encoded))
+}
+
+// Write the rows as a table on stdout, the first row being the headings
+//  rows:		the rows of the table
+func printTable(rows [][]string) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	writer.Flush()
+}
+
+func printValue(key, value string) {
+	if jsonOutput() {
+		printJSON(&keyOutput{Key: key, Value: value})
+		return
+	}
+	fmt.Println(value)
+}
+
+func printKeys(pairs []*ds.KeyPair) {
+	if jsonOutput() {
+		list := make([]*keyOutput, 0, len(pairs))
+		for _, pair := range pairs {
+			list = append(list, &keyOutput{Key: pair.Key, Value: string(pair.Value), Flags: pair.Flags, ModifyIndex: pair.ModifyIndex})
+		}
+		printJSON(list)
+		return
+	}
+	rows := [][]string{{"KEY", "FLAGS", "INDEX", "SIZE"}}
+	for _, pair := range pairs {
+		rows = append(rows, []string{pair.Key, fmt.Sprintf("%d", pair.Flags),
+			fmt.Sprintf("%d", pair.ModifyIndex), fmt.Sprintf("%d", len(pair.Value))})
+	}
+	printTable(rows)
+}
+
+func printEvent(event *ds.KeyAPIEvent) {
+	if jsonOutput() {
+		// step: a line per event, so the output can be streamed into other tools
+		encoded, err := json.Marshal(&eventOutput{
+			Key:         event.Key,
+			Status:      event.Status.String(),
+			Value:       string(event.Value),
+			ModifyIndex: event.ModifyIndex,
+		})
+		if err != nil {
+			log.Fatalf("Failed to encode the output, error: %s", err)
+		}
+		fmt.Println(string(encoded))
+		return
+	}
+	fmt.Printf("%d\t%s\t%s\n", event.ModifyIndex, event.Status, event.Key)
+}
+
+func printNodes(nodes []*ds.Node) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	list := make([]*nodeOutput, 0, len(nodes))
+	for _, node := range nodes {
+		list = append(list, &nodeOutput{
+			Name:       node.ID,
+			Address:    net.JoinHostPort(node.Address, strconv.Itoa(node.Port)),
+			Status:     node.Status.String(),
+			Role:       node.Role.String(),
+			Leader:     node.Leader,
+			Datacenter: node.Datacenter,
+			Tags:       node.Tags,
+		})
+	}
+	if jsonOutput() {
+		printJSON(list)
+		return
+	}
+	rows := [][]string{{"NAME", "ADDRESS", "STATUS", "ROLE", "LEADER", "DC"}}
+	for _, node := range list {
+		rows = append(rows, []string{node.Name, node.Address, node.Status, node.Role,
+			fmt.Sprintf("%t", node.Leader), node.Datacenter})
+	}
+	printTable(rows)
+}
+
+func printSnapshot(path string, meta *ds.SnapshotMeta) {
+	if jsonOutput() {
+		printJSON(meta)
+		return
+	}
+	printTable([][]string{
+		{"FILE", "INDEX", "KEYS", "SIZE", "CHECKSUM"},
+		{path, fmt.Sprintf("%d", meta.Index), fmt.Sprintf("%d", meta.Keys),
+			fmt.Sprintf("%d", meta.Size), meta.Checksum},
+	})
+}
+
+func printSummary(summary *ds.ImportSummary) {
+	if jsonOutput() {
+		printJSON(summary)
+		return
+	}
+	fmt.Println(summary)
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore_test
+
+import (
+	"testing"
+
+	ds "github.com/gambol99/distrostore"
+	"github.com/gambol99/distrostore/distrostoretest"
+	"github.com/gambol99/distrostore/testcluster"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	distrostoretest.RunConformance(t, func() ds.DistroStore {
+		return ds.NewMemory()
+	})
+}
+
+func TestConsulConformance(t *testing.T) {
+	distrostoretest.RunConformance(t, func() ds.DistroStore {
+		return testcluster.New(t, 1, nil).Store(0)
+	})
+}
@@ -14,38 +14,78 @@ limitations under the License.
 package distrostore
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/command/agent"
+	"github.com/hashicorp/consul/consul"
+	"github.com/hashicorp/serf/serf"
 )
 
 const (
 	DEFAULT_WAIT_TIME = (time.Duration(120) * time.Second)
+	// the wait time for prefix watches, bounds how long a closed watch lingers
+	DEFAULT_WATCH_WAIT_TIME = (time.Duration(10) * time.Second)
+	// the interval between checking the cluster membership
+	DEFAULT_NODE_INTERVAL = (time.Duration(1) * time.Second)
+	// the maximum time to backoff on errors from the store
+	DEFAULT_MAX_BACKOFF = (time.Duration(30) * time.Second)
+	// the default time we wait on a graceful leave when closing
+	DEFAULT_LEAVE_TIMEOUT = (time.Duration(5) * time.Second)
 )
 
 type ConsulDistroStore struct {
 	sync.RWMutex
 	// the consul agent
 	agent *agent.Agent
+	// guards the agent and its http and dns servers, which are recreated when the tls settings are reloaded
+	agent_lock sync.RWMutex
+	// the digest of the tls settings and files the agent was started with
+	tls_digest string
 	// the cluster context config
 	context *Context
 	// the configuration for consul
 	config *agent.Config
 	// the client to the consul service
 	client *api.Client
+	// guards the client, which is replaced when the acl token is reloaded
+	client_lock sync.RWMutex
+	// filters the logs below the log level, passing them on to the logger
+	log_writer *levelWriter
 	// the consul http interface
 	http_api []*agent.HTTPServer
 	// the dns api
 	dns_api []*agent.DNSServer
-	// a map of those listening to key events
-	key_listeners map[chan *KeyAPIEvent]bool
-	// a map of those listening to node events
-	node_listeners map[chan *NodeAPIEvent]bool
+	// the dispatcher for those listening to key events
+	key_listeners *dispatcher
+	// the dispatcher for those listening to node events
+	node_listeners *dispatcher
+	// those listening to user events
+	event_listeners *eventListeners
+	// holds back the coalescing user events
+	coalescer *coalescer
+	// the checks we are running for the services, keyed by service id
+	service_checks map[string][]*checkRunner
+	// a map of the service watches
+	service_subscriptions map[*serviceSubscription]bool
+	// a map of the prefix watches
+	subscriptions map[*keySubscription]bool
+	// takes the scheduled snapshots
+	snapshots *snapshotScheduler
+	// closed when the store is shutting down
+	shutdown chan struct{}
+	// ensures the store is only closed once
+	close_once sync.Once
+	// the result of closing the store
+	close_err error
 }
 
 // Created a new node in the cluster
@@ -54,19 +94,60 @@ func NewConsulDistributedStore(cfg *Context) (DistroStore, error) {
 	var err error
 	service := new(ConsulDistroStore)
 	service.context = cfg
-	service.key_listeners = make(map[chan *KeyAPIEvent]bool, 0)
-	service.node_listeners = make(map[chan *NodeAPIEvent]bool, 0)
+	service.key_listeners = newDispatcher("key")
+	service.node_listeners = newDispatcher("node")
+	service.event_listeners = newEventListeners(cfg.ListenerBuffer, cfg.ListenerPolicy)
+	service.coalescer = newCoalescer(DEFAULT_COALESCE_PERIOD, service.event_listeners.publish)
+	service.subscriptions = make(map[*keySubscription]bool, 0)
+	service.service_checks = make(map[string][]*checkRunner, 0)
+	service.service_subscriptions = make(map[*serviceSubscription]bool, 0)
+	service.shutdown = make(chan struct{})
+
+	if err := validateNodeTags(cfg.NodeTags); err != nil {
+		return nil, err
+	}
+	if err := validateSnapshotConfig(&cfg.Snapshots); err != nil {
+		return nil, err
+	}
+	if cfg.LogOutput == nil {
+		cfg.LogOutput = ioutil.Discard
+	}
+	if service.log_writer, err = newLevelWriter(cfg.LogOutput, cfg.Logger, cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	service.snapshots = newSnapshotScheduler(cfg.Snapshots, service.Snapshot, service.isLeader)
+	service.snapshots.logger = service.log_writer
+	// step: fill in any zero ports, they are read back through Config()
+	if err := cfg.PortsConfig.AllocateFree(); err != nil {
+		return nil, err
+	}
 
 	// step: create the agent for the service
+	if service.tls_digest, err = tlsDigest(&cfg.TLS); err != nil {
+		return nil, err
+	}
 	if service.agent, err = service.createConsulAgent(cfg); err != nil {
+		service.Shutdown(true)
 		return nil, err
 	}
 
 	// step: create the client
 	if service.client, err = service.createConsulClient(cfg); err != nil {
+		service.Shutdown(true)
 		return nil, err
 	}
 
+	service.joinMembers(cfg.Members)
+
+	// step: start watching for key and membership changes
+	go service.watchKeys("", 0, service.shutdown, func(event *KeyAPIEvent) bool {
+		service.key_listeners.publish(event)
+		return true
+	})
+	go service.watchNodes()
+	go service.watchEvents()
+	go service.snapshots.run(service.shutdown)
+
 	return service, nil
 }
 
@@ -77,41 +158,59 @@ func (r *ConsulDistroStore) Config() *Context {
 func (r *ConsulDistroStore) createConsulAgent(cfg *Context) (*agent.Agent, error) {
 	var err error
 	var scadaList net.Listener
-
-	if cfg.LogOutput == nil {
-		cfg.LogOutput = ioutil.Discard
-	}
+	r.http_api, r.dns_api = nil, nil
 
 	// step: parse the context and fill in a config
 	if r.config, err = r.parseContext(cfg); err != nil {
-		return nil, nil
+		return nil, err
 	}
 	// step: create the actual agent
-	service, err := agent.Create(r.config, cfg.LogOutput)
+	service, err := agent.Create(r.config, r.log_writer)
 	if err != nil {
 		return nil, err
 	}
 
-	// step: join other members
-	if cfg.Members != nil && len(cfg.Members) > 0 {
-		_, err := service.JoinLAN(cfg.Members)
+	// step: start the http api, which the store makes all its requests through
+	if cfg.EnableHTTP {
+		r.http_api, err = agent.NewHTTPServers(service, r.config, scadaList, r.log_writer)
 		if err != nil {
-			return service, nil
+			service.Shutdown()
+			return nil, err
 		}
 	}
-
-	// step: wait for the service to be available
-
-	if cfg.EnableHTTP {
-		r.http_api, err = agent.NewHTTPServers(service, r.config, scadaList, cfg.LogOutput)
+	if cfg.EnableDNS {
+		address, err := r.config.ClientListener("", r.config.Ports.DNS)
 		if err != nil {
+			service.Shutdown()
 			return nil, err
 		}
+		server, err := agent.NewDNSServer(service, &r.config.DNSConfig, r.log_writer,
+			r.config.Domain, address.String(), r.config.DNSRecursors)
+		if err != nil {
+			service.Shutdown()
+			return nil, err
+		}
+		r.dns_api = append(r.dns_api, server)
 	}
 
 	return service, nil
 }
 
+// Join the members the node was started with; if none of them answer the node
+// still starts, and they are retried in the background until one does
+//  members:	the members to join
+func (r *ConsulDistroStore) joinMembers(members []string) {
+	if len(members) <= 0 {
+		return
+	}
+	joined, err := r.consulAgent().JoinLAN(members)
+	if err == nil && joined > 0 {
+		return
+	}
+	r.log_writer.Log(LogWarn, "unable to join the members, retrying in the background", "members", members, "error", err)
+	go r.retryJoin(members)
+}
+
 func (r *ConsulDistroStore) createConsulClient(cfg *Context) (*api.Client, error) {
 	address := r.config.ClientAddr
 	if address == "0.0.0.0" {
@@ -120,6 +219,7 @@ func (r *ConsulDistroStore) createConsulClient(cfg *Context) (*api.Client, error
 	config := api.DefaultConfig()
 	config.Address = fmt.Sprintf("%s:%d", address, r.config.Ports.HTTP)
 	config.Datacenter = r.config.Datacenter
+	config.Token = cfg.ACLToken
 	cli, err := api.NewClient(config)
 	if err != nil {
 		return nil, err
@@ -133,42 +233,192 @@ func (r *ConsulDistroStore) Join(member string) error {
 	if !isEndpoint(member) {
 		return ErrInvalidMemberAddress
 	}
-	_, err := r.agent.JoinLAN([]string{member})
+	_, err := r.consulAgent().JoinLAN([]string{member})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Leave the cluster gracefully and shutdown, waiting at most the LeaveTimeout on the leave
 func (r *ConsulDistroStore) Close() error {
-	if err := r.agent.Leave(); err != nil {
-		return err
+	return r.Shutdown(false)
+}
+
+// Shutdown the node, closing the subscriptions and listeners and stopping the agent
+//  force:		skip leaving the cluster, the peers will see the node as failed
+func (r *ConsulDistroStore) Shutdown(force bool) error {
+	if force {
+		return r.closeStore(nil, true)
 	}
-	if err := r.agent.Shutdown(); err != nil {
-		return err
+	timeout := DEFAULT_LEAVE_TIMEOUT
+	if r != nil && r.context != nil && r.context.LeaveTimeout > 0 {
+		timeout = r.context.LeaveTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return r.closeStore(ctx, false)
+}
+
+// Leave the cluster gracefully and shutdown, giving up on the leave when the context is done
+//  ctx:		the context bounding the leave
+func (r *ConsulDistroStore) CloseWithContext(ctx context.Context) error {
+	return r.closeStore(ctx, false)
+}
+
+// Close the store once, any further calls return the result of the first
+//  ctx:		the context bounding the leave
+//  force:		skip leaving the cluster
+func (r *ConsulDistroStore) closeStore(ctx context.Context, force bool) error {
+	if r == nil {
+		return nil
+	}
+	r.close_once.Do(func() {
+		r.close_err = r.shutdownStore(ctx, force)
+	})
+	return r.close_err
+}
+
+func (r *ConsulDistroStore) shutdownStore(ctx context.Context, force bool) error {
+	// step: stop the watchers and close any subscriptions and listeners
+	if r.shutdown != nil {
+		close(r.shutdown)
+	}
+	r.closeSubscriptions()
+	r.closeServiceSubscriptions()
+	if r.coalescer != nil {
+		r.coalescer.stop()
+	}
+	if r.key_listeners != nil {
+		r.key_listeners.close(ErrStoreClosed)
+	}
+	if r.node_listeners != nil {
+		r.node_listeners.close(ErrStoreClosed)
+	}
+	if r.event_listeners != nil {
+		r.event_listeners.close(ErrStoreClosed)
+	}
+
+	// step: leave the cluster, unless we are being forced down
+	r.agent_lock.Lock()
+	defer r.agent_lock.Unlock()
+	var err error
+	var leaving chan struct{}
+	if r.agent != nil && !force {
+		if leaving, err = r.leave(ctx); err != nil {
+			r.log_writer.Log(LogWarn, "unable to leave the cluster", "error", err)
+		}
+	}
+	if shutdownErr := r.stopAgent(); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+	// step: a leave we gave up on is still running, it returns once the agent is shutdown
+	if leaving != nil {
+		<-leaving
+	}
+	return err
+}
+
+// Stop the http and dns listeners and then the agent itself, called with the agent lock held
+func (r *ConsulDistroStore) stopAgent() error {
+	for _, server := range r.http_api {
+		server.Shutdown()
+	}
+	for _, server := range r.dns_api {
+		server.Shutdown()
+	}
+	if r.agent != nil {
+		return r.agent.Shutdown()
 	}
 	return nil
 }
 
+// The embedded agent, which is replaced when the tls settings are reloaded
+func (r *ConsulDistroStore) consulAgent() *agent.Agent {
+	r.agent_lock.RLock()
+	defer r.agent_lock.RUnlock()
+	return r.agent
+}
+
+// Leave the cluster, giving up waiting when the context is done; the leave
+// carries on until the agent is shutdown, the channel is closed once it returns
+//  ctx:		the context bounding the leave
+func (r *ConsulDistroStore) leave(ctx context.Context) (chan struct{}, error) {
+	finished := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- r.agent.Leave()
+		close(finished)
+	}()
+	if ctx == nil {
+		return finished, <-done
+	}
+	select {
+	case err := <-done:
+		return finished, err
+	case <-ctx.Done():
+		return finished, ErrLeaveTimeout
+	}
+}
+
 // Retrieve a list of node presently in the cluster
 func (r *ConsulDistroStore) Nodes() ([]*Node, error) {
 	list := make([]*Node, 0)
-	members := r.agent.LANMembers()
+	// step: find the current leader, we can live without it during an election
+	leader, _ := r.api().Status().Leader()
+	members := r.consulAgent().LANMembers()
 	for _, member := range members {
-		node := &Node{
-			ID:      member.Name,
-			Address: member.Addr.String(),
-			Port:    int(member.Port),
-		}
-		list = append(list, node)
+		list = append(list, memberToNode(member, leader))
 	}
 	return list, nil
 }
 
+// Convert the serf member into a node
+//  member:		the serf member
+//  leader:		the raft address of the leader i.e. <IPADDRESS>:<PORT>
+func memberToNode(member serf.Member, leader string) *Node {
+	node := &Node{
+		ID:         member.Name,
+		Address:    member.Addr.String(),
+		Port:       int(member.Port),
+		Status:     memberStatus(member.Status),
+		Role:       NodeClient,
+		Datacenter: member.Tags["dc"],
+		Tags:       make(map[string]string, len(member.Tags)),
+		Build:      member.Tags["build"],
+	}
+	for key, value := range member.Tags {
+		node.Tags[key] = value
+	}
+	if member.Tags["role"] == "consul" {
+		node.Role = NodeServer
+		node.Leader = leader != "" && leader == fmt.Sprintf("%s:%s", node.Address, member.Tags["port"])
+	}
+	if version, err := strconv.Atoi(member.Tags["vsn"]); err == nil {
+		node.Protocol = version
+	}
+	return node
+}
+
+func memberStatus(status serf.MemberStatus) NodeStatus {
+	switch status {
+	case serf.StatusAlive:
+		return NodeAlive
+	case serf.StatusLeaving:
+		return NodeLeaving
+	case serf.StatusLeft:
+		return NodeLeft
+	default:
+		return NodeFailed
+	}
+}
+
 // Get the value from the consul key/value store
 //  key:		the key we are interested in
 func (r *ConsulDistroStore) Get(key string) (string, bool, error) {
-	pair, _, err := r.kv().Get(key, nil)
+	start := time.Now()
+	pair, _, err := r.kv().Get(key, r.readOptions())
+	measureKeyOperation("get", start, err)
 	if err != nil {
 		return "", false, err
 	}
@@ -193,7 +443,80 @@ func (r *ConsulDistroStore) Set(key, data string) error {
 		Key:   key,
 		Value: []byte(data),
 	}
-	if _, err := r.kv().Put(keypair, nil); err != nil {
+	start := time.Now()
+	_, err := r.kv().Put(keypair, nil)
+	measureKeyOperation("set", start, err)
+	return err
+}
+
+// Delete a key from the consul k/v store
+//  key:		the key you wish to delete
+func (r *ConsulDistroStore) Delete(key string) error {
+	start := time.Now()
+	_, err := r.kv().Delete(key, nil)
+	measureKeyOperation("delete", start, err)
+	return err
+}
+
+// Get the modify index of a key, used with CompareAndSet
+//  key:		the key you are looking for
+func (r *ConsulDistroStore) GetIndex(key string) (uint64, bool, error) {
+	pair, _, err := r.kv().Get(key, r.readOptions())
+	if err != nil {
+		return 0, false, err
+	}
+	if pair == nil {
+		return 0, false, nil
+	}
+	return pair.ModifyIndex, true, nil
+}
+
+// Set the key only if it has not been modified since the index
+//  key: 	the key you wish to set
+//  data:	the value of the key
+//  index:	the modify index from GetIndex, zero only sets the key if it does not exist
+func (r *ConsulDistroStore) CompareAndSet(key, data string, index uint64) (bool, error) {
+	keypair := &api.KVPair{
+		Key:         key,
+		Value:       []byte(data),
+		ModifyIndex: index,
+	}
+	start := time.Now()
+	updated, _, err := r.kv().CAS(keypair, nil)
+	measureKeyOperation("cas", start, err)
+	if err != nil {
+		return false, err
+	}
+	if !updated {
+		countCASConflict()
+	}
+	return updated, nil
+}
+
+// Set a key which is deleted once the ttl has passed, the key is held by a
+// session with the ttl; consul may take up to twice the ttl to expire it
+//  key: 	the key you wish to set
+//  data:	the value of the key
+//  ttl:	the time to live for the key
+func (r *ConsulDistroStore) SetWithTTL(key, data string, ttl time.Duration) error {
+	if err := validateKeyTTL(ttl); err != nil {
+		return err
+	}
+	session, _, err := r.api().Session().Create(&api.SessionEntry{
+		Name:      "distrostore:" + key,
+		TTL:       ttl.String(),
+		Behavior:  "delete",
+		LockDelay: time.Duration(1) * time.Millisecond,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	acquired, _, err := r.kv().Acquire(&api.KVPair{Key: key, Value: []byte(data), Session: session}, nil)
+	if err == nil && !acquired {
+		err = ErrKeyLocked
+	}
+	if err != nil {
+		r.api().Session().Destroy(session, nil)
 		return err
 	}
 	return nil
@@ -201,21 +524,73 @@ func (r *ConsulDistroStore) Set(key, data string) error {
 
 // Add a listener for node membership events
 //  channel: 	the channel to pass the events upon
-func (r *ConsulDistroStore) AddNodeListener(channel chan *NodeAPIEvent) {
-	if _, found := r.node_listeners[channel]; !found {
-		r.Lock()
-		defer r.Unlock()
-		r.node_listeners[channel] = true
-	}
+func (r *ConsulDistroStore) AddNodeListener(channel chan *NodeAPIEvent) Listener {
+	return r.node_listeners.add(channel, r.context.ListenerBuffer, r.context.ListenerPolicy,
+		nodeChannelDeliver(channel), nil)
+}
+
+// Remove a listener for node membership events
+//  channel: 	the channel which was passed to AddNodeListener
+func (r *ConsulDistroStore) RemoveNodeListener(channel chan *NodeAPIEvent) {
+	r.node_listeners.remove(channel)
 }
 
 // Add a listener for key events
 //  channel: 	the channel to pass the events upon
-func (r *ConsulDistroStore) AddKeyListener(channel chan *KeyAPIEvent) {
-	if _, found := r.key_listeners[channel]; !found {
+func (r *ConsulDistroStore) AddKeyListener(channel chan *KeyAPIEvent) Listener {
+	return r.key_listeners.add(channel, r.context.ListenerBuffer, r.context.ListenerPolicy,
+		keyChannelDeliver(channel), nil)
+}
+
+// Remove a listener for key events
+//  channel: 	the channel which was passed to AddKeyListener
+func (r *ConsulDistroStore) RemoveKeyListener(channel chan *KeyAPIEvent) {
+	r.key_listeners.remove(channel)
+}
+
+// Watch for changes to the keys under a prefix
+//  prefix:		the prefix of the keys we are interested in
+//  options:	the filter and starting index for the watch, can be nil
+func (r *ConsulDistroStore) Watch(prefix string, options *WatchOptions) (Subscription, error) {
+	filter, err := newKeyFilter(prefix, options)
+	if err != nil {
+		return nil, err
+	}
+	var index uint64
+	if options != nil {
+		index = options.Index
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-r.shutdown:
+		return nil, ErrStoreClosed
+	default:
+	}
+
+	var subscription *keySubscription
+	subscription = newKeySubscription(filter, options, func() {
 		r.Lock()
 		defer r.Unlock()
-		r.key_listeners[channel] = true
+		delete(r.subscriptions, subscription)
+	})
+	r.subscriptions[subscription] = true
+
+	go r.watchKeys(prefix, index, subscription.stopChannel, subscription.send)
+
+	return subscription, nil
+}
+
+func (r *ConsulDistroStore) closeSubscriptions() {
+	r.RLock()
+	list := make([]*keySubscription, 0, len(r.subscriptions))
+	for subscription := range r.subscriptions {
+		list = append(list, subscription)
+	}
+	r.RUnlock()
+	for _, subscription := range list {
+		subscription.Close()
 	}
 }
 
@@ -227,33 +602,305 @@ func (r *ConsulDistroStore) waitIndex() (uint64, error) {
 	}
 }
 
-func (r *ConsulDistroStore) watchKeys() error {
-	// the wait index for consul
+// Watch the keys under the prefix and pass any changes to the handler
+//  prefix:			the prefix of the keys to watch
+//  index:			the index to start from, zero means from now
+//  stopChannel:	closed when we should stop watching
+//  handler:		called with each event, returning false stops the watch
+func (r *ConsulDistroStore) watchKeys(prefix string, index uint64, stopChannel chan struct{}, handler func(*KeyAPIEvent) bool) {
+	watchConsulKeys(r.kv(), prefix, index, r.context.EventValueLimit, stopChannel, handler)
+}
+
+// Watch the keys in consul under the prefix, with blocking listings of the prefix
+//  kv:				the consul k/v api
+//  prefix:			the prefix of the keys to watch
+//  index:			the index to start from, zero means from now
+//  limit:			the largest value to include in the events
+//  stopChannel:	closed when we should stop watching
+//  handler:		called with each event, returning false stops the watch
+func watchConsulKeys(kv *api.KV, prefix string, index uint64, limit int, stopChannel chan struct{}, handler func(*KeyAPIEvent) bool) {
+	// the wait index for consul, the first listing never blocks
 	var wait_index uint64
+	// the keys from the last listing
+	var keys map[string]*keyState
+	// the number of consecutive failures
+	failures := 0
+
+	wait_time := DEFAULT_WATCH_WAIT_TIME
+	if prefix == "" {
+		wait_time = DEFAULT_WAIT_TIME
+	}
 
 	for {
-		// get the wait index if not set
-		if idx, err := r.waitIndex(); err != nil {
-
-		} else {
-			wait_index = idx
+		select {
+		case <-stopChannel:
+			return
+		default:
 		}
 
 		// wait for any changes on in the keys
-		_, meta, err := r.kv().List("/", &api.QueryOptions{WaitIndex: wait_index,
-			WaitTime: DEFAULT_WAIT_TIME})
+		pairs, meta, err := kv.List(prefix, &api.QueryOptions{WaitIndex: wait_index,
+			WaitTime: wait_time})
 		if err != nil {
 			// we need to backoff and wait for a bit
-
+			failures++
+			if !backoff(failures, stopChannel) {
+				return
+			}
 			continue
 		}
+		failures = 0
+
+		var events []*KeyAPIEvent
+		if needsResync(keys, pairs, index, wait_index, meta.LastIndex) {
+			// step: we can't work out what changed, take the listing as the baseline
+			keys, _ = diffKeys(nil, pairs, 0, meta.LastIndex, limit)
+			events = []*KeyAPIEvent{{Key: prefix, Status: KeyResync, ModifyIndex: meta.LastIndex}}
+		} else {
+			keys, events = diffKeys(keys, pairs, index, meta.LastIndex, limit)
+		}
+		for _, event := range events {
+			if !handler(event) {
+				return
+			}
+		}
+
 		// update the index
 		wait_index = meta.LastIndex
 	}
 }
 
+// Check if the watch is unable to diff the listing and needs to resync
+//  previous:	the keys from the last listing, nil if none
+//  pairs:		the current listing of the keys
+//  since:		the index the watch was resumed from, zero if none
+//  waitIndex:	the index of the last listing
+//  index:		the index of the current listing
+func needsResync(previous map[string]*keyState, pairs api.KVPairs, since, waitIndex, index uint64) bool {
+	// step: if the index has gone backwards the store has been reset or restored
+	if previous != nil {
+		return index < waitIndex
+	}
+	if since == 0 {
+		return false
+	}
+	// step: the highest index of the keys under the prefix
+	var highest uint64
+	for _, pair := range pairs {
+		if pair.ModifyIndex > highest {
+			highest = pair.ModifyIndex
+		}
+	}
+	// step: consul only scopes the listing index to the prefix when there are keys
+	// under it, i.e. the highest of the keys and the tombstones of those deleted;
+	// an empty listing carries the index of the whole table, which any write
+	// outside the prefix moves on. So without keys all we can tell is whether the
+	// store was ahead of the index, and a resync of an empty prefix is cheap
+	if len(pairs) == 0 {
+		return since > 0 && index != since
+	}
+	if highest > since {
+		// step: the keys have changed since the index, and can be replayed unless a
+		// tombstone under the prefix is newer than any of the live keys
+		return index > highest
+	}
+	// step: nothing under the prefix has changed since the index, unless a key was
+	// deleted after it; a store behind the index has been reset or restored
+	return index != since
+}
+
+// the state held for a key between listings
+type keyState struct {
+	// the index the key was created at
+	createIndex uint64
+	// the index the key was last modified at
+	modifyIndex uint64
+	// the value of the key, nil when larger than the limit
+	value []byte
+	// the value was larger than the limit
+	omitted bool
+}
+
+// Compare the listing against the previous one and generate the events
+//  previous:	the keys from the last listing, nil if none
+//  pairs:		the current listing of the keys
+//  since:		on the first listing, generate events for keys changed after this index
+//  index:		the index of the current listing
+//  limit:		the largest value to include in the events
+func diffKeys(previous map[string]*keyState, pairs api.KVPairs, since, index uint64, limit int) (map[string]*keyState, []*KeyAPIEvent) {
+	current := make(map[string]*keyState, len(pairs))
+	changed := make([]*api.KVPair, 0)
+	events := make([]*KeyAPIEvent, 0)
+
+	for _, pair := range pairs {
+		state := &keyState{createIndex: pair.CreateIndex, modifyIndex: pair.ModifyIndex}
+		if len(pair.Value) <= limit {
+			state.value = pair.Value
+		} else {
+			state.omitted = true
+		}
+		current[pair.Key] = state
+
+		if previous == nil {
+			if since > 0 && pair.ModifyIndex > since {
+				changed = append(changed, pair)
+			}
+			continue
+		}
+		if before, found := previous[pair.Key]; !found || before.modifyIndex != pair.ModifyIndex {
+			changed = append(changed, pair)
+		}
+	}
+
+	// step: order the changes as they were applied to the store
+	sort.Sort(byModifyIndex(changed))
+	for _, pair := range changed {
+		state := current[pair.Key]
+		event := &KeyAPIEvent{
+			Key:          pair.Key,
+			Status:       KeyChanged,
+			Value:        state.value,
+			ValueOmitted: state.omitted,
+			CreateIndex:  pair.CreateIndex,
+			ModifyIndex:  pair.ModifyIndex,
+			Flags:        pair.Flags,
+			Session:      pair.Session,
+		}
+		if before, found := previous[pair.Key]; found {
+			event.PrevValue = before.value
+			event.ValueOmitted = event.ValueOmitted || before.omitted
+		} else if previous != nil || pair.CreateIndex > since {
+			event.Status = KeySet
+		}
+		events = append(events, event)
+	}
+
+	// step: anything we had before and is no longer present has been deleted
+	deleted := make([]string, 0)
+	for key := range previous {
+		if _, found := current[key]; !found {
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Strings(deleted)
+	for _, key := range deleted {
+		before := previous[key]
+		events = append(events, &KeyAPIEvent{
+			Key:          key,
+			Status:       KeyDeleted,
+			PrevValue:    before.value,
+			ValueOmitted: before.omitted,
+			CreateIndex:  before.createIndex,
+			ModifyIndex:  index,
+		})
+	}
+
+	return current, events
+}
+
+type byModifyIndex api.KVPairs
+
+func (b byModifyIndex) Len() int           { return len(b) }
+func (b byModifyIndex) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byModifyIndex) Less(i, j int) bool { return b[i].ModifyIndex < b[j].ModifyIndex }
+
+// Watch the cluster membership and pass any changes to the node listeners
+func (r *ConsulDistroStore) watchNodes() {
+	// the members from the last check
+	var members map[string]*Node
+	// the last raft term seen
+	var term uint64
+
+	ticker := time.NewTicker(DEFAULT_NODE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.shutdown:
+			return
+		case <-ticker.C:
+		}
+		nodes, err := r.Nodes()
+		if err != nil {
+			continue
+		}
+		emitMemberCounts(nodes)
+		term = countLeaderChange(term, r.raftTerm())
+		r.emitRaftMetrics()
+
+		var events []*NodeAPIEvent
+		members, events = diffNodes(members, nodes)
+		for _, event := range events {
+			level := LogInfo
+			if event.Status == NodeEventUpdated {
+				level = LogDebug
+			}
+			r.log_writer.Log(level, "member "+event.Status.String(), "node", event.Node.ID, "address", event.Node.Address)
+			r.node_listeners.publish(event)
+		}
+	}
+}
+
+// Compare the membership against the previous one and generate the events
+//  previous:	the nodes from the last check, nil if none
+//  nodes:		the current list of nodes
+func diffNodes(previous map[string]*Node, nodes []*Node) (map[string]*Node, []*NodeAPIEvent) {
+	current := make(map[string]*Node, len(nodes))
+	events := make([]*NodeAPIEvent, 0)
+	for _, node := range nodes {
+		current[node.ID] = node
+		if previous == nil {
+			continue
+		}
+		before, found := previous[node.ID]
+		switch {
+		case !found, before.Status != node.Status:
+			events = append(events, &NodeAPIEvent{Node: node, Status: nodeEventStatus(node.Status)})
+		case before.changed(node):
+			events = append(events, &NodeAPIEvent{Node: node, Status: NodeEventUpdated})
+		}
+	}
+	// step: members which have been reaped are gone for good
+	for id, node := range previous {
+		if _, found := current[id]; !found && node.Status != NodeLeft && node.Status != NodeFailed {
+			events = append(events, &NodeAPIEvent{Node: node, Status: NodeEventLeft})
+		}
+	}
+	return current, events
+}
+
+// The event status for a node moving into the status
+//  status:		the status the node has moved into
+func nodeEventStatus(status NodeStatus) NodeEventStatus {
+	switch status {
+	case NodeAlive:
+		return NodeEventJoined
+	case NodeLeft:
+		return NodeEventLeft
+	case NodeFailed:
+		return NodeEventFailed
+	default:
+		return NodeEventUpdated
+	}
+}
+
 func (r *ConsulDistroStore) kv() *api.KV {
-	return r.client.KV()
+	return r.api().KV()
+}
+
+// The client to the consul http api
+func (r *ConsulDistroStore) api() *api.Client {
+	r.client_lock.RLock()
+	defer r.client_lock.RUnlock()
+	return r.client
+}
+
+// The options for reading a key, the consistent mode goes through a quorum of
+// the servers, so the read can't be served by a deposed leader
+func (r *ConsulDistroStore) readOptions() *api.QueryOptions {
+	if r.context.ConsistentReads {
+		return &api.QueryOptions{RequireConsistent: true}
+	}
+	return nil
 }
 
 func (r *ConsulDistroStore) parseContext(cfg *Context) (*agent.Config, error) {
@@ -264,10 +911,18 @@ func (r *ConsulDistroStore) parseContext(cfg *Context) (*agent.Config, error) {
 	config.Bootstrap = cfg.Bootstrap
 	config.EncryptKey = cfg.EncryptKey
 	config.NodeName = cfg.NodeName
-	config.LogLevel = "NONE"
+	// step: the lines are filtered by the log writer, the agent only reports the level
+	config.LogLevel = DEFAULT_LOG_LEVEL
+	if cfg.LogLevel != "" {
+		config.LogLevel = strings.ToUpper(cfg.LogLevel)
+	}
 	config.Datacenter = cfg.Datacenter
-	config.VerifyIncoming = false
-	config.VerifyOutgoing = false
+	config.VerifyIncoming = cfg.TLS.VerifyIncoming
+	config.VerifyOutgoing = cfg.TLS.VerifyOutgoing
+	config.CAFile = cfg.TLS.CAFile
+	config.CertFile = cfg.TLS.CertFile
+	config.KeyFile = cfg.TLS.KeyFile
+	config.ACLToken = cfg.ACLToken
 	config.BindAddr = cfg.BindAddress
 	config.AdvertiseAddr = cfg.BindAdvertised
 	config.ClientAddr = cfg.ClientAddress
@@ -281,6 +936,15 @@ func (r *ConsulDistroStore) parseContext(cfg *Context) (*agent.Config, error) {
 		Server:  cfg.PortsConfig.Server,
 	}
 	config.StartJoin = cfg.Members
+	// step: the application tags are advertised alongside consul's own serf tags;
+	// consul keeps the serf instance to itself, so they are fixed once started
+	config.ConsulConfig = consul.DefaultConfig()
+	if config.ConsulConfig.SerfLANConfig.Tags == nil {
+		config.ConsulConfig.SerfLANConfig.Tags = make(map[string]string, 0)
+	}
+	for key, value := range cfg.NodeTags {
+		config.ConsulConfig.SerfLANConfig.Tags[key] = value
+	}
 	//config.RetryInterval = time.Duration(2) * time.Second
 	//config.RetryMaxAttempts = 3
 	return config, nil
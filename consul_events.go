@@ -0,0 +1,171 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Watch the user events received by the agent and pass on the new ones
+func (r *ConsulDistroStore) watchEvents() {
+	// the wait index for consul
+	var wait_index uint64
+	// the position in the events we have handled
+	cursor := new(eventCursor)
+	// the number of consecutive failures
+	failures := 0
+
+	for {
+		select {
+		case <-r.shutdown:
+			return
+		default:
+		}
+
+		events, meta, err := r.api().Event().List("", &api.QueryOptions{WaitIndex: wait_index,
+			WaitTime: DEFAULT_WAIT_TIME})
+		if err != nil {
+			failures++
+			if !backoff(failures, r.shutdown) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		wait_index = meta.LastIndex
+
+		// step: the agent hands back its recent events, find those we have not handled
+		for _, event := range cursor.next(events) {
+			r.handleEvent(event)
+		}
+	}
+}
+
+// tracks the user events which have been handled, as the agent lists all of
+// the recent events it has received on each call
+type eventCursor struct {
+	// the id of the last event listed, the agent lists them in the order received
+	last_id string
+	// the highest lamport time listed, used once the last event has rotated out
+	ltime uint64
+	// set once the first listing has been taken
+	started bool
+}
+
+// Find the events after those already handled. The first listing is the
+// history from before we started, so nothing in it is passed on; after that the
+// events following the last one listed are new, and if it has rotated out of
+// the agent's buffer those beyond the highest lamport time are
+//  events:		the recent events from the agent, oldest first
+func (c *eventCursor) next(events []*api.UserEvent) []*api.UserEvent {
+	found := make([]*api.UserEvent, 0)
+	if c.started {
+		position := -1
+		for i := len(events) - 1; i >= 0 && c.last_id != ""; i-- {
+			if events[i].ID == c.last_id {
+				position = i
+				break
+			}
+		}
+		if position >= 0 {
+			found = append(found, events[position+1:]...)
+		} else {
+			for _, event := range events {
+				if event.LTime > c.ltime {
+					found = append(found, event)
+				}
+			}
+		}
+	}
+	c.started = true
+	for _, event := range events {
+		if event.LTime > c.ltime {
+			c.ltime = event.LTime
+		}
+	}
+	if len(events) > 0 {
+		c.last_id = events[len(events)-1].ID
+	}
+	return found
+}
+
+// Handle a user event received by the agent
+//  event:		the user event
+func (r *ConsulDistroStore) handleEvent(event *api.UserEvent) {
+	switch {
+	case strings.HasPrefix(event.Name, coalesceEventPrefix):
+		r.coalescer.add(&UserEvent{
+			ID:       event.ID,
+			Name:     strings.TrimPrefix(event.Name, coalesceEventPrefix),
+			Payload:  event.Payload,
+			LTime:    event.LTime,
+			Coalesce: true,
+		})
+	case strings.HasPrefix(event.Name, internalEventPrefix):
+		// an internal event we don't know about, ignore it
+	default:
+		r.event_listeners.publish(&UserEvent{
+			ID:      event.ID,
+			Name:    event.Name,
+			Payload: event.Payload,
+			LTime:   event.LTime,
+		})
+	}
+}
+
+// Broadcast a user event to every node in the cluster, the event is gossiped
+// rather than written through raft so delivery is best effort
+//  name:		the name of the event
+//  payload:	the payload of the event, limited to MaxUserEventSize with the name
+//  coalesce:	when set a burst of events of the same name are delivered as the latest one
+func (r *ConsulDistroStore) Broadcast(name string, payload []byte, coalesce bool) error {
+	wire, err := validateUserEvent(name, payload, coalesce)
+	if err != nil {
+		return err
+	}
+	_, _, err = r.api().Event().Fire(&api.UserEvent{Name: wire, Payload: payload}, nil)
+	return err
+}
+
+// Add a listener for user events
+//  name:		the name of the events, empty for all of them
+//  channel:	the channel to pass the events upon
+func (r *ConsulDistroStore) AddEventListener(name string, channel chan *UserEvent) Listener {
+	return r.event_listeners.add(name, channel)
+}
+
+// Remove a listener for user events
+//  channel:	the channel which was passed to AddEventListener
+func (r *ConsulDistroStore) RemoveEventListener(channel chan *UserEvent) {
+	r.event_listeners.remove(channel)
+}
+
+// Query the nodes in the cluster. The embedded consul (v0.5.2) keeps its serf
+// instance to itself and has no api for serf queries, so rather than emulate
+// them the queries are unsupported; Broadcast and the key/value store remain
+//  name:		the name of the query
+//  payload:	the payload passed to the handlers
+//  options:	the filters and timeout for the query, can be nil
+func (r *ConsulDistroStore) Query(name string, payload []byte, options *QueryOptions) (*QueryResponse, error) {
+	return nil, ErrQueryUnsupported
+}
+
+// Register the handler for queries of the given name, unsupported as with Query
+//  name:		the name of the query
+//  handler:	the handler which produces the response
+func (r *ConsulDistroStore) HandleQuery(name string, handler QueryHandler) error {
+	return ErrQueryUnsupported
+}
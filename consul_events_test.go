@@ -0,0 +1,48 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventCursor(t *testing.T) {
+	cursor := new(eventCursor)
+	events := []*api.UserEvent{{ID: "1", LTime: 1}, {ID: "2", LTime: 2}, {ID: "3", LTime: 3}}
+	assert.Empty(t, cursor.next(events), "the first listing should not replay the history")
+	assert.Empty(t, cursor.next(events), "there should be no new events")
+
+	// step: an event arriving late has a lower lamport time, but follows the last one listed
+	events = append(events, &api.UserEvent{ID: "4", LTime: 2}, &api.UserEvent{ID: "5", LTime: 4})
+	found := cursor.next(events)
+	if assert.Equal(t, 2, len(found), "we should only have the new events") {
+		assert.Equal(t, "4", found[0].ID)
+		assert.Equal(t, "5", found[1].ID)
+	}
+
+	// step: the last event has rotated out, only those beyond the highest lamport time are new
+	rotated := []*api.UserEvent{{ID: "6", LTime: 4}, {ID: "7", LTime: 5}}
+	found = cursor.next(rotated)
+	if assert.Equal(t, 1, len(found), "the rotated events should not be redelivered") {
+		assert.Equal(t, "7", found[0].ID)
+	}
+
+	// step: an empty first listing means anything after it is new
+	cursor = new(eventCursor)
+	assert.Empty(t, cursor.next(nil))
+	assert.Equal(t, 3, len(cursor.next(events[:3])), "events after an empty listing should all be new")
+}
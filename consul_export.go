@@ -0,0 +1,83 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"io"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Write the keys under the prefix to the writer
+//  prefix:		the prefix of the keys exported
+//  format:		the format of the export, json, yaml or tree
+//  w:			the writer for the export
+func (r *ConsulDistroStore) Export(prefix string, format ExportFormat, w io.Writer) error {
+	return exportKeys(r, prefix, format, w)
+}
+
+// Read the keys from an export into the store
+//  reader:		the reader for the export
+//  format:		the format of the export, json, yaml or tree
+//  options:	the options for the import, can be nil
+func (r *ConsulDistroStore) Import(reader io.Reader, format ExportFormat, options *ImportOptions) (*ImportSummary, error) {
+	return importKeys(r, reader, format, options)
+}
+
+// List the keys under the prefix in the consistent mode
+//  prefix:		the prefix of the keys
+func (r *ConsulDistroStore) listPairs(prefix string) ([]*KeyPair, uint64, error) {
+	return listConsulPairs(r.kv(), prefix)
+}
+
+// Set the key if it has not been modified since the index
+//  pair:		the key to set
+//  index:		the modify index, zero only creates the key
+func (r *ConsulDistroStore) casPair(pair *KeyPair, index uint64) (bool, error) {
+	return casConsulPair(r.kv(), pair, index)
+}
+
+// List the keys under the prefix from consul in the consistent mode
+//  kv:			the consul k/v api
+//  prefix:		the prefix of the keys
+func listConsulPairs(kv *api.KV, prefix string) ([]*KeyPair, uint64, error) {
+	pairs, meta, err := kv.List(prefix, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	list := make([]*KeyPair, 0, len(pairs))
+	for _, pair := range pairs {
+		list = append(list, &KeyPair{
+			Key:         pair.Key,
+			Flags:       pair.Flags,
+			Value:       pair.Value,
+			ModifyIndex: pair.ModifyIndex,
+		})
+	}
+	return list, meta.LastIndex, nil
+}
+
+// Set the key in consul if it has not been modified since the index
+//  kv:			the consul k/v api
+//  pair:		the key to set
+//  index:		the modify index, zero only creates the key
+func casConsulPair(kv *api.KV, pair *KeyPair, index uint64) (bool, error) {
+	updated, _, err := kv.CAS(&api.KVPair{
+		Key:         pair.Key,
+		Flags:       pair.Flags,
+		Value:       pair.Value,
+		ModifyIndex: index,
+	}, nil)
+	return updated, err
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// Apply a new context to the running node, i.e. on a SIGHUP. The log level,
+// members, snapshot settings, acl token and tls settings are changed live: new
+// members are joined in the background until one of them answers, the acl
+// token is used for the requests made by the store from now on, and the agent
+// is restarted in place when the tls settings or the files they name have
+// changed, as the embedded consul only loads its certificates when it starts.
+// Everything else is only read when the node starts, including the node tags
+// which are serf tags, so any of those which differ are returned in a
+// RestartRequiredError, after the live settings have been applied
+//  cfg:		the new context i.e. from LoadContext
+func (r *ConsulDistroStore) Reload(cfg *Context) error {
+	if err := validateReload(cfg); err != nil {
+		return err
+	}
+	r.RLock()
+	current := *r.context
+	r.RUnlock()
+	live, restart := splitReloadable(diffContext(&current, cfg))
+
+	// step: the certificates can be replaced under the same paths, so the files are compared too
+	digest, err := tlsDigest(&cfg.TLS)
+	if err != nil {
+		return err
+	}
+	if digest != r.tlsDigest() {
+		if err := r.reloadTLS(&current, &cfg.TLS, digest); err != nil {
+			return err
+		}
+		live["TLS"] = true
+	}
+	if live["LogLevel"] {
+		if err := r.log_writer.SetLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+	if live["ACLToken"] {
+		// step: the consul client has no way to change the token, so we replace it
+		client, err := r.createConsulClient(cfg)
+		if err != nil {
+			return err
+		}
+		r.client_lock.Lock()
+		r.client = client
+		r.client_lock.Unlock()
+	}
+	if added := addedMembers(current.Members, cfg.Members); len(added) > 0 {
+		go r.retryJoin(added)
+	}
+	if snapshotsChanged(live) {
+		r.snapshots.configure(cfg.Snapshots)
+	}
+
+	// step: record the live settings, so the next reload is compared against them
+	r.Lock()
+	r.context.LogLevel = cfg.LogLevel
+	r.context.ACLToken = cfg.ACLToken
+	r.context.Members = append([]string{}, cfg.Members...)
+	r.context.Snapshots = cfg.Snapshots
+	r.context.TLS = cfg.TLS
+	r.Unlock()
+
+	if len(live) > 0 {
+		changed := make([]string, 0, len(live))
+		for name := range live {
+			changed = append(changed, name)
+		}
+		sort.Strings(changed)
+		r.log_writer.Log(LogInfo, "reloaded the context", "changed", changed)
+	}
+
+	return reloadResult(restart)
+}
+
+// Join the members, retrying with a backoff until one of them answers or the
+// store is shutdown
+//  members:	the members to join
+func (r *ConsulDistroStore) retryJoin(members []string) {
+	failures := 0
+	for {
+		joined, err := r.consulAgent().JoinLAN(members)
+		if err == nil && joined > 0 {
+			r.log_writer.Log(LogInfo, "joined the members", "members", members, "joined", joined)
+			return
+		}
+		failures++
+		r.log_writer.Log(LogWarn, "unable to join the members", "members", members, "error", err, "attempts", failures)
+		if !backoff(failures, r.shutdown) {
+			return
+		}
+	}
+}
+
+// Restart the agent with the new tls settings, as the embedded consul only
+// loads its certificates when it starts. The certificates are checked first,
+// then the agent is shutdown without leaving and created again on the same data
+// directory and ports, rejoining the members it could see; if it fails to start
+// with the new settings it is started again with the old ones
+//  current:	the context the node is running with
+//  config:		the new tls settings
+//  digest:		the digest of the new tls settings and files
+func (r *ConsulDistroStore) reloadTLS(current *Context, config *TLSConfig, digest string) error {
+	if err := validateTLS(config); err != nil {
+		return err
+	}
+	r.agent_lock.Lock()
+	defer r.agent_lock.Unlock()
+	select {
+	case <-r.shutdown:
+		return ErrStoreClosed
+	default:
+	}
+	// step: the peers see the node fail while it restarts, so we join them again after
+	members := make([]string, 0)
+	for _, member := range r.agent.LANMembers() {
+		if member.Name != r.config.NodeName && member.Status == serf.StatusAlive {
+			members = append(members, fmt.Sprintf("%s:%d", member.Addr, member.Port))
+		}
+	}
+	if err := r.stopAgent(); err != nil {
+		r.log_writer.Log(LogWarn, "unable to stop the agent cleanly for the tls reload", "error", err)
+	}
+
+	updated := *current
+	updated.TLS = *config
+	service, err := r.createConsulAgent(&updated)
+	if err != nil {
+		r.log_writer.Log(LogError, "unable to start the agent with the new tls settings, restoring the old", "error", err)
+		if service, err = r.createConsulAgent(current); err != nil {
+			r.log_writer.Log(LogError, "unable to start the agent with the old tls settings", "error", err)
+			return err
+		}
+		r.agent = service
+		return fmt.Errorf("unable to start the agent with the new tls settings, the old are still in use")
+	}
+	r.agent = service
+	r.tls_digest = digest
+	r.log_writer.Log(LogInfo, "restarted the agent with the new tls settings", "members", members)
+	if len(members) > 0 {
+		go r.retryJoin(members)
+	}
+	return nil
+}
+
+// The digest of the tls settings the agent is running with
+func (r *ConsulDistroStore) tlsDigest() string {
+	r.agent_lock.RLock()
+	defer r.agent_lock.RUnlock()
+	return r.tls_digest
+}
+
+// Work out a digest of the tls settings and the contents of the files they name
+//  config:		the tls settings
+func tlsDigest(config *TLSConfig) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%t,%t", config.VerifyIncoming, config.VerifyOutgoing)
+	for _, path := range []string{config.CAFile, config.CertFile, config.KeyFile} {
+		fmt.Fprintf(hash, ",%s:", path)
+		if path == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the tls file: %s, error: %s", path, err)
+		}
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Check the certificates can be loaded before the agent is restarted with them
+//  config:		the tls settings
+func validateTLS(config *TLSConfig) error {
+	if config.CertFile != "" || config.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			return fmt.Errorf("unable to load the tls certificate, error: %s", err)
+		}
+	}
+	if config.CAFile != "" {
+		content, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the certificate authority, error: %s", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(content) {
+			return fmt.Errorf("the certificate authority: %s holds no certificates", config.CAFile)
+		}
+	}
+	return nil
+}
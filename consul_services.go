@@ -0,0 +1,279 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Register a service on this node, replacing any service with the same id
+//  service:	the service to register
+//  checks:		the health checks for the service
+func (r *ConsulDistroStore) RegisterService(service *Service, checks ...*ServiceCheck) ([]*CheckHandle, error) {
+	service, err := validateService(service)
+	if err != nil {
+		return nil, err
+	}
+	for _, check := range checks {
+		if err := validateCheck(check); err != nil {
+			return nil, err
+		}
+	}
+	// step: stop the checks from any previous registration
+	r.stopServiceChecks(service.ID)
+
+	err = r.api().Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:      service.ID,
+		Name:    service.Name,
+		Tags:    encodeServiceTags(service),
+		Port:    service.Port,
+		Address: service.Address,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	handles := make([]*CheckHandle, 0, len(checks))
+	runners := make([]*checkRunner, 0)
+	for index, check := range checks {
+		handle := r.checkHandle(fmt.Sprintf("service:%s:%d", service.ID, index+1))
+		if err := r.api().Agent().CheckRegister(serviceCheckRegistration(handle.ID, service, check)); err != nil {
+			for _, runner := range runners {
+				runner.stop()
+			}
+			r.api().Agent().ServiceDeregister(service.ID)
+			return nil, err
+		}
+		// step: the tcp and func checks are run by us and reported into a ttl check
+		if check.Kind == CheckTCP || check.Kind == CheckFunc {
+			runner := newCheckRunner(check, reportCheck(handle))
+			runners = append(runners, runner)
+			go runner.run(r.shutdown)
+		}
+		handles = append(handles, handle)
+	}
+
+	r.Lock()
+	r.service_checks[service.ID] = runners
+	r.Unlock()
+
+	return handles, nil
+}
+
+// Remove a service and its health checks from this node
+//  id:			the id of the service
+func (r *ConsulDistroStore) DeregisterService(id string) error {
+	r.stopServiceChecks(id)
+	return r.api().Agent().ServiceDeregister(id)
+}
+
+// Retrieve the instances of a service across the cluster
+//  name:			the name of the service
+//  passingOnly:	only return the instances passing all their checks
+func (r *ConsulDistroStore) Services(name string, passingOnly bool) ([]*ServiceInstance, error) {
+	entries, _, err := r.api().Health().Service(name, "", passingOnly, nil)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*ServiceInstance, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, serviceEntryToInstance(entry))
+	}
+	return list, nil
+}
+
+// Watch the passing instances of a service, the full set is sent whenever it changes
+//  name:		the name of the service
+//  tag:		only include the instances with this tag, empty for all
+func (r *ConsulDistroStore) WatchService(name, tag string) (ServiceSubscription, error) {
+	if name == "" {
+		return nil, ErrInvalidService
+	}
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-r.shutdown:
+		return nil, ErrStoreClosed
+	default:
+	}
+
+	var subscription *serviceSubscription
+	subscription = newServiceSubscription(func() {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.service_subscriptions, subscription)
+	})
+	r.service_subscriptions[subscription] = true
+
+	window := r.context.ServiceDebounce
+	if window <= 0 {
+		window = DEFAULT_SERVICE_DEBOUNCE
+	}
+	go subscription.run(window)
+	go r.watchService(name, tag, subscription)
+
+	return subscription, nil
+}
+
+// Run blocking queries against the health of a service, passing on each result
+//  name:			the name of the service
+//  tag:			the tag to filter on
+//  subscription:	the watch the results are passed to
+func (r *ConsulDistroStore) watchService(name, tag string, subscription *serviceSubscription) {
+	var index uint64
+	failures := 0
+	for {
+		select {
+		case <-subscription.stopChannel:
+			return
+		default:
+		}
+		entries, meta, err := r.api().Health().Service(name, tag, true, &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  DEFAULT_WATCH_WAIT_TIME,
+		})
+		if err != nil {
+			failures++
+			if !backoff(failures, subscription.stopChannel) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		// step: a timed out query returns the same index and results, nothing has changed
+		if index > 0 && meta.LastIndex == index {
+			continue
+		}
+		// step: the index can go backwards if the raft state was restored
+		index = meta.LastIndex
+
+		instances := make([]*ServiceInstance, 0, len(entries))
+		for _, entry := range entries {
+			instances = append(instances, serviceEntryToInstance(entry))
+		}
+		sortInstances(instances)
+		if !subscription.update(instances) {
+			return
+		}
+	}
+}
+
+func (r *ConsulDistroStore) closeServiceSubscriptions() {
+	r.RLock()
+	list := make([]*serviceSubscription, 0, len(r.service_subscriptions))
+	for subscription := range r.service_subscriptions {
+		list = append(list, subscription)
+	}
+	r.RUnlock()
+	for _, subscription := range list {
+		subscription.Close()
+	}
+}
+
+// Create a handle on a check, reporting through the ttl endpoints of the agent
+//  id:			the id of the check
+func (r *ConsulDistroStore) checkHandle(id string) *CheckHandle {
+	return &CheckHandle{
+		ID: id,
+		update: func(status HealthStatus, note string) error {
+			switch status {
+			case HealthPassing:
+				return r.api().Agent().PassTTL(id, note)
+			case HealthWarning:
+				return r.api().Agent().WarnTTL(id, note)
+			default:
+				return r.api().Agent().FailTTL(id, note)
+			}
+		},
+	}
+}
+
+func (r *ConsulDistroStore) stopServiceChecks(id string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, runner := range r.service_checks[id] {
+		runner.stop()
+	}
+	delete(r.service_checks, id)
+}
+
+// Convert a health check into a consul check registration
+//  id:			the id of the check
+//  service:	the service the check is on
+//  check:		the check to convert
+func serviceCheckRegistration(id string, service *Service, check *ServiceCheck) *api.AgentCheckRegistration {
+	registration := &api.AgentCheckRegistration{
+		ID:        id,
+		Name:      check.Name,
+		ServiceID: service.ID,
+	}
+	if registration.Name == "" {
+		registration.Name = fmt.Sprintf("%s %s check", service.Name, check.Kind)
+	}
+	interval, timeout := checkTimings(check)
+	switch check.Kind {
+	case CheckTTL:
+		registration.TTL = check.TTL.String()
+	case CheckHTTP:
+		registration.HTTP = check.HTTP
+		registration.Interval = interval.String()
+		registration.Timeout = timeout.String()
+	default:
+		// step: give the runner a couple of intervals before the check goes critical
+		registration.TTL = (interval*2 + timeout).String()
+	}
+	return registration
+}
+
+// Create the reporter used by the checks we run
+//  handle:		the handle on the backing ttl check
+func reportCheck(handle *CheckHandle) func(err error) {
+	return func(err error) {
+		if err != nil {
+			handle.Fail(err.Error())
+			return
+		}
+		handle.Pass("")
+	}
+}
+
+// Convert a consul service entry into a service instance
+//  entry:		the entry from the health endpoint
+func serviceEntryToInstance(entry *api.ServiceEntry) *ServiceInstance {
+	tags, meta := decodeServiceTags(entry.Service.Tags)
+	instance := &ServiceInstance{
+		Service: &Service{
+			ID:      entry.Service.ID,
+			Name:    entry.Service.Service,
+			Tags:    tags,
+			Address: entry.Service.Address,
+			Port:    entry.Service.Port,
+			Meta:    meta,
+		},
+	}
+	if entry.Node != nil {
+		instance.Node = entry.Node.Node
+		if instance.Service.Address == "" {
+			instance.Service.Address = entry.Node.Address
+		}
+	}
+	statuses := make([]string, 0, len(entry.Checks))
+	for _, check := range entry.Checks {
+		statuses = append(statuses, check.Status)
+	}
+	instance.Status = worstHealthStatus(statuses)
+	return instance
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Write a snapshot of the keys to the writer; the keys are read in the
+// consistent mode, so the snapshot holds every write made before it was taken.
+// The embedded consul has no raft snapshot api, so this is an export of the
+// k/v store rather than of the raft state, the sessions are not included
+//  w:			the writer for the snapshot
+func (r *ConsulDistroStore) Snapshot(w io.Writer) (*SnapshotMeta, error) {
+	pairs, index, term, err := r.listPairsInTerm()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &SnapshotMeta{
+		Index:      index,
+		Term:       term,
+		Time:       time.Now().UTC(),
+		Node:       r.config.NodeName,
+		Datacenter: r.config.Datacenter,
+	}
+	if err := writeSnapshot(w, snapshot, pairs); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// List the keys along with the raft term they were read in. The term is read
+// before and after the listing, which is retried if an election came between,
+// so the index of the listing belongs to the term
+func (r *ConsulDistroStore) listPairsInTerm() ([]*KeyPair, uint64, uint64, error) {
+	for attempt := 1; ; attempt++ {
+		term := r.raftTerm()
+		pairs, index, err := r.listPairs("")
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if r.raftTerm() == term || attempt >= DEFAULT_SNAPSHOT_ATTEMPTS {
+			return pairs, index, term, nil
+		}
+	}
+}
+
+// Replace the keys with those in a snapshot, once its checksum and keys are
+// verified; those which differ are written and then the keys missing from the
+// snapshot are deleted, one at a time, so the watchers see the changes as
+// normal. This is a k/v export rather than a raft restore, so it isn't atomic:
+// each write and delete is a check-and-set against the listing taken before the
+// restore, and a failure or a conflict partway through is returned as a RestoreError
+//  reader:		the reader for the snapshot
+func (r *ConsulDistroStore) Restore(reader io.Reader) (*SnapshotMeta, error) {
+	return restoreConsulKeys(r.kv(), reader)
+}
+
+// Replace the keys in consul with those in a snapshot
+//  kv:			the consul k/v api
+//  reader:		the reader for the snapshot
+func restoreConsulKeys(kv *api.KV, reader io.Reader) (*SnapshotMeta, error) {
+	meta, pairs, err := readSnapshot(reader)
+	if err != nil {
+		return nil, err
+	}
+	current, _, err := listConsulPairs(kv, "")
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]*KeyPair, len(pairs))
+	for _, pair := range pairs {
+		wanted[pair.Key] = pair
+	}
+	existing := make(map[string]*KeyPair, len(current))
+	for _, pair := range current {
+		existing[pair.Key] = pair
+	}
+	// step: write the keys first, so a failure never leaves the store wiped
+	result := new(RestoreError)
+	for _, pair := range pairs {
+		if item, found := existing[pair.Key]; found && item.Flags == pair.Flags && bytes.Equal(item.Value, pair.Value) {
+			continue
+		}
+		// step: zero only creates the key, so a key added since the listing conflicts too
+		var index uint64
+		if item, found := existing[pair.Key]; found {
+			index = item.ModifyIndex
+		}
+		updated, _, err := kv.CAS(&api.KVPair{Key: pair.Key, Flags: pair.Flags, Value: pair.Value, ModifyIndex: index}, nil)
+		if err == nil && !updated {
+			err = ErrRestoreConflict
+		}
+		if err != nil {
+			result.Key, result.Err = pair.Key, err
+			return nil, result
+		}
+		result.Written++
+	}
+	for _, pair := range current {
+		if _, found := wanted[pair.Key]; found {
+			continue
+		}
+		deleted, _, err := kv.DeleteCAS(&api.KVPair{Key: pair.Key, ModifyIndex: pair.ModifyIndex}, nil)
+		if err == nil && !deleted {
+			err = ErrRestoreConflict
+		}
+		if err != nil {
+			result.Key, result.Err = pair.Key, err
+			return nil, result
+		}
+		result.Deleted++
+	}
+	return meta, nil
+}
+
+// The status of the scheduled snapshots
+func (r *ConsulDistroStore) SnapshotStatus() SnapshotStatus {
+	return r.snapshots.Status()
+}
+
+// Check if this node is the raft leader, from the stats of the agent
+func (r *ConsulDistroStore) isLeader() bool {
+	return r.consulAgent().Stats()["consul"]["leader"] == "true"
+}
+
+// The current raft term from the stats of the agent, zero if unknown
+func (r *ConsulDistroStore) raftTerm() uint64 {
+	stats, found := r.consulAgent().Stats()["raft"]
+	if !found {
+		return 0
+	}
+	term, err := strconv.ParseUint(stats["term"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return term
+}
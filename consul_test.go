@@ -14,7 +14,6 @@ limitations under the License.
 package distrostore
 
 import (
-	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
@@ -33,9 +32,8 @@ func tmpDir(t *testing.T) string {
 }
 
 var (
-	current_index = 100
-	test_server   DistroStore
-	lock          sync.Once
+	test_server DistroStore
+	lock        sync.Once
 )
 
 func createTestServerBootstrap(t *testing.T) DistroStore {
@@ -44,7 +42,8 @@ func createTestServerBootstrap(t *testing.T) DistroStore {
 	config.BindAddress = "127.0.0.1"
 	config.DataDir = tmpDir(t)
 	config.LogOutput = os.Stdout
-	config.PortsConfig.ApplyIndex(current_index)
+	// step: zero ports are allocated from the free ports on the host
+	config.PortsConfig = PortConfig{}
 	return createServer(config, t)
 }
 
@@ -54,7 +53,7 @@ func createTestServerMembers(t *testing.T, members []string) DistroStore {
 	config.Members = members
 	config.DataDir = tmpDir(t)
 	config.LogOutput = os.Stdout
-	config.PortsConfig.ApplyIndex(current_index)
+	config.PortsConfig = PortConfig{}
 	return createServer(config, t)
 }
 
@@ -79,6 +78,7 @@ func createFixedService(t *testing.T) DistroStore {
 		cfg.BindAdvertised = "127.0.0.1"
 		cfg.DataDir = tmpDir(t)
 		cfg.EnableDebug = false
+		cfg.PortsConfig = PortConfig{}
 		test_server = createServer(cfg, t)
 	})
 	return test_server
@@ -117,8 +117,12 @@ func TestNodesList(t *testing.T) {
 	assert.Equal(t, 1, len(members), "the size of the members should be one")
 	member := members[0]
 	assert.Equal(t, "127.0.0.1", member.Address, "the member address is incorrect")
-	assert.Equal(t, 8301, member.Port, "the member port is incorrect")
+	assert.Equal(t, server.Config().PortsConfig.SerfLan, member.Port, "the member port should be the allocated serf lan port")
 	assert.Equal(t, "test1", member.ID, "the member ID is incorrect")
+	assert.Equal(t, NodeAlive, member.Status, "the member should be alive")
+	assert.Equal(t, NodeServer, member.Role, "the member should be a server")
+	assert.Equal(t, "dc1", member.Datacenter, "the member datacenter is incorrect")
+	assert.True(t, member.Leader, "the member should be the leader")
 }
 
 func TestExists(t *testing.T) {
@@ -141,21 +145,11 @@ func TestConfig(t *testing.T) {
 	assert.NotNil(t, config, "we have not recieved the cluster config")
 }
 
-func TestJoining(t *testing.T) {
-	server := createFixedService(t)
-	config := DefaultContext()
-	config.BindAddress = "127.0.0.1"
-	config.DataDir = tmpDir(t)
-	config.NodeName = "secon"
-	config.PortsConfig.ApplyIndex(current_index)
-	endpoint := fmt.Sprintf("127.0.0.1:%d", server.Config().PortsConfig.SerfLan)
-	config.Members = make([]string, 0)
-	config.Members = append(config.Members, endpoint)
-	secondary := createServer(config, t)
-	nodes, err := server.Nodes()
-	assert.Nil(t, err, "unable to get a list of the node, error: %s", err)
-	assert.NotNil(t, nodes, "the list of node is nil")
-	time.Sleep(time.Duration(2) * time.Second)
-	assert.Equal(t, 2, len(nodes), "the nodes size should be two")
-	secondary.Close()
+func TestQuery(t *testing.T) {
+	server := new(ConsulDistroStore)
+	assert.Equal(t, ErrQueryUnsupported, server.HandleQuery("ping", func(payload []byte) ([]byte, error) {
+		return payload, nil
+	}))
+	_, err := server.Query("ping", []byte("ping"), &QueryOptions{RequestAck: true})
+	assert.Equal(t, ErrQueryUnsupported, err, "the embedded consul does not expose serf queries")
 }
@@ -14,11 +14,23 @@ limitations under the License.
 package distrostore
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/hashicorp/consul/consul"
-	"fmt"
+)
+
+const (
+	// the default largest value included in the key events
+	DEFAULT_EVENT_VALUE_LIMIT = 4096
+)
+
+var (
+	// unable to find a port free on both tcp and udp
+	ErrNoFreePort = errors.New("Unable to find a port free on both tcp and udp")
 )
 
 type PortConfig struct {
@@ -31,14 +43,42 @@ type PortConfig struct {
 	Server  int // Server internal RPC
 }
 
+// Offset the ports by the index, zero ports are left to be allocated
+//
+//	index:		the offset to add to the ports
 func (p *PortConfig) ApplyIndex(index int) {
-	p.DNS += index
-	p.HTTP += index
-	p.HTTPS += index
-	p.RPC += index
-	p.SerfLan += index
-	p.SerfWan += index
-	p.Server += index
+	for _, port := range p.ports() {
+		if *port != 0 {
+			*port += index
+		}
+	}
+}
+
+// Allocate a free port for each of the services with a zero port, the port is
+// free on both tcp and udp at the time it is allocated
+func (p *PortConfig) AllocateFree() error {
+	taken := make(map[int]bool, 0)
+	for _, port := range p.ports() {
+		if *port != 0 {
+			taken[*port] = true
+		}
+	}
+	for _, port := range p.ports() {
+		if *port != 0 {
+			continue
+		}
+		free, err := freePort(taken)
+		if err != nil {
+			return err
+		}
+		taken[free] = true
+		*port = free
+	}
+	return nil
+}
+
+func (p *PortConfig) ports() []*int {
+	return []*int{&p.DNS, &p.HTTP, &p.HTTPS, &p.RPC, &p.SerfLan, &p.SerfWan, &p.Server}
 }
 
 func (p PortConfig) String() string {
@@ -49,15 +89,18 @@ func (p PortConfig) String() string {
 	RPC: %d
 	SerfLan: %d
 	SerfWan: %d
+	Server: %d
 	`
-	return fmt.Sprintf(ports, p.DNS, p.HTTP, p.HTTPS, p.RPC, p.SerfLan, p.SerfWan)
+	return fmt.Sprintf(ports, p.DNS, p.HTTP, p.HTTPS, p.RPC, p.SerfLan, p.SerfWan, p.Server)
 }
 
 // the context is a stripped down version of configuration for the Consul
 type Context struct {
+	// the backend for the store i.e. BackendConsul or BackendMemory, empty for consul
+	Backend string
 	// feature http
 	EnableHTTP bool
-	// feature dns
+	// serve the consul dns interface on the client address and dns port
 	EnableDNS bool
 	// whether this node is the bootstrap node
 	Bootstrap bool
@@ -81,20 +124,68 @@ type Context struct {
 	BindAddress string
 	// the address to advertise
 	BindAdvertised string
-	// the port configuration for the above
+	// the port configuration for the above, zero ports are allocated from the
+	// free ports on the host and written back
 	PortsConfig PortConfig
+	// the number of events buffered for each key and node listener
+	ListenerBuffer int
+	// what to do when a listener's buffer is full
+	ListenerPolicy OverflowPolicy
+	// the largest value in bytes included in the key events, zero never includes the values
+	EventValueLimit int
+	// the application tags advertised by the node i.e. zone, capacity
+	NodeTags map[string]string
+	// the window changes to a watched service are gathered over before being sent
+	ServiceDebounce time.Duration
+	// the time we wait on a graceful leave of the cluster when closing
+	LeaveTimeout time.Duration
+	// read the keys in the consistent mode, which is linearizable; the default
+	// mode can return a stale value for a short while after a leader is deposed
+	ConsistentReads bool
+	// the scheduled snapshots of the keys, disabled unless an interval is set
+	Snapshots SnapshotConfig
+	// the lowest level of the logs written, TRACE, DEBUG, INFO, WARN or ERR
+	LogLevel string
+	// the logger for the records of the store and the embedded consul, whose log
+	// lines are parsed into records with a subsystem; when nil the lines are
+	// written as they are to the LogOutput
+	Logger Logger
+	// the tls settings for the rpc between the nodes
+	TLS TLSConfig
+	// the acl token used for the requests made by the store
+	ACLToken string
+}
+
+// the tls settings for the rpc between the nodes
+type TLSConfig struct {
+	// the certificate authority used to verify the other nodes
+	CAFile string
+	// the certificate presented by the node
+	CertFile string
+	// the key for the certificate
+	KeyFile string
+	// require the incoming connections to present a certificate
+	VerifyIncoming bool
+	// verify the certificates of the nodes we connect to
+	VerifyOutgoing bool
 }
 
 func DefaultContext() *Context {
 	return &Context{
-		EnableHTTP:    true,
-		EnableDNS:     false,
-		Members:       make([]string, 0),
-		EnableDebug:   false,
-		LogOutput:     ioutil.Discard,
-		Datacenter:    "dc1",
-		ClientAddress: "0.0.0.0",
-		BindAddress:   "0.0.0.0",
+		EnableHTTP:      true,
+		EnableDNS:       false,
+		Members:         make([]string, 0),
+		EnableDebug:     false,
+		LogOutput:       ioutil.Discard,
+		Datacenter:      "dc1",
+		ClientAddress:   "0.0.0.0",
+		BindAddress:     "0.0.0.0",
+		ListenerBuffer:  DEFAULT_LISTENER_BUFFER,
+		ListenerPolicy:  DropOldest,
+		EventValueLimit: DEFAULT_EVENT_VALUE_LIMIT,
+		ServiceDebounce: DEFAULT_SERVICE_DEBOUNCE,
+		LeaveTimeout:    DEFAULT_LEAVE_TIMEOUT,
+		LogLevel:        DEFAULT_LOG_LEVEL,
 		PortsConfig: PortConfig{
 			DNS:     8600,
 			HTTP:    8500,
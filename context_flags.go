@@ -0,0 +1,124 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+)
+
+// The flags for the settings of a context. The values are gathered as the
+// flags are parsed and applied over a loaded context afterwards, so a flag
+// naming the config files can be parsed alongside them
+//
+//	flags := distrostore.NewContextFlags()
+//	flags.Bind(flag.CommandLine)
+//	flag.Parse()
+//	cfg, err := distrostore.LoadContext(*configFile)
+//	err = flags.Apply(cfg)
+type ContextFlags struct {
+	// the values given for each setting, in the order they were parsed
+	values map[*contextSetting][]string
+}
+
+func NewContextFlags() *ContextFlags {
+	return &ContextFlags{values: make(map[*contextSetting][]string, 0)}
+}
+
+// Register the flags with a flag set from the standard library
+//  flags:		the flag set i.e. flag.CommandLine
+func (c *ContextFlags) Bind(flags *flag.FlagSet) {
+	for _, setting := range contextSettings {
+		flags.Var(c.value(setting), setting.flagName(), setting.usage)
+	}
+}
+
+// the part of a kingpin application or command the flags are registered with
+type kingpinFlags interface {
+	Flag(name, help string) *kingpin.FlagClause
+}
+
+// Register the flags with a kingpin application or command
+//  app:		the application i.e. kingpin.CommandLine, or a command
+func (c *ContextFlags) BindKingpin(app kingpinFlags) {
+	for _, setting := range contextSettings {
+		app.Flag(setting.flagName(), setting.usage).SetValue(c.value(setting))
+	}
+}
+
+// Apply the flags which were given over the context
+//  ctx:		the context to update, i.e. from LoadContext
+func (c *ContextFlags) Apply(ctx *Context) error {
+	for _, setting := range contextSettings {
+		values, found := c.values[setting]
+		if !found {
+			continue
+		}
+		if err := applySetting(ctx, setting, values, "--"+setting.flagName()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ContextFlags) value(setting *contextSetting) *contextFlagValue {
+	return &contextFlagValue{flags: c, setting: setting}
+}
+
+// the value of a flag, implementing both flag.Value and kingpin.Value
+type contextFlagValue struct {
+	// the flags the value is recorded in
+	flags *ContextFlags
+	// the setting of the flag
+	setting *contextSetting
+}
+
+// Record the value, a list is split on the commas as the environment is and
+// gathers each value given, which together replace the list; a single value
+// takes the last. The value is checked here, so a bad one is reported as the
+// flags are parsed
+func (v *contextFlagValue) Set(value string) error {
+	values := []string{value}
+	if v.setting.list {
+		values = splitList(value)
+	}
+	if err := v.setting.set(DefaultContext(), values); err != nil {
+		return err
+	}
+	if v.setting.list {
+		v.flags.values[v.setting] = append(v.flags.values[v.setting], values...)
+	} else {
+		v.flags.values[v.setting] = values
+	}
+	return nil
+}
+
+func (v *contextFlagValue) String() string {
+	if v == nil || v.flags == nil {
+		return ""
+	}
+	return strings.Join(v.flags.values[v.setting], ",")
+}
+
+// Allows a boolean flag to be given without a value
+func (v *contextFlagValue) IsBoolFlag() bool {
+	return v.setting.boolean
+}
+
+// Allows a list flag to be repeated with kingpin
+func (v *contextFlagValue) IsCumulative() bool {
+	return v.setting.list
+}
@@ -0,0 +1,370 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// the prefix of the environment variables read by LoadContext
+	EnvironmentPrefix = "DISTROSTORE_"
+)
+
+// a setting of the context which can be loaded from a file, the environment or a flag
+type contextSetting struct {
+	// the name in the files, nested names are dotted i.e. ports.http
+	name string
+	// a description of the setting, used for the flags
+	usage string
+	// the setting holds a list, a file, variable or flags giving it replace the list of an earlier source
+	list bool
+	// the setting is a boolean, the flag can be given without a value
+	boolean bool
+	// set the values of the setting
+	set func(ctx *Context, values []string) error
+}
+
+// The name of the environment variable for the setting i.e. DISTROSTORE_PORTS_HTTP
+func (s *contextSetting) envName() string {
+	return EnvironmentPrefix + strings.ToUpper(strings.Replace(s.name, ".", "_", -1))
+}
+
+// The name of the flag for the setting i.e. ports-http
+func (s *contextSetting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.name)
+}
+
+// the settings of the context, in the order the flags are listed
+var contextSettings = []*contextSetting{
+	stringSetting("backend", "the backend for the store, consul or memory", func(c *Context) *string { return &c.Backend }),
+	boolSetting("bootstrap", "whether this node is the bootstrap node", func(c *Context) *bool { return &c.Bootstrap }),
+	listSetting("members", "a member of the cluster to join i.e. 10.0.0.1:8301", func(ctx *Context, values []string) error {
+		ctx.Members = values
+		return nil
+	}),
+	stringSetting("node_name", "the name of the node", func(c *Context) *string { return &c.NodeName }),
+	stringSetting("datacenter", "the datacenter of the node", func(c *Context) *string { return &c.Datacenter }),
+	stringSetting("data_dir", "the data directory of the node", func(c *Context) *string { return &c.DataDir }),
+	stringSetting("encrypt_key", "the key used to encrypt the gossip traffic", func(c *Context) *string { return &c.EncryptKey }),
+	stringSetting("client_address", "the address the http api is bound to", func(c *Context) *string { return &c.ClientAddress }),
+	stringSetting("bind_address", "the address the cluster ports are bound to", func(c *Context) *string { return &c.BindAddress }),
+	stringSetting("bind_advertised", "the address advertised to the other members", func(c *Context) *string { return &c.BindAdvertised }),
+	boolSetting("enable_http", "enable the http api", func(c *Context) *bool { return &c.EnableHTTP }),
+	boolSetting("enable_dns", "enable the dns interface", func(c *Context) *bool { return &c.EnableDNS }),
+	boolSetting("enable_debug", "enable the debug endpoints", func(c *Context) *bool { return &c.EnableDebug }),
+	intSetting("ports.dns", "the port of the dns interface", func(c *Context) *int { return &c.PortsConfig.DNS }),
+	intSetting("ports.http", "the port of the http api", func(c *Context) *int { return &c.PortsConfig.HTTP }),
+	intSetting("ports.https", "the port of the https api", func(c *Context) *int { return &c.PortsConfig.HTTPS }),
+	intSetting("ports.rpc", "the port of the cli rpc", func(c *Context) *int { return &c.PortsConfig.RPC }),
+	intSetting("ports.serf_lan", "the port of the lan gossip", func(c *Context) *int { return &c.PortsConfig.SerfLan }),
+	intSetting("ports.serf_wan", "the port of the wan gossip", func(c *Context) *int { return &c.PortsConfig.SerfWan }),
+	intSetting("ports.server", "the port of the server rpc", func(c *Context) *int { return &c.PortsConfig.Server }),
+	intSetting("listener_buffer", "the number of events buffered for each listener", func(c *Context) *int { return &c.ListenerBuffer }),
+	{
+		name:  "listener_policy",
+		usage: "what to do when a listener's buffer is full, drop-oldest, drop-newest or disconnect",
+		set: func(ctx *Context, values []string) error {
+			for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Disconnect} {
+				if policy.String() == values[0] {
+					ctx.ListenerPolicy = policy
+					return nil
+				}
+			}
+			return fmt.Errorf("invalid listener policy: %s", values[0])
+		},
+	},
+	intSetting("event_value_limit", "the largest value in bytes included in the key events", func(c *Context) *int { return &c.EventValueLimit }),
+	listSetting("node_tags", "an application tag advertised by the node i.e. zone=eu-west-1a", func(ctx *Context, values []string) error {
+		tags := make(map[string]string, len(values))
+		for _, value := range values {
+			items := strings.SplitN(value, "=", 2)
+			if len(items) != 2 || items[0] == "" {
+				return fmt.Errorf("invalid node tag: %s, expected a key=value", value)
+			}
+			tags[items[0]] = items[1]
+		}
+		ctx.NodeTags = tags
+		return nil
+	}),
+	durationSetting("service_debounce", "the window changes to a watched service are gathered over", func(c *Context) *time.Duration { return &c.ServiceDebounce }),
+	durationSetting("leave_timeout", "the time we wait on a graceful leave of the cluster", func(c *Context) *time.Duration { return &c.LeaveTimeout }),
+	boolSetting("consistent_reads", "read the keys in the consistent mode", func(c *Context) *bool { return &c.ConsistentReads }),
+	stringSetting("log_level", "the lowest level of the logs written, TRACE, DEBUG, INFO, WARN or ERR", func(c *Context) *string { return &c.LogLevel }),
+	stringSetting("acl_token", "the acl token used for the requests made by the store", func(c *Context) *string { return &c.ACLToken }),
+	stringSetting("tls.ca_file", "the certificate authority used to verify the other nodes", func(c *Context) *string { return &c.TLS.CAFile }),
+	stringSetting("tls.cert_file", "the certificate presented by the node", func(c *Context) *string { return &c.TLS.CertFile }),
+	stringSetting("tls.key_file", "the key for the certificate", func(c *Context) *string { return &c.TLS.KeyFile }),
+	boolSetting("tls.verify_incoming", "require the incoming connections to present a certificate", func(c *Context) *bool { return &c.TLS.VerifyIncoming }),
+	boolSetting("tls.verify_outgoing", "verify the certificates of the nodes we connect to", func(c *Context) *bool { return &c.TLS.VerifyOutgoing }),
+	durationSetting("snapshots.interval", "the interval between the scheduled snapshots", func(c *Context) *time.Duration { return &c.Snapshots.Interval }),
+	stringSetting("snapshots.dir", "the directory of the scheduled snapshots", func(c *Context) *string { return &c.Snapshots.Dir }),
+	intSetting("snapshots.retain", "the number of scheduled snapshots kept", func(c *Context) *int { return &c.Snapshots.Retain }),
+	boolSetting("snapshots.leader_only", "only take the scheduled snapshots on the leader", func(c *Context) *bool { return &c.Snapshots.LeaderOnly }),
+	boolSetting("snapshots.compress", "compress the scheduled snapshots", func(c *Context) *bool { return &c.Snapshots.Compress }),
+}
+
+func stringSetting(name, usage string, field func(*Context) *string) *contextSetting {
+	return &contextSetting{name: name, usage: usage, set: func(ctx *Context, values []string) error {
+		*field(ctx) = values[0]
+		return nil
+	}}
+}
+
+func boolSetting(name, usage string, field func(*Context) *bool) *contextSetting {
+	return &contextSetting{name: name, usage: usage, boolean: true, set: func(ctx *Context, values []string) error {
+		value, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid boolean: %s", values[0])
+		}
+		*field(ctx) = value
+		return nil
+	}}
+}
+
+func intSetting(name, usage string, field func(*Context) *int) *contextSetting {
+	return &contextSetting{name: name, usage: usage, set: func(ctx *Context, values []string) error {
+		value, err := strconv.Atoi(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid number: %s", values[0])
+		}
+		*field(ctx) = value
+		return nil
+	}}
+}
+
+func durationSetting(name, usage string, field func(*Context) *time.Duration) *contextSetting {
+	return &contextSetting{name: name, usage: usage, set: func(ctx *Context, values []string) error {
+		value, err := time.ParseDuration(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid duration: %s", values[0])
+		}
+		*field(ctx) = value
+		return nil
+	}}
+}
+
+func listSetting(name, usage string, set func(*Context, []string) error) *contextSetting {
+	return &contextSetting{name: name, usage: usage, list: true, set: set}
+}
+
+// Find the setting with the name
+//  name:		the name of the setting i.e. ports.http
+func findSetting(name string) *contextSetting {
+	for _, setting := range contextSettings {
+		if setting.name == name {
+			return setting
+		}
+	}
+	return nil
+}
+
+// Apply the values to the setting, wrapping any error with the name and source
+//  ctx:		the context to update
+//  setting:	the setting being changed
+//  values:		the values of the setting
+//  source:		where the values came from i.e. a file or variable
+func applySetting(ctx *Context, setting *contextSetting, values []string, source string) error {
+	if !setting.list && len(values) != 1 {
+		return fmt.Errorf("%s: %s takes a single value", source, setting.name)
+	}
+	if err := setting.set(ctx, values); err != nil {
+		return fmt.Errorf("%s: %s, %s", source, setting.name, err)
+	}
+	return nil
+}
+
+// Load a context from the defaults, the config files and the environment.
+// The files are read in order and can be json, yaml or toml, going by their
+// extension; a later file overrides the settings of an earlier one, and the
+// DISTROSTORE_* environment variables override them all. Flags bound with
+// ContextFlags are applied over the result, giving the precedence:
+//
+//	defaults < files (in order) < environment < flags
+//
+//  paths:		the config files to read
+func LoadContext(paths ...string) (*Context, error) {
+	ctx := DefaultContext()
+	for _, path := range paths {
+		if err := loadContextFile(ctx, path); err != nil {
+			return nil, err
+		}
+	}
+	if err := loadContextEnvironment(ctx, os.Environ()); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// Read a config file onto the context; unknown settings are an error, so a
+// misspelt setting is not silently ignored
+//  ctx:		the context to update
+//  path:		the path of the config file
+func loadContextFile(ctx *Context, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	settings := make(map[string]interface{}, 0)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(content, &settings)
+	case ".yaml", ".yml":
+		var document map[interface{}]interface{}
+		if err = yaml.Unmarshal(content, &document); err == nil {
+			settings, err = yamlSettings(document)
+		}
+	case ".toml":
+		_, err = toml.Decode(string(content), &settings)
+	default:
+		return fmt.Errorf("%s: unknown config format, expected a .json, .yaml or .toml file", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: unable to decode the config, error: %s", path, err)
+	}
+	return applyFileSettings(ctx, "", settings, path)
+}
+
+// Walk the settings from a file, nested tables are dotted onto the name
+//  ctx:		the context to update
+//  prefix:		the name of the table the settings are in
+//  settings:	the settings in the table
+//  path:		the path of the config file
+func applyFileSettings(ctx *Context, prefix string, settings map[string]interface{}, path string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := settings[name]
+		setting := findSetting(prefix + name)
+		if table, ok := value.(map[string]interface{}); ok && (setting == nil || !setting.list) {
+			if err := applyFileSettings(ctx, prefix+name+".", table, path); err != nil {
+				return err
+			}
+			continue
+		}
+		if setting == nil {
+			return fmt.Errorf("%s: unknown setting: %s", path, prefix+name)
+		}
+		values, err := fileValues(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s, %s", path, setting.name, err)
+		}
+		if err := applySetting(ctx, setting, values, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Convert a value from a file into the text values of a setting; a table is
+// taken as a list of key=value
+//  value:		the value from the file
+func fileValues(value interface{}) ([]string, error) {
+	switch item := value.(type) {
+	case []interface{}:
+		values := make([]string, 0, len(item))
+		for _, element := range item {
+			values = append(values, fmt.Sprintf("%v", element))
+		}
+		return values, nil
+	case map[string]interface{}:
+		values := make([]string, 0, len(item))
+		for key, element := range item {
+			values = append(values, fmt.Sprintf("%s=%v", key, element))
+		}
+		sort.Strings(values)
+		return values, nil
+	case nil:
+		return nil, fmt.Errorf("has no value")
+	case float64:
+		// step: json decodes every number as a float
+		return []string{strconv.FormatFloat(item, 'f', -1, 64)}, nil
+	default:
+		return []string{fmt.Sprintf("%v", item)}, nil
+	}
+}
+
+// Convert a yaml document into the same maps as json and toml decode to
+//  document:	the decoded yaml
+func yamlSettings(document map[interface{}]interface{}) (map[string]interface{}, error) {
+	settings := make(map[string]interface{}, len(document))
+	for key, value := range document {
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("the setting: %v is not a string", key)
+		}
+		if table, ok := value.(map[interface{}]interface{}); ok {
+			converted, err := yamlSettings(table)
+			if err != nil {
+				return nil, err
+			}
+			value = converted
+		}
+		settings[name] = value
+	}
+	return settings, nil
+}
+
+// Split the value of a list setting given as text on the commas
+//  value:		the value of the variable or flag
+func splitList(value string) []string {
+	values := make([]string, 0)
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			values = append(values, element)
+		}
+	}
+	return values
+}
+
+// Apply the DISTROSTORE_* environment variables onto the context, a list is
+// separated by commas and replaces the list from the files
+//  ctx:			the context to update
+//  environment:	the environment i.e. os.Environ()
+func loadContextEnvironment(ctx *Context, environment []string) error {
+	variables := make(map[string]string, 0)
+	for _, item := range environment {
+		if items := strings.SplitN(item, "=", 2); len(items) == 2 && strings.HasPrefix(items[0], EnvironmentPrefix) {
+			variables[items[0]] = items[1]
+		}
+	}
+	for _, setting := range contextSettings {
+		value, found := variables[setting.envName()]
+		if !found {
+			continue
+		}
+		values := []string{value}
+		if setting.list {
+			values = splitList(value)
+		}
+		if err := applySetting(ctx, setting, values, setting.envName()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
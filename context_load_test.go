@@ -0,0 +1,107 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeContextFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatalf("unable to create the directory, error: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unable to write the file, error: %s", err)
+	}
+	return path
+}
+
+func TestLoadContextFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{"bootstrap": true, "members": ["10.0.0.1:8301", "10.0.0.2:8301"],
+			"ports": {"http": 9500}, "node_tags": {"zone": "a"}, "snapshots": {"interval": "1h", "retain": 3},
+			"listener_policy": "disconnect"}`,
+		"config.yaml": "bootstrap: true\nmembers:\n  - 10.0.0.1:8301\n  - 10.0.0.2:8301\nports:\n  http: 9500\n" +
+			"node_tags:\n  zone: a\nsnapshots:\n  interval: 1h\n  retain: 3\nlistener_policy: disconnect\n",
+		"config.toml": "bootstrap = true\nmembers = [\"10.0.0.1:8301\", \"10.0.0.2:8301\"]\nlistener_policy = \"disconnect\"\n" +
+			"[ports]\nhttp = 9500\n[node_tags]\nzone = \"a\"\n[snapshots]\ninterval = \"1h\"\nretain = 3\n",
+	}
+	for name, content := range files {
+		cfg, err := LoadContext(writeContextFile(t, name, content))
+		if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+			continue
+		}
+		assert.True(t, cfg.Bootstrap, "%s should set the bootstrap", name)
+		assert.Equal(t, []string{"10.0.0.1:8301", "10.0.0.2:8301"}, cfg.Members)
+		assert.Equal(t, 9500, cfg.PortsConfig.HTTP)
+		assert.Equal(t, 8300, cfg.PortsConfig.Server, "the unset ports should keep their defaults")
+		assert.Equal(t, map[string]string{"zone": "a"}, cfg.NodeTags)
+		assert.Equal(t, time.Hour, cfg.Snapshots.Interval)
+		assert.Equal(t, 3, cfg.Snapshots.Retain)
+		assert.Equal(t, Disconnect, cfg.ListenerPolicy)
+	}
+}
+
+func TestLoadContextErrors(t *testing.T) {
+	_, err := LoadContext(writeContextFile(t, "config.json", `{"bind_adress": "10.0.0.1"}`))
+	assert.NotNil(t, err, "a misspelt setting should be an error")
+	_, err = LoadContext(writeContextFile(t, "config.json", `{"ports": {"http": "high"}}`))
+	assert.NotNil(t, err, "an invalid port should be an error")
+	_, err = LoadContext(writeContextFile(t, "config.ini", ""))
+	assert.NotNil(t, err, "an unknown format should be an error")
+	_, err = LoadContext("/does/not/exist.json")
+	assert.NotNil(t, err, "a missing file should be an error")
+}
+
+func TestLoadContextPrecedence(t *testing.T) {
+	first := writeContextFile(t, "first.yaml", "bind_address: 10.0.0.1\ndatacenter: dc2\nnode_name: first\n")
+	second := writeContextFile(t, "second.json", `{"bind_address": "10.0.0.2", "node_name": "second", "members": ["10.0.0.4:8301"]}`)
+	cfg := DefaultContext()
+	for _, path := range []string{first, second} {
+		assert.Nil(t, loadContextFile(cfg, path))
+	}
+	err := loadContextEnvironment(cfg, []string{"DISTROSTORE_NODE_NAME=environment",
+		"DISTROSTORE_MEMBERS=10.0.0.5:8301, 10.0.0.6:8301", "DISTROSTORE_PORTS_SERF_LAN=7301", "OTHER=value"})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, []string{"10.0.0.5:8301", "10.0.0.6:8301"}, cfg.Members, "the environment should replace the list")
+
+	flags := NewContextFlags()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Bind(set)
+	err = set.Parse([]string{"-node-name", "flag", "-members", "10.0.0.7:8301", "-members", "10.0.0.8:8301,10.0.0.9:8301", "-consistent-reads"})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Nil(t, flags.Apply(cfg))
+
+	assert.Equal(t, "dc2", cfg.Datacenter, "the first file should apply where nothing overrides it")
+	assert.Equal(t, "10.0.0.2", cfg.BindAddress, "the later file should override the earlier")
+	assert.Equal(t, 7301, cfg.PortsConfig.SerfLan, "the environment should be applied")
+	assert.Equal(t, "flag", cfg.NodeName, "the flags should override everything")
+	assert.Equal(t, []string{"10.0.0.7:8301", "10.0.0.8:8301", "10.0.0.9:8301"}, cfg.Members, "the flags should replace the list")
+	assert.True(t, cfg.ConsistentReads)
+
+	set = flag.NewFlagSet("test", flag.ContinueOnError)
+	set.SetOutput(ioutil.Discard)
+	NewContextFlags().Bind(set)
+	assert.NotNil(t, set.Parse([]string{"-leave-timeout", "soon"}), "an invalid flag should fail the parse")
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyIndex(t *testing.T) {
+	ports := PortConfig{HTTP: 8500, Server: 8300}
+	ports.ApplyIndex(10)
+	assert.Equal(t, 8510, ports.HTTP)
+	assert.Equal(t, 8310, ports.Server)
+	assert.Equal(t, 0, ports.DNS, "a zero port should be left for allocation")
+}
+
+func TestAllocateFree(t *testing.T) {
+	ports := PortConfig{HTTP: 8500}
+	err := ports.AllocateFree()
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, 8500, ports.HTTP, "a set port should not be changed")
+	seen := make(map[int]bool, 0)
+	for _, port := range ports.ports() {
+		assert.NotEqual(t, 0, *port, "every port should have been allocated")
+		assert.False(t, seen[*port], "the port %d has been allocated twice", *port)
+		seen[*port] = true
+	}
+}
+
+func TestPortConfigString(t *testing.T) {
+	ports := PortConfig{Server: 8300}
+	assert.True(t, strings.Contains(ports.String(), "Server: 8300"), "the server port should be included")
+}
@@ -0,0 +1,356 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the default number of events buffered for each listener
+	DEFAULT_LISTENER_BUFFER = 128
+)
+
+var (
+	// the subscriber did not keep up with the events and was disconnected
+	ErrSlowConsumer = errors.New("The subscriber was disconnected as it did not keep up with the events")
+)
+
+// the policy applied when a subscriber's buffer is full
+type OverflowPolicy int
+
+const (
+	// discard the oldest buffered event to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// discard the new event
+	DropNewest
+	// remove the subscriber and close it with ErrSlowConsumer
+	Disconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// a handle on a listener added to the store, the channel it was added with
+// belongs to the caller and is never closed by the store
+type Listener interface {
+	// the number of events dropped because the buffer was full
+	Dropped() uint64
+	// the reason the listener was removed i.e. ErrSlowConsumer or ErrStoreClosed,
+	// nil if it was removed by the caller or is still listening
+	Err() error
+	// closed once the listener has been removed and no more events will be sent
+	Done() <-chan struct{}
+}
+
+// a subscriber with its own bounded buffer and delivery goroutine, so a slow
+// consumer only ever holds up itself
+type subscriber struct {
+	sync.Mutex
+	// the kind of listener i.e. key, node, event or watch, used in the metrics
+	kind string
+	// the buffered events waiting for delivery
+	queue []queuedEvent
+	// the maximum size of the queue
+	size int
+	// what to do when the queue is full
+	policy OverflowPolicy
+	// signalled when an event is queued
+	wakeup chan struct{}
+	// closed when the subscriber is removed
+	done chan struct{}
+	// ensure we only close once
+	once sync.Once
+	// passes an event on, returning false if the subscriber was closed while waiting
+	deliver func(event interface{}, done chan struct{}) bool
+	// called once the delivery goroutine has finished
+	finished func(err error)
+	// the number of events dropped
+	dropped uint64
+	// the number of panics recovered from the deliver function
+	panics uint64
+	// the reason the subscriber was closed, if any
+	err error
+}
+
+// an event waiting in the buffer of a subscriber
+type queuedEvent struct {
+	// the event to deliver
+	event interface{}
+	// the time the event was queued
+	queued time.Time
+}
+
+func newSubscriber(kind string, size int, policy OverflowPolicy, deliver func(interface{}, chan struct{}) bool, finished func(error)) *subscriber {
+	if size <= 0 {
+		size = DEFAULT_LISTENER_BUFFER
+	}
+	s := &subscriber{
+		kind:     kind,
+		queue:    make([]queuedEvent, 0),
+		size:     size,
+		policy:   policy,
+		wakeup:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		deliver:  deliver,
+		finished: finished,
+	}
+	go s.run()
+	return s
+}
+
+// Queue an event for delivery, returns false if the subscriber has been closed
+//  event:		the event to queue
+func (s *subscriber) push(event interface{}) bool {
+	s.Lock()
+	select {
+	case <-s.done:
+		s.Unlock()
+		return false
+	default:
+	}
+	if len(s.queue) >= s.size {
+		switch s.policy {
+		case DropNewest:
+			atomic.AddUint64(&s.dropped, 1)
+			countListenerDrop(s.kind)
+			s.Unlock()
+			return true
+		case Disconnect:
+			atomic.AddUint64(&s.dropped, 1)
+			countListenerDrop(s.kind)
+			s.Unlock()
+			s.closeWithError(ErrSlowConsumer)
+			return false
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			countListenerDrop(s.kind)
+			s.queue[0] = queuedEvent{}
+			s.queue = s.queue[1:]
+		}
+	}
+	s.queue = append(s.queue, queuedEvent{event: event, queued: time.Now()})
+	s.Unlock()
+
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Retrieve the next event to deliver, blocking until one is available
+func (s *subscriber) next() (queuedEvent, bool) {
+	for {
+		s.Lock()
+		if len(s.queue) > 0 {
+			item := s.queue[0]
+			s.queue[0] = queuedEvent{}
+			s.queue = s.queue[1:]
+			s.Unlock()
+			return item, true
+		}
+		s.Unlock()
+
+		select {
+		case <-s.done:
+			return queuedEvent{}, false
+		case <-s.wakeup:
+		}
+	}
+}
+
+func (s *subscriber) run() {
+	defer func() {
+		if s.finished != nil {
+			s.finished(s.Err())
+		}
+	}()
+	for {
+		item, found := s.next()
+		if !found {
+			return
+		}
+		if !s.safeDeliver(item.event) {
+			return
+		}
+		measureListenerLag(s.kind, item.queued)
+	}
+}
+
+func (s *subscriber) safeDeliver(event interface{}) (delivered bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			atomic.AddUint64(&s.panics, 1)
+			delivered = true
+		}
+	}()
+	return s.deliver(event, s.done)
+}
+
+// The number of events which have been dropped
+func (s *subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// The number of panics recovered from the subscriber
+func (s *subscriber) Panics() uint64 {
+	return atomic.LoadUint64(&s.panics)
+}
+
+// The reason the subscriber was closed, nil if closed normally or still open
+func (s *subscriber) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+// The channel closed once the subscriber has been closed
+func (s *subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *subscriber) close() {
+	s.closeWithError(nil)
+}
+
+func (s *subscriber) closeWithError(err error) {
+	s.once.Do(func() {
+		s.Lock()
+		s.err = err
+		s.queue = nil
+		close(s.done)
+		s.Unlock()
+	})
+}
+
+// fans events out to a set of subscribers, publishing never blocks
+type dispatcher struct {
+	sync.RWMutex
+	// the kind of listeners i.e. key, node or event, used in the metrics
+	kind string
+	// the subscribers, keyed by the channel or handle they were added with
+	subscribers map[interface{}]*subscriber
+}
+
+func newDispatcher(kind string) *dispatcher {
+	return &dispatcher{
+		kind:        kind,
+		subscribers: make(map[interface{}]*subscriber, 0),
+	}
+}
+
+// Add a subscriber, adding the same key twice is ignored
+//  key:		the channel or handle used to identify the subscriber
+//  size:		the size of the buffer for the subscriber
+//  policy:		the overflow policy when the buffer is full
+//  deliver:	passes the event to the subscriber
+//  finished:	called when the subscriber has been removed, can be nil
+func (d *dispatcher) add(key interface{}, size int, policy OverflowPolicy,
+	deliver func(interface{}, chan struct{}) bool, finished func(error)) *subscriber {
+	d.Lock()
+	defer d.Unlock()
+	if s, found := d.subscribers[key]; found {
+		return s
+	}
+	var s *subscriber
+	s = newSubscriber(d.kind, size, policy, deliver, func(err error) {
+		// step: a disconnected subscriber removes itself
+		if err != nil {
+			d.Lock()
+			if current, found := d.subscribers[key]; found && current == s {
+				delete(d.subscribers, key)
+			}
+			d.Unlock()
+		}
+		if finished != nil {
+			finished(err)
+		}
+	})
+	d.subscribers[key] = s
+	return s
+}
+
+// Remove and close a subscriber
+//  key:		the channel or handle the subscriber was added with
+func (d *dispatcher) remove(key interface{}) {
+	d.Lock()
+	s, found := d.subscribers[key]
+	delete(d.subscribers, key)
+	d.Unlock()
+	if found {
+		s.close()
+	}
+}
+
+// Publish an event to all the subscribers
+//  event:		the event to publish
+func (d *dispatcher) publish(event interface{}) {
+	d.RLock()
+	defer d.RUnlock()
+	for _, s := range d.subscribers {
+		s.push(event)
+	}
+}
+
+// Remove and close all the subscribers
+//  err:		the error passed to the subscribers, nil if they were not disconnected
+func (d *dispatcher) close(err error) {
+	d.Lock()
+	list := d.subscribers
+	d.subscribers = make(map[interface{}]*subscriber, 0)
+	d.Unlock()
+	for _, s := range list {
+		s.closeWithError(err)
+	}
+}
+
+// Create a deliver function which passes key events onto a channel
+//  channel:	the channel to pass the events upon
+func keyChannelDeliver(channel chan *KeyAPIEvent) func(interface{}, chan struct{}) bool {
+	return func(event interface{}, done chan struct{}) bool {
+		select {
+		case channel <- event.(*KeyAPIEvent):
+			return true
+		case <-done:
+			return false
+		}
+	}
+}
+
+// Create a deliver function which passes node events onto a channel
+//  channel:	the channel to pass the events upon
+func nodeChannelDeliver(channel chan *NodeAPIEvent) func(interface{}, chan struct{}) bool {
+	return func(event interface{}, done chan struct{}) bool {
+		select {
+		case channel <- event.(*NodeAPIEvent):
+			return true
+		case <-done:
+			return false
+		}
+	}
+}
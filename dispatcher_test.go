@@ -0,0 +1,145 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveKeys(t *testing.T, channel chan *KeyAPIEvent, count int) []string {
+	keys := make([]string, 0)
+	for i := 0; i < count; i++ {
+		select {
+		case event := <-channel:
+			keys = append(keys, event.Key)
+		case <-time.After(time.Duration(2) * time.Second):
+			t.Fatalf("we did not recieve the event in time")
+		}
+	}
+	return keys
+}
+
+func TestDispatcherDelivery(t *testing.T) {
+	d := newDispatcher("key")
+	channel := make(chan *KeyAPIEvent)
+	d.add(channel, 10, DropOldest, keyChannelDeliver(channel), nil)
+	d.publish(&KeyAPIEvent{Key: "a"})
+	d.publish(&KeyAPIEvent{Key: "b"})
+	assert.Equal(t, []string{"a", "b"}, receiveKeys(t, channel, 2), "the events should be in order")
+	d.close(nil)
+}
+
+func TestDispatcherSlowConsumer(t *testing.T) {
+	d := newDispatcher("key")
+	slow := make(chan *KeyAPIEvent)
+	fast := make(chan *KeyAPIEvent, 10)
+	d.add(slow, 1, DropNewest, keyChannelDeliver(slow), nil)
+	d.add(fast, 10, DropNewest, keyChannelDeliver(fast), nil)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		d.publish(&KeyAPIEvent{Key: key})
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d"}, receiveKeys(t, fast, 4), "the slow consumer should not block others")
+	d.close(nil)
+}
+
+func TestDispatcherDropOldest(t *testing.T) {
+	channel := make(chan *KeyAPIEvent)
+	started := make(chan struct{}, 1)
+	blocked := make(chan struct{})
+	s := newSubscriber("key", 2, DropOldest, func(event interface{}, done chan struct{}) bool {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-blocked
+		return keyChannelDeliver(channel)(event, done)
+	}, nil)
+	// step: the first event is held by the delivery, b is then dropped for c and d
+	s.push(&KeyAPIEvent{Key: "a"})
+	<-started
+	for _, key := range []string{"b", "c", "d"} {
+		s.push(&KeyAPIEvent{Key: key})
+	}
+	close(blocked)
+	assert.Equal(t, []string{"a", "c", "d"}, receiveKeys(t, channel, 3))
+	assert.Equal(t, uint64(1), s.Dropped(), "we should have dropped one event")
+	s.close()
+}
+
+func TestDispatcherDisconnect(t *testing.T) {
+	d := newDispatcher("key")
+	channel := make(chan *KeyAPIEvent)
+	finished := make(chan error, 1)
+	s := d.add(channel, 1, Disconnect, keyChannelDeliver(channel), func(err error) {
+		finished <- err
+	})
+	for _, key := range []string{"a", "b", "c"} {
+		d.publish(&KeyAPIEvent{Key: key})
+	}
+	select {
+	case err := <-finished:
+		assert.Equal(t, ErrSlowConsumer, err, "the subscriber should have been disconnected")
+	case <-time.After(time.Duration(2) * time.Second):
+		t.Fatalf("the subscriber was not disconnected")
+	}
+	assert.Equal(t, ErrSlowConsumer, s.Err())
+	assert.True(t, s.Dropped() > 0, "the dropped count should have been incremented")
+	select {
+	case <-s.Done():
+	default:
+		t.Errorf("the done channel should have been closed")
+	}
+	d.RLock()
+	assert.Equal(t, 0, len(d.subscribers), "the subscriber should have been removed")
+	d.RUnlock()
+}
+
+func TestDispatcherRecoverPanic(t *testing.T) {
+	d := newDispatcher("key")
+	received := make(chan string, 2)
+	s := d.add("handler", 10, DropOldest, func(event interface{}, done chan struct{}) bool {
+		key := event.(*KeyAPIEvent).Key
+		if key == "panic" {
+			panic("handler failure")
+		}
+		received <- key
+		return true
+	}, nil)
+	d.publish(&KeyAPIEvent{Key: "panic"})
+	d.publish(&KeyAPIEvent{Key: "after"})
+	select {
+	case key := <-received:
+		assert.Equal(t, "after", key, "delivery should continue after a panic")
+	case <-time.After(time.Duration(2) * time.Second):
+		t.Fatalf("we did not recieve the event after the panic")
+	}
+	assert.Equal(t, uint64(1), s.Panics(), "we should have recovered one panic")
+	d.close(nil)
+}
+
+func TestDispatcherRemove(t *testing.T) {
+	d := newDispatcher("key")
+	channel := make(chan *KeyAPIEvent, 10)
+	d.add(channel, 10, DropOldest, keyChannelDeliver(channel), nil)
+	d.remove(channel)
+	d.publish(&KeyAPIEvent{Key: "a"})
+	select {
+	case event := <-channel:
+		t.Fatalf("we should not have recieved an event: %s", event)
+	case <-time.After(time.Duration(100) * time.Millisecond):
+	}
+}
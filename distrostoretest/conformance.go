@@ -0,0 +1,451 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package distrostoretest holds a conformance suite for the DistroStore
+// implementations, so an alternative or mock backend can be checked to behave
+// the same as the consul one.
+package distrostoretest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/gambol99/distrostore"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	// the time we wait on an event which should arrive
+	EventTimeout = (time.Duration(15) * time.Second)
+	// the time we wait to be sure an event is not going to arrive
+	QuietPeriod = (time.Duration(2) * time.Second)
+)
+
+// Run the conformance suite against a backend; every test is given a new store
+// from the factory, which is closed once the test has finished. The ttl expiry
+// test waits on the ttl, so it is skipped in short mode.
+//  t:			the test we are running under
+//  factory:	creates a ready to use store
+func RunConformance(t *testing.T, factory func() ds.DistroStore) {
+	tests := []struct {
+		name string
+		test func(*testing.T, ds.DistroStore)
+	}{
+		{"Config", testConfig},
+		{"KeyValue", testKeyValue},
+		{"Delete", testDelete},
+		{"CompareAndSet", testCompareAndSet},
+		{"SnapshotRestore", testSnapshotRestore},
+		{"ExportImport", testExportImport},
+		{"KeyEventOrdering", testKeyEventOrdering},
+		{"KeyListenerRemoval", testKeyListenerRemoval},
+		{"Watch", testWatch},
+		{"TTLExpiry", testTTLExpiry},
+		{"Nodes", testNodes},
+		{"NodeTags", testNodeTags},
+		{"Reload", testReload},
+		{"Broadcast", testBroadcast},
+		{"Query", testQuery},
+		{"Services", testServices},
+		{"Close", testClose},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			store := factory()
+			if store == nil {
+				t.Fatalf("the factory did not return a store")
+			}
+			defer store.Close()
+			test.test(t, store)
+		})
+	}
+}
+
+// Wait on the next key event
+//  t:			the test we are running under
+//  channel:	the channel the events are passed on
+func nextKeyEvent(t *testing.T, channel <-chan *ds.KeyAPIEvent) *ds.KeyAPIEvent {
+	select {
+	case event, found := <-channel:
+		if !found {
+			t.Fatalf("the key event channel was closed")
+		}
+		return event
+	case <-time.After(EventTimeout):
+		t.Fatalf("we did not recieve the key event in time")
+	}
+	return nil
+}
+
+// Watch the prefix from the current index of the store, so no change made after
+// we return can be missed while the watch starts
+//  t:			the test we are running under
+//  store:		the store being tested
+//  prefix:		the prefix to watch
+//  options:	the options for the watch, can be nil
+func watchFromNow(t *testing.T, store ds.DistroStore, prefix string, options *ds.WatchOptions) ds.Subscription {
+	if options == nil {
+		options = &ds.WatchOptions{}
+	}
+	if err := store.Set("conformance/marker", prefix); err != nil {
+		t.Fatalf("unable to set the marker key, error: %s", err)
+	}
+	options.Index, _, _ = store.GetIndex("conformance/marker")
+	subscription, err := store.Watch(prefix, options)
+	if err != nil {
+		t.Fatalf("unable to watch the prefix %s, error: %s", prefix, err)
+	}
+	return subscription
+}
+
+// Wait on the condition to be true, the consul catalog is updated in the background
+//  t:			the test we are running under
+//  condition:	the condition we are waiting on
+//  message:	the failure message
+func eventually(t *testing.T, condition func() bool, message string) {
+	deadline := time.Now().Add(EventTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Error(message)
+			return
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+}
+
+func testConfig(t *testing.T, store ds.DistroStore) {
+	assert.NotNil(t, store.Config(), "we have not recieved the store config")
+}
+
+func testKeyValue(t *testing.T, store ds.DistroStore) {
+	_, found, err := store.Get("conformance/kv")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.False(t, found, "the key should not exist yet")
+
+	assert.Nil(t, store.Set("conformance/kv", "hello"))
+	value, found, err := store.Get("conformance/kv")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, found, "the key should exist")
+	assert.Equal(t, "hello", value)
+	found, err = store.Exists("conformance/kv")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, found, "the key should exist")
+
+	first, found, err := store.GetIndex("conformance/kv")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, found, "the key should exist")
+	assert.Nil(t, store.Set("conformance/kv", "world"))
+	second, _, _ := store.GetIndex("conformance/kv")
+	assert.True(t, second > first, "the index should move on with the change")
+}
+
+func testDelete(t *testing.T, store ds.DistroStore) {
+	assert.Nil(t, store.Delete("conformance/missing"), "deleting a missing key should not fail")
+	assert.Nil(t, store.Set("conformance/delete", "hello"))
+	assert.Nil(t, store.Delete("conformance/delete"))
+	found, err := store.Exists("conformance/delete")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.False(t, found, "the key should have been deleted")
+	_, found, _ = store.GetIndex("conformance/delete")
+	assert.False(t, found, "the key should have no index once deleted")
+}
+
+func testCompareAndSet(t *testing.T, store ds.DistroStore) {
+	updated, err := store.CompareAndSet("conformance/cas", "a", 0)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, updated, "a zero index should create the key")
+	updated, _ = store.CompareAndSet("conformance/cas", "b", 0)
+	assert.False(t, updated, "a zero index should not replace the key")
+
+	index, _, _ := store.GetIndex("conformance/cas")
+	assert.Nil(t, store.Set("conformance/cas", "c"))
+	updated, _ = store.CompareAndSet("conformance/cas", "d", index)
+	assert.False(t, updated, "a stale index should conflict")
+
+	index, _, _ = store.GetIndex("conformance/cas")
+	updated, err = store.CompareAndSet("conformance/cas", "e", index)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, updated, "the current index should update the key")
+	value, _, _ := store.Get("conformance/cas")
+	assert.Equal(t, "e", value)
+}
+
+func testSnapshotRestore(t *testing.T, store ds.DistroStore) {
+	assert.Nil(t, store.Set("conformance/snapshot/a", "1"))
+	assert.Nil(t, store.Set("conformance/snapshot/b", "2"))
+	buffer := new(bytes.Buffer)
+	meta, err := store.Snapshot(buffer)
+	if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+		t.FailNow()
+	}
+	assert.True(t, meta.Keys >= 2, "the snapshot should hold the keys")
+	assert.NotEmpty(t, meta.Checksum)
+	snapshot := buffer.Bytes()
+
+	// step: change the keys and restore them
+	assert.Nil(t, store.Set("conformance/snapshot/a", "changed"))
+	assert.Nil(t, store.Delete("conformance/snapshot/b"))
+	assert.Nil(t, store.Set("conformance/snapshot/c", "3"))
+	restored, err := store.Restore(bytes.NewReader(snapshot))
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	if assert.NotNil(t, restored) {
+		assert.Equal(t, meta.Checksum, restored.Checksum)
+	}
+	for key, expected := range map[string]string{"a": "1", "b": "2"} {
+		value, found, _ := store.Get("conformance/snapshot/" + key)
+		assert.True(t, found, "the key %s should have been restored", key)
+		assert.Equal(t, expected, value)
+	}
+	found, _ := store.Exists("conformance/snapshot/c")
+	assert.False(t, found, "the key missing from the snapshot should be deleted")
+
+	// step: a corrupted snapshot is refused
+	corrupted := bytes.Replace(snapshot, []byte(`"key":"conformance/snapshot/a"`), []byte(`"key":"conformance/snapshot/x"`), 1)
+	_, err = store.Restore(bytes.NewReader(corrupted))
+	assert.Equal(t, ds.ErrSnapshotChecksum, err)
+}
+
+func testExportImport(t *testing.T, store ds.DistroStore) {
+	assert.Nil(t, store.Set("conformance/export/a", "1"))
+	assert.Nil(t, store.Set("conformance/export/b", "2"))
+	buffer := new(bytes.Buffer)
+	err := store.Export("conformance/export/", ds.FormatJSON, buffer)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+
+	assert.Nil(t, store.Set("conformance/export/a", "changed"))
+	summary, err := store.Import(bytes.NewReader(buffer.Bytes()), ds.FormatJSON, &ds.ImportOptions{Prefix: "conformance/imported/"})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	if assert.NotNil(t, summary) {
+		assert.Equal(t, 2, len(summary.Added))
+	}
+	value, _, _ := store.Get("conformance/imported/conformance/export/a")
+	assert.Equal(t, "1", value)
+
+	summary, err = store.Import(bytes.NewReader(buffer.Bytes()), ds.FormatJSON, &ds.ImportOptions{Overwrite: true})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	if assert.NotNil(t, summary) {
+		assert.Equal(t, []string{"conformance/export/a"}, summary.Updated)
+		assert.Equal(t, []string{"conformance/export/b"}, summary.Unchanged)
+	}
+	value, _, _ = store.Get("conformance/export/a")
+	assert.Equal(t, "1", value)
+}
+
+func testKeyEventOrdering(t *testing.T, store ds.DistroStore) {
+	subscription := watchFromNow(t, store, "conformance/order/", nil)
+	defer subscription.Close()
+
+	// step: each change is waited on, consul may merge the changes made within one blocking query
+	var last uint64
+	changes := []struct {
+		change func() error
+		status ds.KeyStatus
+		value  string
+	}{
+		{func() error { return store.Set("conformance/order/key", "1") }, ds.KeySet, "1"},
+		{func() error { return store.Set("conformance/order/key", "2") }, ds.KeyChanged, "2"},
+		{func() error { return store.Delete("conformance/order/key") }, ds.KeyDeleted, ""},
+	}
+	for _, change := range changes {
+		assert.Nil(t, change.change())
+		event := nextKeyEvent(t, subscription.Events())
+		assert.Equal(t, "conformance/order/key", event.Key)
+		assert.Equal(t, change.status, event.Status)
+		assert.True(t, event.ModifyIndex > last, "the events should be in the order of the changes")
+		if change.value != "" {
+			assert.Equal(t, []byte(change.value), event.Value)
+		} else {
+			assert.Equal(t, []byte("2"), event.PrevValue, "the delete should carry the previous value")
+		}
+		last = event.ModifyIndex
+	}
+}
+
+func testKeyListenerRemoval(t *testing.T, store ds.DistroStore) {
+	channel := make(chan *ds.KeyAPIEvent, 10)
+	store.AddKeyListener(channel)
+	assert.Nil(t, store.Set("conformance/listener", "1"))
+	event := nextKeyEvent(t, channel)
+	assert.Equal(t, "conformance/listener", event.Key)
+
+	store.RemoveKeyListener(channel)
+	assert.Nil(t, store.Set("conformance/listener", "2"))
+	select {
+	case event := <-channel:
+		if event != nil {
+			t.Errorf("we should not recieve events after the listener was removed: %s", event)
+		}
+	case <-time.After(QuietPeriod):
+	}
+}
+
+func testWatch(t *testing.T, store ds.DistroStore) {
+	subscription := watchFromNow(t, store, "conformance/watch/", &ds.WatchOptions{Glob: "conformance/watch/*/config"})
+	_, err := store.Watch("conformance/", &ds.WatchOptions{Glob: "*", Regex: ".*"})
+	assert.Equal(t, ds.ErrInvalidWatchFilter, err)
+
+	assert.Nil(t, store.Set("conformance/other", "1"))
+	assert.Nil(t, store.Set("conformance/watch/web/port", "80"))
+	assert.Nil(t, store.Set("conformance/watch/web/config", "{}"))
+	event := nextKeyEvent(t, subscription.Events())
+	assert.Equal(t, "conformance/watch/web/config", event.Key, "we should only recieve the matching keys")
+	assert.Equal(t, event.ModifyIndex, subscription.LastIndex())
+
+	subscription.Close()
+	select {
+	case _, found := <-subscription.Events():
+		assert.False(t, found, "the events channel should be closed")
+	case <-time.After(EventTimeout):
+		t.Fatalf("the events channel was not closed in time")
+	}
+}
+
+func testTTLExpiry(t *testing.T, store ds.DistroStore) {
+	assert.Equal(t, ds.ErrInvalidTTL, store.SetWithTTL("conformance/ttl", "1", time.Second))
+	if testing.Short() {
+		t.Skip("skipping the ttl expiry in short mode")
+	}
+	assert.Nil(t, store.SetWithTTL("conformance/ttl", "1", ds.MinKeyTTL))
+	found, _ := store.Exists("conformance/ttl")
+	assert.True(t, found, "the key should exist until the ttl has passed")
+	assert.Equal(t, ds.ErrKeyLocked, store.SetWithTTL("conformance/ttl", "2", ds.MinKeyTTL))
+
+	// step: consul can take up to twice the ttl to expire a session
+	deadline := time.Now().Add(3 * ds.MinKeyTTL)
+	for time.Now().Before(deadline) {
+		if found, _ = store.Exists("conformance/ttl"); !found {
+			return
+		}
+		time.Sleep(time.Duration(500) * time.Millisecond)
+	}
+	t.Fatalf("the key was not deleted once the ttl had passed")
+}
+
+func testNodes(t *testing.T, store ds.DistroStore) {
+	nodes, err := store.Nodes()
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.NotEmpty(t, nodes, "there should be at least this node")
+	alive := 0
+	for _, node := range nodes {
+		if node.IsAlive() {
+			alive++
+		}
+	}
+	assert.True(t, alive > 0, "at least this node should be alive")
+	assert.Equal(t, ds.ErrInvalidMemberAddress, store.Join("nowhere"))
+}
+
+func testNodeTags(t *testing.T, store ds.DistroStore) {
+	name := store.Config().NodeName
+	nodes, _ := store.Nodes()
+	for _, node := range nodes {
+		if name == "" || node.ID == name {
+			for key, value := range store.Config().NodeTags {
+				assert.Equal(t, value, node.Tags[key], "the node should carry the tag: %s", key)
+			}
+			return
+		}
+	}
+	t.Fatalf("the node was not found in the list of nodes")
+}
+
+func testReload(t *testing.T, store ds.DistroStore) {
+	assert.NotNil(t, store.Reload(nil), "a nil context should be rejected")
+	updated := *store.Config()
+	updated.LogLevel = "DEBUG"
+	assert.Nil(t, store.Reload(&updated), "the live settings should not need a restart")
+	assert.Equal(t, "DEBUG", store.Config().LogLevel)
+
+	updated.Datacenter = "elsewhere"
+	updated.NodeTags = map[string]string{"zone": "reloaded"}
+	err := store.Reload(&updated)
+	if restart, ok := err.(*ds.RestartRequiredError); assert.True(t, ok, "we should recieve a restart error: %v", err) {
+		assert.Equal(t, []string{"Datacenter", "NodeTags"}, restart.Fields)
+	}
+	updated.LogLevel = "LOUD"
+	assert.Equal(t, ds.ErrInvalidLogLevel, store.Reload(&updated))
+}
+
+func testBroadcast(t *testing.T, store ds.DistroStore) {
+	assert.Equal(t, ds.ErrInvalidEventName, store.Broadcast("", nil, false))
+	assert.Equal(t, ds.ErrUserEventTooLarge, store.Broadcast("conformance", []byte(strings.Repeat("x", ds.MaxUserEventSize)), false))
+
+	channel := make(chan *ds.UserEvent, 10)
+	store.AddEventListener("conformance", channel)
+	defer store.RemoveEventListener(channel)
+	assert.Nil(t, store.Broadcast("conformance", []byte("payload"), false))
+	select {
+	case event := <-channel:
+		assert.Equal(t, "conformance", event.Name)
+		assert.Equal(t, []byte("payload"), event.Payload)
+	case <-time.After(EventTimeout):
+		t.Fatalf("we did not recieve the user event in time")
+	}
+}
+
+func testQuery(t *testing.T, store ds.DistroStore) {
+	// step: neither backend has queries, the embedded consul does not expose them
+	assert.Equal(t, ds.ErrQueryUnsupported, store.HandleQuery("conformance", func(payload []byte) ([]byte, error) {
+		return payload, nil
+	}))
+	_, err := store.Query("conformance", []byte("ping"), nil)
+	assert.Equal(t, ds.ErrQueryUnsupported, err)
+}
+
+func testServices(t *testing.T, store ds.DistroStore) {
+	_, err := store.RegisterService(&ds.Service{})
+	assert.Equal(t, ds.ErrInvalidService, err)
+	handles, err := store.RegisterService(&ds.Service{Name: "conformance", Port: 8080},
+		&ds.ServiceCheck{Kind: ds.CheckTTL, TTL: time.Minute})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	if len(handles) != 1 {
+		t.Fatalf("we should have recieved a handle for the check")
+	}
+
+	count := func(passingOnly bool) int {
+		services, err := store.Services("conformance", passingOnly)
+		assert.Nil(t, err, "we should not recieve an error: %s", err)
+		return len(services)
+	}
+	eventually(t, func() bool { return count(false) == 1 }, "the critical instance should be listed")
+	assert.Equal(t, 0, count(true), "the ttl check should start critical")
+
+	assert.Nil(t, handles[0].Pass("ready"))
+	eventually(t, func() bool { return count(true) == 1 }, "the instance should be passing")
+	services, _ := store.Services("conformance", true)
+	if len(services) == 1 {
+		assert.Equal(t, 8080, services[0].Service.Port)
+		assert.Equal(t, ds.HealthPassing, services[0].Status)
+	}
+
+	assert.Nil(t, store.DeregisterService("conformance"))
+	eventually(t, func() bool { return count(false) == 0 }, "the service should have been removed")
+}
+
+func testClose(t *testing.T, store ds.DistroStore) {
+	channel := make(chan *ds.NodeAPIEvent, 10)
+	listener := store.AddNodeListener(channel)
+	assert.Nil(t, store.Close())
+	assert.Nil(t, store.Close(), "closing twice should not fail")
+	_, err := store.Watch("conformance/", nil)
+	assert.Equal(t, ds.ErrStoreClosed, err)
+	select {
+	case <-listener.Done():
+		assert.Equal(t, ds.ErrStoreClosed, listener.Err())
+	case <-time.After(EventTimeout):
+		t.Fatalf("the listener was not removed with the store")
+	}
+}
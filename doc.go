@@ -14,19 +14,44 @@ limitations under the License.
 package distrostore
 
 import (
+	"context"
 	"errors"
+	"io"
+	"time"
+)
+
+const (
+	// the shortest ttl for a key, the least consul allows on a session
+	MinKeyTTL = (time.Duration(10) * time.Second)
+	// the longest ttl for a key, the most consul allows on a session
+	MaxKeyTTL = (time.Duration(3600) * time.Second)
 )
 
 var (
 	ErrInvalidConfig = errors.New("Invalid configuration supplied")
 	// an invalid member / endpoint
 	ErrInvalidMemberAddress = errors.New("Invalid members / endpoint address")
+	// the store has been closed
+	ErrStoreClosed = errors.New("The store has been closed")
+	// the node did not leave the cluster gracefully in time, it was shutdown regardless
+	ErrLeaveTimeout = errors.New("Timed out leaving the cluster, the node was shutdown regardless")
+	// the ttl for the key is outside of the range supported
+	ErrInvalidTTL = errors.New("The ttl for the key must be between 10 seconds and an hour")
+	// the key is held by another session
+	ErrKeyLocked = errors.New("The key is held by another session")
 )
 
 type DistroStore interface {
 	Config() *Context
-	// shutdown and release resources
+	// apply a new context to the running node, returning a RestartRequiredError
+	// listing the settings which can't be changed live
+	Reload(cfg *Context) error
+	// leave the cluster and release resources, safe to call more than once
 	Close() error
+	// as Close, giving up on the graceful leave when the context is done
+	CloseWithContext(ctx context.Context) error
+	// shutdown and release resources, force skips leaving the cluster
+	Shutdown(force bool) error
 	// join a new member to the cluster
 	Join(member string) error
 	// get a list of the nodes in the cluster
@@ -37,15 +62,77 @@ type DistroStore interface {
 	Set(key string, data string) error
 	// get the value from the store
 	Get(key string) (string, bool, error)
-	// add a node listener for the cluster
-	AddNodeListener(channel chan *NodeAPIEvent)
-	// watch for changes in the store
-	AddKeyListener(channel chan *KeyAPIEvent)
+	// delete a key from the store
+	Delete(key string) error
+	// get the modify index of a key, used with CompareAndSet
+	GetIndex(key string) (uint64, bool, error)
+	// set the key only if it has not been modified since the index, zero only creates the key
+	CompareAndSet(key, data string, index uint64) (bool, error)
+	// set a key which is deleted once the ttl has passed
+	SetWithTTL(key, data string, ttl time.Duration) error
+	// write a consistent snapshot of the keys to the writer
+	Snapshot(w io.Writer) (*SnapshotMeta, error)
+	// replace the keys with those in a snapshot, verifying its checksum
+	Restore(r io.Reader) (*SnapshotMeta, error)
+	// the status of the scheduled snapshots
+	SnapshotStatus() SnapshotStatus
+	// write the keys under the prefix in the format, json, yaml or tree
+	Export(prefix string, format ExportFormat, w io.Writer) error
+	// read the keys from an export into the store, returning the changes
+	Import(r io.Reader, format ExportFormat, options *ImportOptions) (*ImportSummary, error)
+	// add a node listener for the cluster, the handle carries its drop count
+	AddNodeListener(channel chan *NodeAPIEvent) Listener
+	// remove a node listener
+	RemoveNodeListener(channel chan *NodeAPIEvent)
+	// watch for changes in the store, the handle carries its drop count
+	AddKeyListener(channel chan *KeyAPIEvent) Listener
+	// remove a key listener
+	RemoveKeyListener(channel chan *KeyAPIEvent)
+	// watch for changes to the keys under a prefix
+	Watch(prefix string, options *WatchOptions) (Subscription, error)
+	// broadcast a user event to every node in the cluster
+	Broadcast(name string, payload []byte, coalesce bool) error
+	// add a listener for user events, an empty name listens to all of them
+	AddEventListener(name string, channel chan *UserEvent) Listener
+	// remove a user event listener
+	RemoveEventListener(channel chan *UserEvent)
+	// query the nodes in the cluster, returns ErrQueryUnsupported as the embedded
+	// consul does not expose serf queries
+	Query(name string, payload []byte, options *QueryOptions) (*QueryResponse, error)
+	// register the handler for queries of the given name, returns ErrQueryUnsupported
+	HandleQuery(name string, handler QueryHandler) error
+	// register a service and its health checks on this node
+	RegisterService(service *Service, checks ...*ServiceCheck) ([]*CheckHandle, error)
+	// remove a service from this node
+	DeregisterService(id string) error
+	// retrieve the instances of a service across the cluster
+	Services(name string, passingOnly bool) ([]*ServiceInstance, error)
+	// watch the passing instances of a service
+	WatchService(name, tag string) (ServiceSubscription, error)
+}
+
+// Check the ttl for a key is supported
+//  ttl:		the time to live for the key
+func validateKeyTTL(ttl time.Duration) error {
+	if ttl < MinKeyTTL || ttl > MaxKeyTTL {
+		return ErrInvalidTTL
+	}
+	return nil
 }
 
 func New(cfg *Context) (DistroStore, error) {
 	if cfg == nil {
 		return nil, errors.New("You have not specified any configuration")
 	}
-	return NewConsulDistributedStore(cfg)
+	switch cfg.Backend {
+	case "", BackendConsul:
+		return NewConsulDistributedStore(cfg)
+	case BackendMemory:
+		store, err := NewMemoryStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, ErrInvalidConfig
 }
@@ -15,25 +15,117 @@ package distrostore
 
 import "fmt"
 
-// an interface used for the join and leaving of nodes in the cluster
+// the type of change made to the membership of a node
+type NodeEventStatus int
+
+const (
+	// the node has joined the cluster or has become alive again
+	NodeEventJoined NodeEventStatus = iota + 1
+	// the node has gracefully left the cluster or has been reaped
+	NodeEventLeft
+	// the node has stopped responding
+	NodeEventFailed
+	// the address, role, tags or leadership of the node have changed
+	NodeEventUpdated
+)
+
+func (s NodeEventStatus) String() string {
+	switch s {
+	case NodeEventJoined:
+		return "joined"
+	case NodeEventLeft:
+		return "left"
+	case NodeEventFailed:
+		return "failed"
+	case NodeEventUpdated:
+		return "update"
+	default:
+		return "unknown"
+	}
+}
+
+// an event for the join, leaving or update of a node in the cluster
 type NodeAPIEvent struct {
 	// a link to the node info
 	Node *Node
-	// the status i.e. left, joined
-	Status string
+	// the type of change (joined, left, failed, update)
+	Status NodeEventStatus
 }
 
 func (k NodeAPIEvent) String() string {
 	return fmt.Sprintf("node: %s, status: %s", k.Node.ID, k.Status)
 }
 
+// the type of change made to a key
+type KeyStatus int
+
+const (
+	// the key has been created
+	KeySet KeyStatus = iota + 1
+	// the value of the key has changed
+	KeyChanged
+	// the key has been deleted
+	KeyDeleted
+	// the watch was unable to work out the changes since its index, the key is
+	// the prefix being watched and the consumer should re-read it
+	KeyResync
+)
+
+func (s KeyStatus) String() string {
+	switch s {
+	case KeySet:
+		return "set"
+	case KeyChanged:
+		return "change"
+	case KeyDeleted:
+		return "delete"
+	case KeyResync:
+		return "resync"
+	default:
+		return "unknown"
+	}
+}
+
+// an event for the change of a key under a watched prefix
 type KeyAPIEvent struct {
 	// the key for this value
 	Key string
-	// the type of update (set, change, delete)
-	Status string
+	// the type of change (set, change, delete, resync)
+	Status KeyStatus
+	// the new value of the key, nil on delete or when larger than the EventValueLimit
+	Value []byte
+	// the previous value of the key, nil on set or when larger than the EventValueLimit
+	PrevValue []byte
+	// the value was larger than the EventValueLimit and has not been included
+	ValueOmitted bool
+	// the index the key was created at
+	CreateIndex uint64
+	// the index the key was last modified at, on delete the index the delete was seen at
+	ModifyIndex uint64
+	// the flags stored with the key
+	Flags uint64
+	// the session holding a lock on the key, if any
+	Session string
 }
 
 func (k KeyAPIEvent) String() string {
-	return fmt.Sprintf("key: %s, status: %s", k.Key, k.Status)
+	return fmt.Sprintf("key: %s, status: %s, index: %d", k.Key, k.Status, k.ModifyIndex)
+}
+
+// a user event broadcast across the cluster
+type UserEvent struct {
+	// the unique id of the event
+	ID string
+	// the name of the event
+	Name string
+	// the payload of the event
+	Payload []byte
+	// the lamport time of the event
+	LTime uint64
+	// whether the event was coalesced with others of the same name
+	Coalesce bool
+}
+
+func (u UserEvent) String() string {
+	return fmt.Sprintf("event: %s, id: %s, ltime: %d", u.Name, u.ID, u.LTime)
 }
@@ -30,7 +30,7 @@ import (
 var (
 	bootstrap = kingpin.Flag("bootstrap", "whether we are the bootstrap").Bool()
 	members = kingpin.Flag("member", "add a member to the list").Strings()
-	offset = kingpin.Flag("offset", "add the offset to the ports").Required().Int()
+	offset = kingpin.Flag("offset", "add the offset to the ports, otherwise free ports are allocated").Int()
 )
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -58,13 +58,17 @@ func main() {
 	config.DataDir = tempDirectory()
 	config.Bootstrap = *bootstrap
 	config.Members = *members
-	config.PortsConfig.ApplyIndex(*offset)
-	log.Println("Ports: %s", config.PortsConfig)
+	if *offset > 0 {
+		config.PortsConfig.ApplyIndex(*offset)
+	} else {
+		config.PortsConfig = ds.PortConfig{}
+	}
 
 	store, err := ds.New(config)
 	if err != nil {
 		log.Fatalf("Failed to create the distributed data store, error: %s", err)
 	}
+	log.Printf("Ports: %s", store.Config().PortsConfig)
 
 	time.Sleep(time.Duration(3) * time.Second)
 
@@ -0,0 +1,421 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the format of an export
+type ExportFormat string
+
+const (
+	// a json list of the keys
+	FormatJSON ExportFormat = "json"
+	// a yaml list of the keys
+	FormatYAML ExportFormat = "yaml"
+	// a nested json document, one level per path segment; keys with flags can't be exported
+	FormatTree ExportFormat = "tree"
+	// the prefix of a base64 encoded value in the tree format
+	treeBase64Prefix = "base64:"
+)
+
+var (
+	// the format is not one we support
+	ErrInvalidFormat = errors.New("The format must be one of json, yaml or tree")
+	// the keys can't be placed in a tree
+	ErrTreeConflict = errors.New("A key is both a value and the parent of other keys, it can't be exported as a tree")
+	// the tree format has nowhere to hold the flags of a key
+	ErrTreeFlags = errors.New("A key has flags, which can't be held in a tree export, use the json or yaml format")
+	// a key was changed by someone else between working out the import and writing it
+	ErrImportConflict = errors.New("The keys were changed by someone else during the import, nothing was written")
+)
+
+// a key in the store, along with the index it was last modified at
+type KeyPair struct {
+	// the key
+	Key string `json:"key"`
+	// the flags stored with the key
+	Flags uint64 `json:"flags,omitempty"`
+	// the value of the key
+	Value []byte `json:"value"`
+	// the index the key was last modified at
+	ModifyIndex uint64 `json:"-"`
+}
+
+// the parts of a backend the export and import are built on
+type pairStore interface {
+	// list the keys under the prefix, with the index of the store
+	listPairs(prefix string) ([]*KeyPair, uint64, error)
+	// set the key if it has not been modified since the index, zero only creates the key
+	casPair(pair *KeyPair, index uint64) (bool, error)
+}
+
+// a key in the json and yaml exports
+type ExportedKey struct {
+	// the key
+	Key string `json:"key" yaml:"key"`
+	// the flags stored with the key
+	Flags uint64 `json:"flags,omitempty" yaml:"flags,omitempty"`
+	// the value of the key, base64 encoded if not valid utf8
+	Value string `json:"value" yaml:"value"`
+	// whether the value is base64 encoded
+	Base64 bool `json:"base64,omitempty" yaml:"base64,omitempty"`
+}
+
+// the options for an import
+type ImportOptions struct {
+	// a prefix added to each key imported
+	Prefix string
+	// replace the keys which already exist, else they are skipped
+	Overwrite bool
+	// work out the changes without making them
+	DryRun bool
+}
+
+// the changes made by an import
+type ImportSummary struct {
+	// the keys added
+	Added []string
+	// the keys whose value or flags were replaced
+	Updated []string
+	// the keys which already held the value
+	Unchanged []string
+	// the keys which exist and were not overwritten
+	Skipped []string
+	// the keys which were changed by someone else during the import, and were left alone
+	Conflicts []string
+	// the changes were not made
+	DryRun bool
+}
+
+// A summary of the changes, followed by a line per key changed or not imported
+func (s ImportSummary) String() string {
+	summary := fmt.Sprintf("added: %d, updated: %d, unchanged: %d, skipped: %d, conflicts: %d",
+		len(s.Added), len(s.Updated), len(s.Unchanged), len(s.Skipped), len(s.Conflicts))
+	if s.DryRun {
+		summary += " (dry run)"
+	}
+	for _, item := range []struct {
+		mark string
+		keys []string
+	}{{"+", s.Added}, {"~", s.Updated}, {"=", s.Skipped}, {"!", s.Conflicts}} {
+		for _, key := range item.keys {
+			summary += fmt.Sprintf("\n%s %s", item.mark, key)
+		}
+	}
+	return summary
+}
+
+// Write the keys under the prefix in the format
+//  store:		the backend holding the keys
+//  prefix:		the prefix of the keys exported
+//  format:		the format of the export
+//  w:			the writer for the export
+func exportKeys(store pairStore, prefix string, format ExportFormat, w io.Writer) error {
+	if err := validateFormat(format); err != nil {
+		return err
+	}
+	pairs, _, err := store.listPairs(prefix)
+	if err != nil {
+		return err
+	}
+	var content []byte
+	switch format {
+	case FormatJSON:
+		content, err = json.MarshalIndent(encodeKeys(pairs), "", "  ")
+		content = append(content, '\n')
+	case FormatYAML:
+		content, err = yaml.Marshal(encodeKeys(pairs))
+	case FormatTree:
+		var tree map[string]interface{}
+		if tree, err = encodeTree(pairs); err == nil {
+			content, err = json.MarshalIndent(tree, "", "  ")
+			content = append(content, '\n')
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// Read the keys from an export and write them to the store. The embedded
+// consul has no transactions, so the changes are worked out for every key and
+// checked against a second listing before any are written; each key is then
+// written with a cas against the index it was compared at, and a key changed by
+// someone else in between is left alone and reported as a conflict. On an error
+// the summary holds the keys written before it
+//  store:		the backend to import into
+//  r:			the reader for the export
+//  format:		the format of the export
+//  options:	the options for the import, can be nil
+func importKeys(store pairStore, r io.Reader, format ExportFormat, options *ImportOptions) (*ImportSummary, error) {
+	if err := validateFormat(format); err != nil {
+		return nil, err
+	}
+	if options == nil {
+		options = &ImportOptions{}
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := decodeExport(content, format)
+	if err != nil {
+		return nil, err
+	}
+	current, _, err := store.listPairs(options.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*KeyPair, len(current))
+	for _, pair := range current {
+		existing[pair.Key] = pair
+	}
+
+	// step: work out the change for every key before writing any of them
+	summary := &ImportSummary{DryRun: options.DryRun}
+	changes := make([]*importChange, 0, len(pairs))
+	seen := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		pair.Key = options.Prefix + pair.Key
+		if seen[pair.Key] {
+			return nil, fmt.Errorf("the key %s is in the export more than once", pair.Key)
+		}
+		seen[pair.Key] = true
+		change := &importChange{pair: pair, added: true}
+		if item, found := existing[pair.Key]; found {
+			switch {
+			case item.Flags == pair.Flags && bytes.Equal(item.Value, pair.Value):
+				summary.Unchanged = append(summary.Unchanged, pair.Key)
+				continue
+			case !options.Overwrite:
+				summary.Skipped = append(summary.Skipped, pair.Key)
+				continue
+			}
+			change.index = item.ModifyIndex
+			change.added = false
+		}
+		changes = append(changes, change)
+	}
+	if options.DryRun {
+		for _, change := range changes {
+			summary.record(change)
+		}
+		return summary, nil
+	}
+
+	// step: check none of the keys have moved on before the first write
+	if current, _, err = store.listPairs(options.Prefix); err != nil {
+		return nil, err
+	}
+	indexes := make(map[string]uint64, len(current))
+	for _, pair := range current {
+		indexes[pair.Key] = pair.ModifyIndex
+	}
+	for _, change := range changes {
+		if indexes[change.pair.Key] != change.index {
+			summary.Conflicts = append(summary.Conflicts, change.pair.Key)
+		}
+	}
+	if len(summary.Conflicts) > 0 {
+		return summary, ErrImportConflict
+	}
+
+	for _, change := range changes {
+		updated, err := store.casPair(change.pair, change.index)
+		if err != nil {
+			return summary, err
+		}
+		if !updated {
+			summary.Conflicts = append(summary.Conflicts, change.pair.Key)
+			continue
+		}
+		summary.record(change)
+	}
+	return summary, nil
+}
+
+// a key to be written by an import
+type importChange struct {
+	// the key and its value
+	pair *KeyPair
+	// the index the key was compared at, zero if it does not exist
+	index uint64
+	// the key does not exist
+	added bool
+}
+
+// Add the change to the keys added or updated
+//  change:		the change made
+func (s *ImportSummary) record(change *importChange) {
+	if change.added {
+		s.Added = append(s.Added, change.pair.Key)
+	} else {
+		s.Updated = append(s.Updated, change.pair.Key)
+	}
+}
+
+func validateFormat(format ExportFormat) error {
+	switch format {
+	case FormatJSON, FormatYAML, FormatTree:
+		return nil
+	}
+	return ErrInvalidFormat
+}
+
+// Convert the keys for the json and yaml exports
+//  pairs:		the keys in the store
+func encodeKeys(pairs []*KeyPair) []*ExportedKey {
+	sort.Sort(byKeyPair(pairs))
+	list := make([]*ExportedKey, 0, len(pairs))
+	for _, pair := range pairs {
+		item := &ExportedKey{Key: pair.Key, Flags: pair.Flags, Value: string(pair.Value)}
+		if !utf8.Valid(pair.Value) {
+			item.Value = base64.StdEncoding.EncodeToString(pair.Value)
+			item.Base64 = true
+		}
+		list = append(list, item)
+	}
+	return list
+}
+
+// Place the keys in a tree, split on the '/'; a key ending in a '/' is held
+// under the empty name inside its directory. Values which are not valid utf8,
+// or which could be mistaken for an encoded one, are base64 encoded with a
+// prefix; keys with flags are rejected rather than losing them
+//  pairs:		the keys in the store
+func encodeTree(pairs []*KeyPair) (map[string]interface{}, error) {
+	tree := make(map[string]interface{}, 0)
+	for _, pair := range pairs {
+		if pair.Flags != 0 {
+			return nil, ErrTreeFlags
+		}
+		value := string(pair.Value)
+		if !utf8.Valid(pair.Value) || strings.HasPrefix(value, treeBase64Prefix) {
+			value = treeBase64Prefix + base64.StdEncoding.EncodeToString(pair.Value)
+		}
+		names := strings.Split(pair.Key, "/")
+		parent := tree
+		for _, name := range names[:len(names)-1] {
+			child, found := parent[name]
+			if !found {
+				child = make(map[string]interface{}, 0)
+				parent[name] = child
+			}
+			directory, ok := child.(map[string]interface{})
+			if !ok {
+				return nil, ErrTreeConflict
+			}
+			parent = directory
+		}
+		name := names[len(names)-1]
+		if _, found := parent[name]; found {
+			return nil, ErrTreeConflict
+		}
+		parent[name] = value
+	}
+	return tree, nil
+}
+
+// Read the keys from an export
+//  content:	the export
+//  format:		the format of the export
+func decodeExport(content []byte, format ExportFormat) ([]*KeyPair, error) {
+	if format == FormatTree {
+		tree := make(map[string]interface{}, 0)
+		if err := json.Unmarshal(content, &tree); err != nil {
+			return nil, fmt.Errorf("unable to decode the tree, error: %s", err)
+		}
+		pairs := make([]*KeyPair, 0)
+		if err := decodeTree("", tree, &pairs); err != nil {
+			return nil, err
+		}
+		return pairs, nil
+	}
+	keys := make([]*ExportedKey, 0)
+	var err error
+	if format == FormatJSON {
+		err = json.Unmarshal(content, &keys)
+	} else {
+		err = yaml.Unmarshal(content, &keys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode the keys, error: %s", err)
+	}
+	pairs := make([]*KeyPair, 0, len(keys))
+	for _, key := range keys {
+		value := []byte(key.Value)
+		if key.Base64 {
+			if value, err = base64.StdEncoding.DecodeString(key.Value); err != nil {
+				return nil, fmt.Errorf("the value of %s is not valid base64, error: %s", key.Key, err)
+			}
+		}
+		pairs = append(pairs, &KeyPair{Key: key.Key, Flags: key.Flags, Value: value})
+	}
+	return pairs, nil
+}
+
+// Walk the tree, numbers and booleans are taken as their text
+//  path:		the path of the directory
+//  tree:		the directory
+//  pairs:		the keys found
+func decodeTree(path string, tree map[string]interface{}, pairs *[]*KeyPair) error {
+	for name, item := range tree {
+		key := path + name
+		switch value := item.(type) {
+		case map[string]interface{}:
+			if err := decodeTree(key+"/", value, pairs); err != nil {
+				return err
+			}
+		case string:
+			data := []byte(value)
+			if strings.HasPrefix(value, treeBase64Prefix) {
+				decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, treeBase64Prefix))
+				if err != nil {
+					return fmt.Errorf("the value of %s is not valid base64, error: %s", key, err)
+				}
+				data = decoded
+			}
+			*pairs = append(*pairs, &KeyPair{Key: key, Value: data})
+		case nil:
+			*pairs = append(*pairs, &KeyPair{Key: key, Value: []byte{}})
+		case []interface{}:
+			return fmt.Errorf("the value of %s is a list, which can't be held in a key", key)
+		default:
+			*pairs = append(*pairs, &KeyPair{Key: key, Value: []byte(fmt.Sprintf("%v", value))})
+		}
+	}
+	sort.Sort(byKeyPair(*pairs))
+	return nil
+}
+
+type byKeyPair []*KeyPair
+
+func (b byKeyPair) Len() int           { return len(b) }
+func (b byKeyPair) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byKeyPair) Less(i, j int) bool { return b[i].Key < b[j].Key }
@@ -0,0 +1,137 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newExportStore(t *testing.T) *MemoryDistroStore {
+	store := NewMemory()
+	t.Cleanup(func() { store.Close() })
+	store.casPair(&KeyPair{Key: "app/config/port", Value: []byte("8080"), Flags: 7}, 0)
+	store.casPair(&KeyPair{Key: "app/config/name", Value: []byte("service")}, 0)
+	store.casPair(&KeyPair{Key: "app/binary", Value: []byte{0xff, 0x00, 0x01}}, 0)
+	store.casPair(&KeyPair{Key: "app/dir/", Value: []byte{}}, 0)
+	store.casPair(&KeyPair{Key: "other", Value: []byte("excluded")}, 0)
+	return store
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []ExportFormat{FormatJSON, FormatYAML, FormatTree} {
+		source := newExportStore(t)
+		if format == FormatTree {
+			// step: the tree has nowhere to hold the flags
+			source.Set("app/config/port", "8080")
+		}
+		buffer := new(bytes.Buffer)
+		err := source.Export("app/", format, buffer)
+		if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+			continue
+		}
+		assert.NotContains(t, buffer.String(), "excluded", "the keys outside the prefix should not be exported")
+
+		target := NewMemory()
+		defer target.Close()
+		summary, err := target.Import(buffer, format, &ImportOptions{Prefix: "copy/"})
+		assert.Nil(t, err, "we should not recieve an error: %s", err)
+		assert.Equal(t, 4, len(summary.Added), "format %s should import every key", format)
+
+		pairs, _, _ := target.listPairs("copy/")
+		if assert.Equal(t, 4, len(pairs)) {
+			assert.Equal(t, "copy/app/binary", pairs[0].Key)
+			assert.Equal(t, []byte{0xff, 0x00, 0x01}, pairs[0].Value)
+			assert.Equal(t, "copy/app/config/port", pairs[2].Key)
+			assert.Equal(t, []byte("8080"), pairs[2].Value)
+			assert.Equal(t, "copy/app/dir/", pairs[3].Key)
+			if format != FormatTree {
+				assert.Equal(t, uint64(7), pairs[2].Flags)
+			}
+		}
+	}
+}
+
+func TestImportOptions(t *testing.T) {
+	store := newExportStore(t)
+	document := `[
+		{"key": "app/config/port", "value": "9090"},
+		{"key": "app/config/name", "value": "service"},
+		{"key": "app/new", "value": "added"}
+	]`
+	summary, err := store.Import(strings.NewReader(document), FormatJSON, &ImportOptions{DryRun: true, Overwrite: true})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, []string{"app/new"}, summary.Added)
+	assert.Equal(t, []string{"app/config/port"}, summary.Updated)
+	assert.Equal(t, []string{"app/config/name"}, summary.Unchanged)
+	found, _ := store.Exists("app/new")
+	assert.False(t, found, "a dry run should not make changes")
+	assert.Contains(t, summary.String(), "(dry run)")
+	assert.Contains(t, summary.String(), "+ app/new")
+
+	summary, err = store.Import(strings.NewReader(document), FormatJSON, nil)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, []string{"app/config/port"}, summary.Skipped)
+	value, _, _ := store.Get("app/config/port")
+	assert.Equal(t, "8080", value, "the key should not be overwritten")
+	value, _, _ = store.Get("app/new")
+	assert.Equal(t, "added", value)
+
+	// step: every key is checked before the first is written
+	duplicated := `[{"key": "app/first", "value": "1"}, {"key": "app/first", "value": "2"}]`
+	_, err = store.Import(strings.NewReader(duplicated), FormatJSON, nil)
+	assert.NotNil(t, err, "a duplicated key should be rejected")
+	found, _ = store.Exists("app/first")
+	assert.False(t, found, "a rejected import should not make changes")
+}
+
+func TestExportTree(t *testing.T) {
+	store := newExportStore(t)
+	assert.Equal(t, ErrTreeFlags, store.Export("app/config/", FormatTree, new(bytes.Buffer)),
+		"a key with flags should not be exported as a tree")
+	store.Set("app/config/port", "8080")
+	buffer := new(bytes.Buffer)
+	assert.Nil(t, store.Export("app/config/", FormatTree, buffer))
+	assert.Contains(t, buffer.String(), `"port": "8080"`)
+
+	// step: a key which is also a directory can't be placed in a tree
+	store.Set("app/config", "value")
+	assert.Equal(t, ErrTreeConflict, store.Export("app/", FormatTree, new(bytes.Buffer)))
+
+	// step: the numbers and text prefixed like an encoded value survive the tree
+	pairs, err := decodeExport([]byte(`{"a": {"b": 10, "c": true, "d": null}}`), FormatTree)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	if assert.Equal(t, 3, len(pairs)) {
+		assert.Equal(t, "a/b", pairs[0].Key)
+		assert.Equal(t, []byte("10"), pairs[0].Value)
+		assert.Equal(t, []byte("true"), pairs[1].Value)
+		assert.Equal(t, []byte{}, pairs[2].Value)
+	}
+	tree, err := encodeTree([]*KeyPair{{Key: "a", Value: []byte("base64:text")}})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.NotEqual(t, "base64:text", tree["a"])
+}
+
+func TestExportInvalidFormat(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	assert.Equal(t, ErrInvalidFormat, store.Export("", "xml", new(bytes.Buffer)))
+	_, err := store.Import(strings.NewReader("[]"), "xml", nil)
+	assert.Equal(t, ErrInvalidFormat, err)
+	_, err = store.Import(strings.NewReader("not json"), FormatJSON, nil)
+	assert.NotNil(t, err, "we should have recieved an error")
+}
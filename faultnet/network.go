@@ -0,0 +1,316 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package faultnet places proxies between embedded nodes on a single linux box,
+so the tests can partition, delay or drop the serf and server rpc traffic.
+
+Each node is given two loopback addresses: it binds to BindAddress(i) and
+advertises AdvertiseAddress(i), where the proxies listen on the same ports and
+forward to the node. Linux routes the whole of 127.0.0.0/8 to the loopback, so
+no setup is required; other platforms need the addresses aliased first.
+
+The proxies need to know which node the traffic is from:
+
+  - udp (serf gossip) is sent from the bind address of the node, so it is always attributed
+  - the raft rpcs carry the server address of the sender, which we look for in the first bytes
+  - anything else over tcp (serf push/pull, rpc forwarding) can't be attributed and is let
+    through, although any connection which can be attributed is cut when a partition is made
+
+Serf probes over udp, so a partition is seen by the membership; and raft is
+attributed, so a minority partition loses its leader.
+*/
+package faultnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// the most nodes we can give addresses to
+	MaxNodes = 98
+	// the time we wait on the first bytes of a tcp connection
+	DEFAULT_PEEK_TIMEOUT = (time.Duration(200) * time.Millisecond)
+	// the number of bytes we look through to attribute a tcp connection
+	DEFAULT_PEEK_SIZE = 1024
+)
+
+var (
+	// the node index is outside of the addresses we can give out
+	ErrInvalidNode = errors.New("The node index must be between zero and the maximum nodes")
+	// the node has already been added to the network
+	ErrNodeExists = errors.New("The node has already been added to the network")
+)
+
+// The address the node should bind to, the proxies forward the traffic here
+//
+//	i:			the index of the node
+func BindAddress(i int) string {
+	return fmt.Sprintf("127.0.0.%d", 100+i)
+}
+
+// The address the node should advertise, the proxies listen here
+//
+//	i:			the index of the node
+func AdvertiseAddress(i int) string {
+	return fmt.Sprintf("127.0.0.%d", i+2)
+}
+
+// The address and port of a node
+//
+//	address:	the address of the node
+//	port:		the port on the node
+func hostPort(address string, port int) string {
+	return net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+// the faults injected between the nodes
+type Network struct {
+	sync.RWMutex
+	// the group of each partitioned node
+	groups map[int]int
+	// the delay added to the traffic
+	delay time.Duration
+	// the chance of a udp packet being dropped
+	dropRate float64
+	// the source of the drops, seeded so the faults are reproducible
+	random *rand.Rand
+	// the proxies for each node
+	proxies map[int][]io.Closer
+	// the tcp links which have been attributed, cut on a partition
+	links map[*tcpLink]bool
+	// the bind address of each node, used to attribute the udp packets
+	nodes map[string]int
+	// the server address of each node, used to attribute the raft rpcs
+	servers map[int]string
+}
+
+// Create a network with no faults
+//
+//	seed:		the seed for the packet drops
+func New(seed int64) *Network {
+	return &Network{
+		groups:  make(map[int]int, 0),
+		random:  rand.New(rand.NewSource(seed)),
+		proxies: make(map[int][]io.Closer, 0),
+		links:   make(map[*tcpLink]bool, 0),
+		nodes:   make(map[string]int, 0),
+		servers: make(map[int]string, 0),
+	}
+}
+
+// Start the proxies for a node, before the node is started
+//
+//	i:			the index of the node
+//	serfPorts:	the serf lan and wan ports, proxied over udp and tcp
+//	serverPort:	the server rpc port, proxied over tcp
+func (n *Network) AddNode(i int, serfPorts []int, serverPort int) error {
+	if i < 0 || i >= MaxNodes {
+		return ErrInvalidNode
+	}
+	n.Lock()
+	if _, found := n.proxies[i]; found {
+		n.Unlock()
+		return ErrNodeExists
+	}
+	n.proxies[i] = make([]io.Closer, 0)
+	n.nodes[BindAddress(i)] = i
+	n.servers[i] = hostPort(AdvertiseAddress(i), serverPort)
+	n.Unlock()
+
+	for _, port := range serfPorts {
+		if err := n.startUDPProxy(i, port); err != nil {
+			n.removeNode(i)
+			return err
+		}
+		if err := n.startTCPProxy(i, port); err != nil {
+			n.removeNode(i)
+			return err
+		}
+	}
+	if err := n.startTCPProxy(i, serverPort); err != nil {
+		n.removeNode(i)
+		return err
+	}
+	return nil
+}
+
+// Partition the nodes into groups which can't talk to each other, the nodes
+// not in any group can still talk to everyone
+//
+//	groups:		the indexes of the nodes in each group
+func (n *Network) Partition(groups ...[]int) {
+	n.Lock()
+	n.groups = make(map[int]int, 0)
+	for group, nodes := range groups {
+		for _, node := range nodes {
+			n.groups[node] = group
+		}
+	}
+	cut := make([]*tcpLink, 0)
+	for link := range n.links {
+		if !n.allowedLocked(link.from, link.to) {
+			cut = append(cut, link)
+		}
+	}
+	n.Unlock()
+	for _, link := range cut {
+		link.close()
+	}
+}
+
+// Remove the partitions
+func (n *Network) Heal() {
+	n.Lock()
+	defer n.Unlock()
+	n.groups = make(map[int]int, 0)
+}
+
+// Delay all the traffic between the nodes
+//
+//	delay:		the delay to add, zero for none
+func (n *Network) SetDelay(delay time.Duration) {
+	n.Lock()
+	defer n.Unlock()
+	n.delay = delay
+}
+
+// Drop a share of the udp packets between the nodes
+//
+//	rate:		the chance of a packet being dropped, between zero and one
+func (n *Network) SetDropRate(rate float64) {
+	n.Lock()
+	defer n.Unlock()
+	n.dropRate = rate
+}
+
+// Stop the proxies and cut all the links
+func (n *Network) Close() {
+	n.Lock()
+	proxies := n.proxies
+	links := n.links
+	n.proxies = make(map[int][]io.Closer, 0)
+	n.links = make(map[*tcpLink]bool, 0)
+	n.Unlock()
+	for _, list := range proxies {
+		for _, proxy := range list {
+			proxy.Close()
+		}
+	}
+	for link := range links {
+		link.close()
+	}
+}
+
+func (n *Network) removeNode(i int) {
+	n.Lock()
+	list := n.proxies[i]
+	delete(n.proxies, i)
+	n.Unlock()
+	for _, proxy := range list {
+		proxy.Close()
+	}
+}
+
+func (n *Network) addProxy(i int, proxy io.Closer) {
+	n.Lock()
+	defer n.Unlock()
+	n.proxies[i] = append(n.proxies[i], proxy)
+}
+
+// Check if the traffic is allowed, an unknown node is always allowed
+//
+//	from:		the index of the sender, -1 if unknown
+//	to:			the index of the reciever
+func (n *Network) allowed(from, to int) bool {
+	n.RLock()
+	defer n.RUnlock()
+	return n.allowedLocked(from, to)
+}
+
+func (n *Network) allowedLocked(from, to int) bool {
+	if from < 0 || to < 0 {
+		return true
+	}
+	a, found := n.groups[from]
+	if !found {
+		return true
+	}
+	b, found := n.groups[to]
+	return !found || a == b
+}
+
+// Work out the delay for the traffic and whether a packet should be dropped
+//
+//	packet:		whether this is a udp packet, which can be dropped
+func (n *Network) fault(packet bool) (time.Duration, bool) {
+	n.Lock()
+	defer n.Unlock()
+	if packet && n.dropRate > 0 && n.random.Float64() < n.dropRate {
+		return 0, true
+	}
+	return n.delay, false
+}
+
+// Find the node a udp packet was sent from
+//
+//	address:	the source address of the packet
+func (n *Network) nodeOf(address *net.UDPAddr) int {
+	n.RLock()
+	defer n.RUnlock()
+	if i, found := n.nodes[address.IP.String()]; found {
+		return i
+	}
+	return -1
+}
+
+// Attribute a tcp connection from the first bytes, by the server address of the sender
+//
+//	data:		the first bytes of the connection
+//	to:			the node the connection is to
+func (n *Network) attribute(data []byte, to int) int {
+	n.RLock()
+	defer n.RUnlock()
+	from := -1
+	for i, address := range n.servers {
+		if i == to || !bytes.Contains(data, []byte(address)) {
+			continue
+		}
+		// step: more than one address means we can't tell
+		if from >= 0 {
+			return -1
+		}
+		from = i
+	}
+	return from
+}
+
+func (n *Network) addLink(link *tcpLink) {
+	n.Lock()
+	defer n.Unlock()
+	n.links[link] = true
+}
+
+func (n *Network) removeLink(link *tcpLink) {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.links, link)
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package faultnet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a pair of sockets standing in for the serf of two nodes
+func newTestNetwork(t *testing.T) (*Network, []*net.UDPConn, int) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(BindAddress(0))})
+	if err != nil {
+		t.Skipf("unable to bind the loopback addresses, error: %s", err)
+	}
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(BindAddress(1)), Port: port})
+	if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+		t.FailNow()
+	}
+	network := New(1)
+	for i := 0; i < 2; i++ {
+		err := network.AddNode(i, []int{port}, port+1)
+		if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+			t.FailNow()
+		}
+	}
+	t.Cleanup(func() {
+		network.Close()
+		listener.Close()
+		other.Close()
+	})
+	return network, []*net.UDPConn{listener, other}, port
+}
+
+func sendPacket(conn *net.UDPConn, to, port int, message string) {
+	conn.WriteToUDP([]byte(message), &net.UDPAddr{IP: net.ParseIP(AdvertiseAddress(to)), Port: port})
+}
+
+func recvPacket(conn *net.UDPConn, timeout time.Duration) (string, *net.UDPAddr) {
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	size, address, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		return "", nil
+	}
+	return string(buffer[:size]), address
+}
+
+func TestAddresses(t *testing.T) {
+	assert.Equal(t, "127.0.0.100", BindAddress(0))
+	assert.Equal(t, "127.0.0.2", AdvertiseAddress(0))
+	assert.Equal(t, ErrInvalidNode, New(1).AddNode(MaxNodes, nil, 0))
+}
+
+func TestAllowed(t *testing.T) {
+	network := New(1)
+	assert.True(t, network.allowed(0, 1))
+	network.Partition([]int{0}, []int{1, 2})
+	assert.False(t, network.allowed(0, 1))
+	assert.False(t, network.allowed(2, 0))
+	assert.True(t, network.allowed(1, 2))
+	assert.True(t, network.allowed(0, 3))
+	assert.True(t, network.allowed(-1, 0))
+	network.Heal()
+	assert.True(t, network.allowed(0, 1))
+}
+
+func TestAttribute(t *testing.T) {
+	network := New(1)
+	network.servers[0] = "127.0.0.2:8300"
+	network.servers[1] = "127.0.0.3:8300"
+	assert.Equal(t, 0, network.attribute([]byte("\x01leader127.0.0.2:8300"), 1))
+	assert.Equal(t, -1, network.attribute([]byte("\x01leader127.0.0.2:8300"), 0))
+	assert.Equal(t, -1, network.attribute([]byte("127.0.0.2:8300 127.0.0.3:8300"), 2))
+	assert.Equal(t, -1, network.attribute([]byte("nothing"), 1))
+}
+
+func TestUDPPartition(t *testing.T) {
+	network, nodes, port := newTestNetwork(t)
+
+	// step: the packet is forwarded and the reply comes back from the advertised address
+	sendPacket(nodes[0], 1, port, "ping")
+	message, address := recvPacket(nodes[1], time.Second)
+	if !assert.Equal(t, "ping", message) {
+		t.FailNow()
+	}
+	assert.Equal(t, AdvertiseAddress(0), address.IP.String())
+	nodes[1].WriteToUDP([]byte("ack"), address)
+	message, address = recvPacket(nodes[0], time.Second)
+	if !assert.Equal(t, "ack", message) {
+		t.FailNow()
+	}
+	assert.Equal(t, hostPort(AdvertiseAddress(1), port), address.String())
+
+	// step: nothing gets through the partition
+	network.Partition([]int{0}, []int{1})
+	sendPacket(nodes[0], 1, port, "ping")
+	message, _ = recvPacket(nodes[1], time.Duration(200)*time.Millisecond)
+	assert.Empty(t, message)
+
+	network.Heal()
+	sendPacket(nodes[0], 1, port, "ping")
+	message, _ = recvPacket(nodes[1], time.Second)
+	assert.Equal(t, "ping", message)
+}
+
+func TestUDPDelayAndDrop(t *testing.T) {
+	network, nodes, port := newTestNetwork(t)
+	network.SetDelay(time.Duration(300) * time.Millisecond)
+	sendPacket(nodes[0], 1, port, "ping")
+	message, _ := recvPacket(nodes[1], time.Duration(100)*time.Millisecond)
+	assert.Empty(t, message)
+	message, _ = recvPacket(nodes[1], time.Second)
+	assert.Equal(t, "ping", message)
+
+	network.SetDelay(0)
+	network.SetDropRate(1)
+	sendPacket(nodes[0], 1, port, "ping")
+	message, _ = recvPacket(nodes[1], time.Duration(200)*time.Millisecond)
+	assert.Empty(t, message)
+}
+
+func TestTCPPartition(t *testing.T) {
+	listener, err := net.Listen("tcp", BindAddress(1)+":0")
+	if err != nil {
+		t.Skipf("unable to bind the loopback addresses, error: %s", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	network := New(1)
+	defer network.Close()
+	assert.Nil(t, network.AddNode(0, nil, port))
+	assert.Nil(t, network.AddNode(1, nil, port))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					size, err := conn.Read(buffer)
+					if err != nil {
+						return
+					}
+					conn.Write(buffer[:size])
+				}
+			}()
+		}
+	}()
+
+	// step: a raft style rpc carrying the server address of node 0
+	conn, err := net.Dial("tcp", hostPort(AdvertiseAddress(1), port))
+	if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	request := "\x01leader" + hostPort(AdvertiseAddress(0), port)
+	conn.Write([]byte(request))
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	size, err := conn.Read(buffer)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, request, string(buffer[:size]))
+
+	// step: the partition cuts the connection
+	network.Partition([]int{0}, []int{1})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(buffer)
+	assert.NotNil(t, err, "the connection should have been cut")
+}
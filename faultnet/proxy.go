@@ -0,0 +1,277 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package faultnet
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// the size of the buffers used to copy the traffic
+const bufferSize = 65536
+
+// a udp proxy in front of a node; the packets from each sender are forwarded
+// from a socket on the advertised address of the sender, so the replies of
+// the node come back to us and can be faulted in the other direction
+type udpProxy struct {
+	sync.Mutex
+	// the network the proxy belongs to
+	network *Network
+	// the node the proxy is in front of
+	to int
+	// the socket on the advertised address of the node
+	listener *net.UDPConn
+	// the bind address of the node
+	target *net.UDPAddr
+	// the socket forwarding for each sender
+	upstreams map[string]*net.UDPConn
+}
+
+func (n *Network) startUDPProxy(i, port int) error {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(AdvertiseAddress(i)), Port: port})
+	if err != nil {
+		return err
+	}
+	proxy := &udpProxy{
+		network:   n,
+		to:        i,
+		listener:  listener,
+		target:    &net.UDPAddr{IP: net.ParseIP(BindAddress(i)), Port: port},
+		upstreams: make(map[string]*net.UDPConn, 0),
+	}
+	n.addProxy(i, proxy)
+	go proxy.run()
+
+	return nil
+}
+
+func (p *udpProxy) run() {
+	buffer := make([]byte, bufferSize)
+	for {
+		size, source, err := p.listener.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		from := p.network.nodeOf(source)
+		upstream, err := p.upstream(from, source)
+		if err != nil {
+			continue
+		}
+		p.send(from, p.to, upstream, p.target, copyBytes(buffer[:size]))
+	}
+}
+
+// Forward a packet, applying the partition, drops and delay
+//
+//	from:		the index of the sender
+//	to:			the index of the reciever
+//	conn:		the socket to send from
+//	address:	the address to send to
+//	packet:		the packet to send
+func (p *udpProxy) send(from, to int, conn *net.UDPConn, address *net.UDPAddr, packet []byte) {
+	if !p.network.allowed(from, to) {
+		return
+	}
+	delay, drop := p.network.fault(true)
+	if drop {
+		return
+	}
+	if delay <= 0 {
+		conn.WriteToUDP(packet, address)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		conn.WriteToUDP(packet, address)
+	})
+}
+
+// Get or create the socket forwarding for a sender
+//
+//	from:		the index of the sender, -1 if unknown
+//	source:		the address of the sender
+func (p *udpProxy) upstream(from int, source *net.UDPAddr) (*net.UDPConn, error) {
+	p.Lock()
+	defer p.Unlock()
+	if conn, found := p.upstreams[source.String()]; found {
+		return conn, nil
+	}
+	address := "127.0.0.1"
+	if from >= 0 {
+		address = AdvertiseAddress(from)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(address)})
+	if err != nil {
+		return nil, err
+	}
+	p.upstreams[source.String()] = conn
+	// step: relay the replies of the node back to the sender
+	go func() {
+		buffer := make([]byte, bufferSize)
+		for {
+			size, _, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			p.send(p.to, from, p.listener, source, copyBytes(buffer[:size]))
+		}
+	}()
+
+	return conn, nil
+}
+
+func (p *udpProxy) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	for _, conn := range p.upstreams {
+		conn.Close()
+	}
+	return p.listener.Close()
+}
+
+// a tcp proxy in front of a node
+type tcpProxy struct {
+	// the network the proxy belongs to
+	network *Network
+	// the node the proxy is in front of
+	to int
+	// the listener on the advertised address of the node
+	listener net.Listener
+	// the bind address of the node
+	target string
+}
+
+func (n *Network) startTCPProxy(i, port int) error {
+	listener, err := net.Listen("tcp", hostPort(AdvertiseAddress(i), port))
+	if err != nil {
+		return err
+	}
+	proxy := &tcpProxy{
+		network:  n,
+		to:       i,
+		listener: listener,
+		target:   hostPort(BindAddress(i), port),
+	}
+	n.addProxy(i, proxy)
+	go proxy.run()
+
+	return nil
+}
+
+func (p *tcpProxy) run() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *tcpProxy) handle(conn net.Conn) {
+	// step: peek at the first bytes to work out who the connection is from
+	buffer := make([]byte, DEFAULT_PEEK_SIZE)
+	conn.SetReadDeadline(time.Now().Add(DEFAULT_PEEK_TIMEOUT))
+	size, err := conn.Read(buffer)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && size == 0 {
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			conn.Close()
+			return
+		}
+	}
+	from := p.network.attribute(buffer[:size], p.to)
+	if !p.network.allowed(from, p.to) {
+		conn.Close()
+		return
+	}
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	link := &tcpLink{from: from, to: p.to, client: conn, upstream: upstream}
+	if from >= 0 {
+		p.network.addLink(link)
+	}
+	if size > 0 {
+		if _, err := upstream.Write(buffer[:size]); err != nil {
+			link.close()
+			return
+		}
+	}
+	go p.network.pipe(link, conn, upstream, from, p.to)
+	go p.network.pipe(link, upstream, conn, p.to, from)
+}
+
+func (p *tcpProxy) Close() error {
+	return p.listener.Close()
+}
+
+// a proxied tcp connection
+type tcpLink struct {
+	// the node the connection is from, -1 if unknown
+	from int
+	// the node the connection is to
+	to int
+	// the connection from the sender
+	client net.Conn
+	// the connection to the node
+	upstream net.Conn
+	// ensures we close once
+	once sync.Once
+}
+
+func (l *tcpLink) close() {
+	l.once.Do(func() {
+		l.client.Close()
+		l.upstream.Close()
+	})
+}
+
+// Copy the traffic one way over a link, applying the partition and delay
+//
+//	link:		the link being copied
+//	src:		the connection to read from
+//	dst:		the connection to write to
+//	from:		the index of the sender
+//	to:			the index of the reciever
+func (n *Network) pipe(link *tcpLink, src, dst net.Conn, from, to int) {
+	defer func() {
+		link.close()
+		n.removeLink(link)
+	}()
+	buffer := make([]byte, bufferSize)
+	for {
+		size, err := src.Read(buffer)
+		if err != nil {
+			return
+		}
+		if !n.allowed(from, to) {
+			return
+		}
+		if delay, _ := n.fault(false); delay > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := dst.Write(buffer[:size]); err != nil {
+			return
+		}
+	}
+}
+
+func copyBytes(data []byte) []byte {
+	item := make([]byte, len(data))
+	copy(item, data)
+	return item
+}
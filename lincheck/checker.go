@@ -0,0 +1,322 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package lincheck records histories of concurrent operations against a store and
+checks they are linearizable, in the style of Porcupine: the history is split
+into independent parts (one per key), and each part is searched for an order of
+the operations which is allowed by a sequential model and which respects their
+real time order, using the algorithm of Wing & Gong with the memoization of Lowe.
+*/
+package lincheck
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// an operation in the history
+type Operation struct {
+	// the client which made the operation
+	ClientID int
+	// the input to the operation
+	Input interface{}
+	// the output of the operation
+	Output interface{}
+	// the time the operation was called, in nanoseconds
+	Call int64
+	// the time the operation returned, in nanoseconds; an operation which
+	// failed may or may not have taken effect and is given math.MaxInt64
+	Return int64
+}
+
+// a sequential specification of the store
+type Model struct {
+	// split the history into parts which can be checked independently, can be nil
+	Partition func(history []Operation) [][]Operation
+	// the initial state of the model
+	Init func() interface{}
+	// apply an operation to the state, returning false if the output is not allowed
+	Step func(state, input, output interface{}) (bool, interface{})
+	// compare two states, the states are compared with == when nil
+	Equal func(a, b interface{}) bool
+	// describe an operation for the report, can be nil
+	Describe func(input, output interface{}) string
+}
+
+// a part of the history which is not linearizable
+type Anomaly struct {
+	// the operations in the part of the history
+	Operations []Operation
+	// the longest sequence of operations which could be linearized
+	Linearized []Operation
+	// the check gave up before the part was decided
+	TimedOut bool
+}
+
+// Describe the anomaly for the report
+//  model:		the model used for the check
+func (a *Anomaly) Describe(model Model) string {
+	describe := model.Describe
+	if describe == nil {
+		describe = func(input, output interface{}) string {
+			return fmt.Sprintf("%v -> %v", input, output)
+		}
+	}
+	message := fmt.Sprintf("the history of %d operations is not linearizable", len(a.Operations))
+	if a.TimedOut {
+		message = fmt.Sprintf("the check of %d operations timed out", len(a.Operations))
+	}
+	message += fmt.Sprintf(", the longest linearizable prefix (%d operations):", len(a.Linearized))
+	for _, op := range a.Linearized {
+		message += fmt.Sprintf("\n  client %d: %s", op.ClientID, describe(op.Input, op.Output))
+	}
+	message += "\nthe operations in the part of the history:"
+	for _, op := range a.Operations {
+		returned := "never"
+		if op.Return != math.MaxInt64 {
+			returned = fmt.Sprintf("%d", op.Return)
+		}
+		message += fmt.Sprintf("\n  client %d [%d, %s]: %s", op.ClientID, op.Call, returned, describe(op.Input, op.Output))
+	}
+	return message
+}
+
+// Check a history against the model
+//  model:		the sequential specification
+//  history:	the operations which were made
+//  timeout:	the time we spend on each part of the history, zero for no limit
+func Check(model Model, history []Operation, timeout time.Duration) []*Anomaly {
+	parts := [][]Operation{history}
+	if model.Partition != nil {
+		parts = model.Partition(history)
+	}
+	anomalies := make([]*Anomaly, 0)
+	for _, part := range parts {
+		if anomaly := checkPart(model, part, timeout); anomaly != nil {
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	return anomalies
+}
+
+// an entry in the list of calls and returns
+type entry struct {
+	// the index of the operation
+	id int
+	// whether this is the call of the operation
+	call bool
+	// the time of the entry
+	time int64
+	// the return entry of a call
+	match *entry
+	prev  *entry
+	next  *entry
+}
+
+// a linearized call on the stack
+type frame struct {
+	entry *entry
+	state interface{}
+}
+
+// a state we have already searched from
+type cached struct {
+	linearized bitset
+	state      interface{}
+}
+
+func checkPart(model Model, history []Operation, timeout time.Duration) *Anomaly {
+	equal := model.Equal
+	if equal == nil {
+		equal = func(a, b interface{}) bool { return a == b }
+	}
+	head := makeEntries(history)
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	state := model.Init()
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]cached, 0)
+	calls := make([]frame, 0)
+	longest := make([]int, 0)
+
+	current := head.next
+	for steps := 0; head.next != nil; steps++ {
+		// step: check the clock every so often
+		if timeout > 0 && steps%1024 == 0 && time.Now().After(deadline) {
+			return newAnomaly(history, longest, true)
+		}
+		if current.call {
+			op := history[current.id]
+			ok, next := model.Step(state, op.Input, op.Output)
+			if ok {
+				candidate := linearized.clone().set(current.id)
+				hash := candidate.hash()
+				seen := false
+				for _, item := range cache[hash] {
+					if item.linearized.equals(candidate) && equal(item.state, next) {
+						seen = true
+						break
+					}
+				}
+				if !seen {
+					cache[hash] = append(cache[hash], cached{linearized: candidate, state: next})
+					calls = append(calls, frame{entry: current, state: state})
+					if len(calls) > len(longest) {
+						longest = stackIDs(calls)
+					}
+					state = next
+					linearized.set(current.id)
+					lift(current)
+					current = head.next
+					continue
+				}
+			}
+			current = current.next
+			continue
+		}
+		// step: we hit a return before its call could be linearized, backtrack
+		if len(calls) == 0 {
+			return newAnomaly(history, longest, false)
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		state = top.state
+		linearized.clear(top.entry.id)
+		unlift(top.entry)
+		current = top.entry.next
+	}
+	return nil
+}
+
+func newAnomaly(history []Operation, longest []int, timedOut bool) *Anomaly {
+	anomaly := &Anomaly{
+		Operations: history,
+		Linearized: make([]Operation, 0, len(longest)),
+		TimedOut:   timedOut,
+	}
+	for _, id := range longest {
+		anomaly.Linearized = append(anomaly.Linearized, history[id])
+	}
+	return anomaly
+}
+
+func stackIDs(calls []frame) []int {
+	list := make([]int, 0, len(calls))
+	for _, item := range calls {
+		list = append(list, item.entry.id)
+	}
+	return list
+}
+
+// Build the list of calls and returns ordered by time, a call at the same
+// time as a return is placed after it, so the operations are not concurrent
+//  history:	the operations
+func makeEntries(history []Operation) *entry {
+	entries := make([]*entry, 0, len(history)*2)
+	for i, op := range history {
+		call := &entry{id: i, call: true, time: op.Call}
+		ret := &entry{id: i, time: op.Return}
+		call.match = ret
+		entries = append(entries, call, ret)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		if entries[i].id == entries[j].id {
+			return entries[i].call
+		}
+		return !entries[i].call && entries[j].call
+	})
+	head := &entry{id: -1}
+	last := head
+	for _, item := range entries {
+		last.next = item
+		item.prev = last
+		last = item
+	}
+	return head
+}
+
+// Remove a call and its return from the list
+func lift(call *entry) {
+	call.prev.next = call.next
+	if call.next != nil {
+		call.next.prev = call.prev
+	}
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// Put a call and its return back into the list
+func unlift(call *entry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	if call.next != nil {
+		call.next.prev = call
+	}
+}
+
+// a set of the linearized operations
+type bitset []uint64
+
+func newBitset(size int) bitset {
+	return make(bitset, (size+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	item := make(bitset, len(b))
+	copy(item, b)
+	return item
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) equals(other bitset) bool {
+	for i := range b {
+		if b[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	hash := uint64(14695981039346656037)
+	for _, word := range b {
+		hash ^= word
+		hash *= 1099511628211
+	}
+	return hash
+}
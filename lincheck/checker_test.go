@@ -0,0 +1,140 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lincheck
+
+import (
+	"math"
+	"testing"
+
+	ds "github.com/gambol99/distrostore"
+	"github.com/gambol99/distrostore/testcluster"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(client int, key, value string, found bool, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KVInput{Kind: OpGet, Key: key},
+		Output: KVOutput{Value: value, Found: found}, Call: call, Return: ret}
+}
+
+func set(client int, key, value string, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KVInput{Kind: OpSet, Key: key, Value: value},
+		Output: KVOutput{}, Call: call, Return: ret}
+}
+
+func index(client int, key string, index uint64, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KVInput{Kind: OpGetIndex, Key: key},
+		Output: KVOutput{Index: index, Found: true}, Call: call, Return: ret}
+}
+
+func cas(client int, key, value string, index uint64, swapped bool, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KVInput{Kind: OpCAS, Key: key, Value: value, Index: index},
+		Output: KVOutput{Swapped: swapped}, Call: call, Return: ret}
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	history := []Operation{
+		set(0, "a", "1", 0, 10),
+		// step: concurrent with the set, so either value is fine
+		get(1, "a", "", false, 5, 15),
+		set(1, "a", "2", 20, 30),
+		get(0, "a", "2", true, 25, 35),
+		get(0, "b", "", false, 0, 5),
+	}
+	assert.Empty(t, Check(KVModel, history, 0))
+}
+
+func TestCheckStaleRead(t *testing.T) {
+	history := []Operation{
+		set(0, "a", "1", 0, 10),
+		set(0, "a", "2", 20, 30),
+		// step: a read after the second write has returned sees the first
+		get(1, "a", "1", true, 40, 50),
+	}
+	anomalies := Check(KVModel, history, 0)
+	if assert.Equal(t, 1, len(anomalies)) {
+		assert.False(t, anomalies[0].TimedOut)
+		assert.Equal(t, 2, len(anomalies[0].Linearized))
+		assert.Contains(t, anomalies[0].Describe(KVModel), `get(a) -> "1"`)
+	}
+}
+
+func TestCheckCompareAndSet(t *testing.T) {
+	history := []Operation{
+		cas(0, "a", "1", 0, true, 0, 10),
+		index(0, "a", 5, 20, 30),
+		index(1, "a", 5, 20, 30),
+		cas(0, "a", "2", 5, true, 40, 50),
+		cas(1, "a", "3", 5, false, 40, 50),
+		get(1, "a", "2", true, 60, 70),
+	}
+	assert.Empty(t, Check(KVModel, history, 0))
+
+	// step: two cas against the same index can't both succeed
+	history[4] = cas(1, "a", "3", 5, true, 40, 50)
+	assert.Equal(t, 1, len(Check(KVModel, history, 0)))
+}
+
+func TestCheckIndexesIncrease(t *testing.T) {
+	history := []Operation{
+		set(0, "a", "1", 0, 10),
+		index(0, "a", 5, 20, 30),
+		set(0, "a", "2", 40, 50),
+		index(0, "a", 4, 60, 70),
+	}
+	assert.Equal(t, 1, len(Check(KVModel, history, 0)))
+}
+
+func TestCheckUnknownWrite(t *testing.T) {
+	history := []Operation{
+		set(0, "a", "1", 0, 10),
+		{ClientID: 1, Input: KVInput{Kind: OpSet, Key: "a", Value: "2"}, Output: KVOutput{Unknown: true}, Call: 20, Return: math.MaxInt64},
+		get(0, "a", "1", true, 30, 40),
+		get(0, "a", "2", true, 50, 60),
+	}
+	assert.Empty(t, Check(KVModel, history, 0))
+
+	// step: once the write has been seen it can't be undone
+	history = append(history, get(0, "a", "1", true, 70, 80))
+	assert.Equal(t, 1, len(Check(KVModel, history, 0)))
+}
+
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder()
+	recorder.Record(0, KVInput{Kind: OpSet, Key: "a", Value: "1"}, func() (KVOutput, error) {
+		return KVOutput{}, nil
+	})
+	recorder.Record(0, KVInput{Kind: OpGet, Key: "a"}, func() (KVOutput, error) {
+		return KVOutput{}, ds.ErrStoreClosed
+	})
+	recorder.Record(0, KVInput{Kind: OpSet, Key: "a", Value: "2"}, func() (KVOutput, error) {
+		return KVOutput{}, ds.ErrStoreClosed
+	})
+	history := recorder.History()
+	if assert.Equal(t, 2, len(history), "the failed read should have been dropped") {
+		assert.True(t, history[1].Output.(KVOutput).Unknown)
+		assert.Equal(t, int64(math.MaxInt64), history[1].Return)
+	}
+}
+
+func TestConsulLinearizable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the linearizability run in short mode")
+	}
+	cluster := testcluster.New(t, 3, &testcluster.Options{
+		Configure: func(index int, cfg *ds.Context) {
+			cfg.ConsistentReads = true
+		},
+	})
+	Run(t, cluster, nil)
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lincheck
+
+import "fmt"
+
+// the kind of operation on a key
+type OpKind int
+
+const (
+	// a Get of the key
+	OpGet OpKind = iota
+	// a Set of the key
+	OpSet
+	// a GetIndex of the key
+	OpGetIndex
+	// a CompareAndSet of the key
+	OpCAS
+)
+
+func (o OpKind) String() string {
+	switch o {
+	case OpGet:
+		return "get"
+	case OpSet:
+		return "set"
+	case OpGetIndex:
+		return "index"
+	case OpCAS:
+		return "cas"
+	}
+	return "unknown"
+}
+
+// the input to an operation on the store
+type KVInput struct {
+	// the kind of operation
+	Kind OpKind
+	// the key the operation is on
+	Key string
+	// the value being set
+	Value string
+	// the index the cas is made against
+	Index uint64
+}
+
+// the output of an operation on the store
+type KVOutput struct {
+	// the value of the key, for gets
+	Value string
+	// whether the key was found, for gets and indexes
+	Found bool
+	// the modify index of the key, for indexes
+	Index uint64
+	// whether the cas was made
+	Swapped bool
+	// the operation failed, so it may or may not have taken effect
+	Unknown bool
+}
+
+// the state of a key in the model; the modify indexes are chosen by the store,
+// so the index of a write is unknown until it is read or used by a cas, after
+// which it is bound and must be seen by the following operations
+type kvState struct {
+	// the value of the key
+	value string
+	// whether the key exists
+	exists bool
+	// the modify index of the value, zero when unknown
+	index uint64
+	// the highest index bound so far, the next write must be above it
+	last uint64
+}
+
+// The model of the key/value store, a register per key with the modify index
+// used for CompareAndSet; the history is checked key by key
+var KVModel = Model{
+	Partition: partitionByKey,
+	Init: func() interface{} {
+		return kvState{}
+	},
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		return stepKV(state.(kvState), input.(KVInput), output.(KVOutput))
+	},
+	Describe: func(input, output interface{}) string {
+		return describeKV(input.(KVInput), output.(KVOutput))
+	},
+}
+
+func stepKV(state kvState, in KVInput, out KVOutput) (bool, interface{}) {
+	switch in.Kind {
+	case OpGet:
+		if out.Found != state.exists {
+			return false, state
+		}
+		return !out.Found || out.Value == state.value, state
+	case OpGetIndex:
+		if out.Found != state.exists {
+			return false, state
+		}
+		if !out.Found {
+			return true, state
+		}
+		return state.bind(out.Index)
+	case OpSet:
+		return true, state.write(in.Value, 0)
+	case OpCAS:
+		matched, next := state.matches(in.Index)
+		if out.Unknown {
+			// step: a failed cas is made if it could have been, else it's a noop
+			if matched {
+				return true, next.write(in.Value, in.Index)
+			}
+			return true, state
+		}
+		if out.Swapped {
+			if !matched {
+				return false, state
+			}
+			return true, next.write(in.Value, in.Index)
+		}
+		// step: the cas was refused, which is only allowed if the index could differ
+		if in.Index == 0 {
+			return state.exists, state
+		}
+		return !state.exists || state.index != in.Index, state
+	}
+	return false, state
+}
+
+// Bind the index of the current value, or check it against the one bound
+//  index:		the index which was read
+func (s kvState) bind(index uint64) (bool, interface{}) {
+	if s.index != 0 {
+		return s.index == index, s
+	}
+	if index <= s.last {
+		return false, s
+	}
+	s.index = index
+	s.last = index
+	return true, s
+}
+
+// Check a cas against the index would be made, binding the index if required
+//  index:		the index of the cas, zero only if the key does not exist
+func (s kvState) matches(index uint64) (bool, kvState) {
+	if index == 0 {
+		return !s.exists, s
+	}
+	if !s.exists {
+		return false, s
+	}
+	ok, next := s.bind(index)
+	return ok, next.(kvState)
+}
+
+// Write a new value, whose index is unknown
+//  value:		the value written
+//  index:		an index used by the write, raising the floor for the next
+func (s kvState) write(value string, index uint64) kvState {
+	if index > s.last {
+		s.last = index
+	}
+	s.value = value
+	s.exists = true
+	s.index = 0
+	return s
+}
+
+func partitionByKey(history []Operation) [][]Operation {
+	keys := make(map[string]int, 0)
+	parts := make([][]Operation, 0)
+	for _, op := range history {
+		key := op.Input.(KVInput).Key
+		i, found := keys[key]
+		if !found {
+			i = len(parts)
+			keys[key] = i
+			parts = append(parts, make([]Operation, 0))
+		}
+		parts[i] = append(parts[i], op)
+	}
+	return parts
+}
+
+func describeKV(in KVInput, out KVOutput) string {
+	result := ""
+	switch {
+	case out.Unknown:
+		result = "unknown"
+	case in.Kind == OpGet && out.Found:
+		result = fmt.Sprintf("%q", out.Value)
+	case in.Kind == OpGetIndex && out.Found:
+		result = fmt.Sprintf("%d", out.Index)
+	case in.Kind == OpGet, in.Kind == OpGetIndex:
+		result = "not found"
+	case in.Kind == OpCAS:
+		result = fmt.Sprintf("%t", out.Swapped)
+	default:
+		result = "ok"
+	}
+	switch in.Kind {
+	case OpSet:
+		return fmt.Sprintf("set(%s, %q) -> %s", in.Key, in.Value, result)
+	case OpCAS:
+		return fmt.Sprintf("cas(%s, %q, %d) -> %s", in.Key, in.Value, in.Index, result)
+	}
+	return fmt.Sprintf("%s(%s) -> %s", in.Kind, in.Key, result)
+}
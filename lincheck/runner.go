@@ -0,0 +1,236 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lincheck
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/gambol99/distrostore"
+	"github.com/gambol99/distrostore/testcluster"
+)
+
+const (
+	// the default number of concurrent clients
+	DEFAULT_CLIENTS = 6
+	// the default number of keys the clients work on
+	DEFAULT_KEYS = 3
+	// the default time the clients run for
+	DEFAULT_DURATION = (time.Duration(30) * time.Second)
+	// the default time between killing and restarting the nodes
+	DEFAULT_KILL_INTERVAL = (time.Duration(5) * time.Second)
+	// the default time we spend checking each key
+	DEFAULT_CHECK_TIMEOUT = (time.Duration(60) * time.Second)
+	// the time a client waits after an error before moving to another node
+	clientBackoff = (time.Duration(50) * time.Millisecond)
+)
+
+// the options for a run
+type Options struct {
+	// the number of concurrent clients, zero uses the default
+	Clients int
+	// the number of keys the clients work on, zero uses the default
+	Keys int
+	// the time the clients run for, zero uses the default
+	Duration time.Duration
+	// the time between killing and restarting a node, zero uses the default
+	// and a negative interval never kills the nodes
+	KillInterval time.Duration
+	// the time we spend checking each key, zero uses the default
+	CheckTimeout time.Duration
+	// the seed for the operations and the nodes killed
+	Seed int64
+}
+
+// records the operations made by the clients
+type Recorder struct {
+	sync.Mutex
+	// the time the recording started
+	start time.Time
+	// the operations made
+	history []Operation
+}
+
+// Create a recorder
+func NewRecorder() *Recorder {
+	return &Recorder{
+		start:   time.Now(),
+		history: make([]Operation, 0),
+	}
+}
+
+// Make and record an operation; a failed read is dropped as it has no effect,
+// while a failed write may or may not have been made and is left open
+//  client:		the id of the client
+//  input:		the operation being made
+//  call:		makes the operation
+func (r *Recorder) Record(client int, input KVInput, call func() (KVOutput, error)) (KVOutput, error) {
+	called := time.Since(r.start).Nanoseconds()
+	output, err := call()
+	returned := time.Since(r.start).Nanoseconds()
+	if err != nil {
+		if input.Kind == OpGet || input.Kind == OpGetIndex {
+			return output, err
+		}
+		output = KVOutput{Unknown: true}
+		returned = math.MaxInt64
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.history = append(r.history, Operation{
+		ClientID: client,
+		Input:    input,
+		Output:   output,
+		Call:     called,
+		Return:   returned,
+	})
+	return output, err
+}
+
+// The operations recorded so far
+func (r *Recorder) History() []Operation {
+	r.Lock()
+	defer r.Unlock()
+	history := make([]Operation, len(r.history))
+	copy(history, r.history)
+	return history
+}
+
+// Run concurrent clients against the cluster while killing and restarting the
+// nodes, one at a time, then check the history is linearizable; the anomalies
+// found are reported as errors on the test and returned
+//  t:			the test being run
+//  cluster:	the cluster to run against
+//  options:	the options for the run, can be nil
+func Run(t testing.TB, cluster *testcluster.Cluster, options *Options) []*Anomaly {
+	if options == nil {
+		options = &Options{}
+	}
+	if options.Clients <= 0 {
+		options.Clients = DEFAULT_CLIENTS
+	}
+	if options.Keys <= 0 {
+		options.Keys = DEFAULT_KEYS
+	}
+	if options.Duration <= 0 {
+		options.Duration = DEFAULT_DURATION
+	}
+	if options.KillInterval == 0 {
+		options.KillInterval = DEFAULT_KILL_INTERVAL
+	}
+	if options.CheckTimeout <= 0 {
+		options.CheckTimeout = DEFAULT_CHECK_TIMEOUT
+	}
+	recorder := NewRecorder()
+	stopChannel := make(chan struct{})
+	wait := &sync.WaitGroup{}
+	for i := 0; i < options.Clients; i++ {
+		wait.Add(1)
+		go func(client int) {
+			defer wait.Done()
+			runClient(client, cluster, recorder, options, stopChannel)
+		}(i)
+	}
+
+	// step: the nodes are killed from the test goroutine, as the cluster fails the test on errors
+	random := rand.New(rand.NewSource(options.Seed))
+	deadline := time.Now().Add(options.Duration)
+	for time.Now().Before(deadline) {
+		if options.KillInterval < 0 {
+			time.Sleep(time.Until(deadline))
+			break
+		}
+		time.Sleep(options.KillInterval)
+		node := random.Intn(cluster.Size())
+		t.Logf("killing node %d", node)
+		cluster.Kill(node)
+		time.Sleep(options.KillInterval)
+		t.Logf("restarting node %d", node)
+		cluster.Restart(node)
+	}
+	close(stopChannel)
+	wait.Wait()
+
+	history := recorder.History()
+	t.Logf("checking a history of %d operations", len(history))
+	anomalies := Check(KVModel, history, options.CheckTimeout)
+	for _, anomaly := range anomalies {
+		t.Error(anomaly.Describe(KVModel))
+	}
+	return anomalies
+}
+
+// Make random operations against the nodes until stopped, moving to another
+// node when an operation fails
+//  client:		the id of the client
+//  cluster:	the cluster to run against
+//  recorder:	records the operations
+//  options:	the options for the run
+//  stopChannel: closed to stop the client
+func runClient(client int, cluster *testcluster.Cluster, recorder *Recorder, options *Options, stopChannel chan struct{}) {
+	random := rand.New(rand.NewSource(options.Seed + int64(client) + 1))
+	node := client % cluster.Size()
+	for sequence := 0; ; sequence++ {
+		select {
+		case <-stopChannel:
+			return
+		default:
+		}
+		store := cluster.Store(node)
+		if store == nil {
+			node = (node + 1) % cluster.Size()
+			continue
+		}
+		key := fmt.Sprintf("lincheck/%d", random.Intn(options.Keys))
+		value := fmt.Sprintf("%d-%d", client, sequence)
+		var err error
+		switch choice := random.Intn(10); {
+		case choice < 4:
+			_, err = recorder.Record(client, KVInput{Kind: OpGet, Key: key}, func() (KVOutput, error) {
+				current, found, err := store.Get(key)
+				return KVOutput{Value: current, Found: found}, err
+			})
+		case choice < 7:
+			_, err = recorder.Record(client, KVInput{Kind: OpSet, Key: key, Value: value}, func() (KVOutput, error) {
+				return KVOutput{}, store.Set(key, value)
+			})
+		default:
+			err = compareAndSet(client, store, recorder, key, value)
+		}
+		if err != nil {
+			time.Sleep(clientBackoff)
+			node = (node + 1) % cluster.Size()
+		}
+	}
+}
+
+// Read the index of the key and make a cas against it
+func compareAndSet(client int, store ds.DistroStore, recorder *Recorder, key, value string) error {
+	read, err := recorder.Record(client, KVInput{Kind: OpGetIndex, Key: key}, func() (KVOutput, error) {
+		index, found, err := store.GetIndex(key)
+		return KVOutput{Index: index, Found: found}, err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = recorder.Record(client, KVInput{Kind: OpCAS, Key: key, Value: value, Index: read.Index}, func() (KVOutput, error) {
+		swapped, err := store.CompareAndSet(key, value, read.Index)
+		return KVOutput{Swapped: swapped}, err
+	})
+	return err
+}
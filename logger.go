@@ -0,0 +1,195 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the default lowest level of the logs written
+	DEFAULT_LOG_LEVEL = "INFO"
+	// the subsystem of the records logged by the store itself
+	storeSubsystem = "distrostore"
+	// the format of the time at the start of the consul log lines
+	logTimeFormat = "2006/01/02 15:04:05"
+)
+
+var (
+	// the log level is not one consul writes
+	ErrInvalidLogLevel = errors.New("The log level must be one of TRACE, DEBUG, INFO, WARN or ERR")
+)
+
+// the levels of the consul logs, lowest first
+var logLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERR"}
+
+// the level of a log record
+type LogLevel int
+
+const (
+	LogTrace LogLevel = iota
+	LogDebug
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	if l < LogTrace || l > LogError {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return logLevels[l]
+}
+
+// A leveled, structured logger for the records of the store and the embedded
+// consul. The attributes are alternating keys and values, every record carries
+// a "subsystem" i.e. raft, serf, memberlist, agent or distrostore
+type Logger interface {
+	// Log a record
+	//  level:		the level of the record
+	//  message:	the message, without the subsystem
+	//  attrs:		the attributes, alternating keys and values
+	Log(level LogLevel, message string, attrs ...interface{})
+}
+
+// Find the position of the level, an empty level is the default
+//  level:		the name of the level, in any case
+func logLevelIndex(level string) (int, error) {
+	if level == "" {
+		level = DEFAULT_LOG_LEVEL
+	}
+	for index, name := range logLevels {
+		if strings.EqualFold(name, level) {
+			return index, nil
+		}
+	}
+	return 0, ErrInvalidLogLevel
+}
+
+// Parse a consul log line of the form "2015/03/16 14:28:12 [INFO] raft: msg"
+// into the level, subsystem and message; a line without a level is info and
+// one without a subsystem is from the agent
+//  line:		the log line
+func parseLogLine(line []byte) (LogLevel, string, string) {
+	level, text := LogInfo, strings.TrimSpace(string(line))
+	if start := strings.IndexByte(text, '['); start >= 0 {
+		if end := strings.IndexByte(text[start:], ']'); end > 0 {
+			if index, err := logLevelIndex(text[start+1 : start+end]); err == nil {
+				level, text = LogLevel(index), strings.TrimSpace(text[start+end+1:])
+			}
+		}
+	}
+	// step: the subsystem is a single word ahead of the first colon
+	if colon := strings.Index(text, ": "); colon > 0 && !strings.ContainsAny(text[:colon], " \t") {
+		return level, text[:colon], text[colon+2:]
+	}
+	return level, "agent", text
+}
+
+// filters the log lines below a level, which can be changed while running, and
+// passes them on to the logger as records, or else as they are to the writer;
+// the lines are of the form "2015/03/16 14:28:12 [INFO] raft: ...", those
+// without a level are always passed on
+type levelWriter struct {
+	sync.RWMutex
+	// the writer the lines are passed to when there is no logger
+	writer io.Writer
+	// the logger the lines are passed to as records
+	logger Logger
+	// the position of the lowest level written
+	minimum int
+}
+
+func newLevelWriter(writer io.Writer, logger Logger, level string) (*levelWriter, error) {
+	minimum, err := logLevelIndex(level)
+	if err != nil {
+		return nil, err
+	}
+	return &levelWriter{writer: writer, logger: logger, minimum: minimum}, nil
+}
+
+// Change the lowest level written
+//  level:		the name of the level
+func (l *levelWriter) SetLevel(level string) error {
+	minimum, err := logLevelIndex(level)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.minimum = minimum
+	return nil
+}
+
+// Check if records of the level are passed on
+//  level:		the level of the record
+func (l *levelWriter) enabled(level LogLevel) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return int(level) >= l.minimum
+}
+
+func (l *levelWriter) Write(line []byte) (int, error) {
+	if l.logger == nil {
+		if start := bytes.IndexByte(line, '['); start >= 0 {
+			if end := bytes.IndexByte(line[start:], ']'); end > 0 {
+				if index, err := logLevelIndex(string(line[start+1 : start+end])); err == nil && !l.enabled(LogLevel(index)) {
+					return len(line), nil
+				}
+			}
+		}
+		return l.writer.Write(line)
+	}
+	// step: a write can hold several lines, i.e. a multi-line error from raft
+	for _, text := range bytes.Split(line, []byte("\n")) {
+		if len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+		level, subsystem, message := parseLogLine(text)
+		if l.enabled(level) {
+			l.logger.Log(level, message, "subsystem", subsystem)
+		}
+	}
+	return len(line), nil
+}
+
+// Log a record from the store itself, which is formatted as a consul log line
+// when there is no logger
+//  level:		the level of the record
+//  message:	the message
+//  attrs:		the attributes, alternating keys and values
+func (l *levelWriter) Log(level LogLevel, message string, attrs ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	if l.logger != nil {
+		l.logger.Log(level, message, append([]interface{}{"subsystem", storeSubsystem}, attrs...)...)
+		return
+	}
+	line := fmt.Sprintf("%s [%s] %s: %s", time.Now().Format(logTimeFormat), level, storeSubsystem, message)
+	for i := 0; i < len(attrs); i += 2 {
+		if i+1 < len(attrs) {
+			line += fmt.Sprintf(", %v: %v", attrs[i], attrs[i+1])
+		} else {
+			line += fmt.Sprintf(", %v", attrs[i])
+		}
+	}
+	l.writer.Write([]byte(line + "\n"))
+}
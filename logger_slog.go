@@ -0,0 +1,67 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// the slog level of the trace records, below debug
+const LevelTrace = slog.LevelDebug - 4
+
+// passes the records to a slog handler
+type slogLogger struct {
+	// the handler the records are passed to
+	handler slog.Handler
+}
+
+// Create a logger passing the records to a slog handler, the trace records are
+// logged at LevelTrace and the errors at slog.LevelError
+//  handler:	the slog handler i.e. slog.Default().Handler()
+func NewSlogLogger(handler slog.Handler) Logger {
+	return &slogLogger{handler: handler}
+}
+
+func (s *slogLogger) Log(level LogLevel, message string, attrs ...interface{}) {
+	ctx := context.Background()
+	severity := slogLevel(level)
+	if !s.handler.Enabled(ctx, severity) {
+		return
+	}
+	record := slog.NewRecord(time.Now(), severity, message, 0)
+	record.Add(attrs...)
+	s.handler.Handle(ctx, record)
+}
+
+// The slog level for a log level
+//  level:		the log level
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogTrace:
+		return LevelTrace
+	case LogDebug:
+		return slog.LevelDebug
+	case LogWarn:
+		return slog.LevelWarn
+	case LogError:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,43 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	logger := NewSlogLogger(slog.NewJSONHandler(buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	writer, err := newLevelWriter(nil, logger, "trace")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	writer.Write([]byte("2015/03/16 14:28:12 [TRACE] raft: below the handler level\n"))
+	writer.Write([]byte("2015/03/16 14:28:12 [ERR] raft: Failed to make RequestVote RPC\n"))
+
+	var record map[string]interface{}
+	err = json.Unmarshal(buffer.Bytes(), &record)
+	if assert.Nil(t, err, "we should not recieve an error: %s, output: %s", err, buffer.String()) {
+		assert.Equal(t, "ERROR", record["level"])
+		assert.Equal(t, "raft", record["subsystem"])
+		assert.Equal(t, "Failed to make RequestVote RPC", record["msg"])
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRecord struct {
+	level   LogLevel
+	message string
+	attrs   []interface{}
+}
+
+type testLogger struct {
+	sync.Mutex
+	records []testRecord
+}
+
+func (l *testLogger) Log(level LogLevel, message string, attrs ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.records = append(l.records, testRecord{level: level, message: message, attrs: attrs})
+}
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line      string
+		level     LogLevel
+		subsystem string
+		message   string
+	}{
+		{"2015/03/16 14:28:12 [INFO] raft: Node at 127.0.0.1:8300 [Follower] entering Follower state\n",
+			LogInfo, "raft", "Node at 127.0.0.1:8300 [Follower] entering Follower state"},
+		{"2015/03/16 14:28:12 [ERR] agent: failed to sync remote state: No cluster leader",
+			LogError, "agent", "failed to sync remote state: No cluster leader"},
+		{"[WARN] memberlist: Was able to reach node via TCP but not UDP", LogWarn, "memberlist", "Was able to reach node via TCP but not UDP"},
+		{"2015/03/16 14:28:12 [DEBUG] http: Request /v1/kv/ (1ms)", LogDebug, "http", "Request /v1/kv/ (1ms)"},
+		{"==> Starting Consul agent...", LogInfo, "agent", "==> Starting Consul agent..."},
+		{"[INFO] no subsystem here: just text", LogInfo, "agent", "no subsystem here: just text"},
+	}
+	for _, test := range tests {
+		level, subsystem, message := parseLogLine([]byte(test.line))
+		assert.Equal(t, test.level, level, "line: %s", test.line)
+		assert.Equal(t, test.subsystem, subsystem, "line: %s", test.line)
+		assert.Equal(t, test.message, message, "line: %s", test.line)
+	}
+	assert.Equal(t, "ERR", LogError.String())
+	assert.Equal(t, "LogLevel(9)", LogLevel(9).String())
+}
+
+func TestLevelWriterLogger(t *testing.T) {
+	logger := new(testLogger)
+	buffer := new(bytes.Buffer)
+	writer, err := newLevelWriter(buffer, logger, "info")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	writer.Write([]byte("2015/03/16 14:28:12 [DEBUG] raft: hidden\n"))
+	writer.Write([]byte("2015/03/16 14:28:12 [INFO] serf: EventMemberJoin: node1 127.0.0.1\n2015/03/16 14:28:12 [WARN] raft: Heartbeat timeout reached\n"))
+	writer.Log(LogInfo, "joined the members", "members", []string{"10.0.0.2:8301"})
+	writer.Log(LogDebug, "hidden")
+	assert.Empty(t, buffer.String(), "the lines should only go to the logger")
+
+	if assert.Equal(t, 3, len(logger.records)) {
+		assert.Equal(t, testRecord{LogInfo, "EventMemberJoin: node1 127.0.0.1", []interface{}{"subsystem", "serf"}}, logger.records[0])
+		assert.Equal(t, testRecord{LogWarn, "Heartbeat timeout reached", []interface{}{"subsystem", "raft"}}, logger.records[1])
+		assert.Equal(t, testRecord{LogInfo, "joined the members",
+			[]interface{}{"subsystem", "distrostore", "members", []string{"10.0.0.2:8301"}}}, logger.records[2])
+	}
+
+	// step: without a logger the records of the store are written as consul lines
+	writer, _ = newLevelWriter(buffer, nil, "warn")
+	writer.Log(LogInfo, "hidden")
+	writer.Log(LogWarn, "unable to join the members", "error", "timeout")
+	assert.Contains(t, buffer.String(), "[WARN] distrostore: unable to join the members, error: timeout\n")
+	assert.NotContains(t, buffer.String(), "hidden")
+}
+
+func TestMemoryLogger(t *testing.T) {
+	logger := new(testLogger)
+	cfg := DefaultContext()
+	cfg.Logger = logger
+	cfg.LogLevel = "debug"
+	cfg.Snapshots = SnapshotConfig{Dir: newTestSnapshotDir(t), Retain: 1}
+	store, err := NewMemoryStore(cfg)
+	if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+		return
+	}
+	defer store.Close()
+	err = store.snapshots.take()
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	if assert.Equal(t, 1, len(logger.records)) {
+		assert.Equal(t, LogDebug, logger.records[0].level)
+		assert.Equal(t, "took a snapshot", logger.records[0].message)
+		assert.Equal(t, []interface{}{"subsystem", "distrostore"}, logger.records[0].attrs[:2])
+	}
+
+	cfg.LogLevel = "LOUD"
+	_, err = NewMemoryStore(cfg)
+	assert.Equal(t, ErrInvalidLogLevel, err)
+}
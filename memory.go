@@ -0,0 +1,987 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the store backed by an embedded consul agent
+	BackendConsul = "consul"
+	// the store held in memory, for unit tests
+	BackendMemory = "memory"
+	// the number of key events the memory store keeps to resume watches from
+	DEFAULT_MEMORY_HISTORY = 1024
+	// the name of the memory node when none is given
+	DEFAULT_MEMORY_NODE = "memory"
+)
+
+var (
+	// the node is not known to the memory store
+	ErrUnknownNode = errors.New("The node is not known to the store")
+)
+
+// A DistroStore held entirely in memory, without a gossip stack or raft. The
+// events for a change are queued to the listeners before the call returns, in
+// the order of the changes.
+// The peers of the node are simulated with AddNode, SetNodeStatus and RemoveNode.
+type MemoryDistroStore struct {
+	sync.RWMutex
+	// the cluster context config
+	context *Context
+	// the node the store is running as
+	node *Node
+	// the simulated peers, keyed by name
+	nodes map[string]*Node
+	// the key/value pairs
+	pairs map[string]*memoryPair
+	// the index of the last change
+	index uint64
+	// the most recent key events, used to resume watches
+	history []*KeyAPIEvent
+	// the index of the last event dropped from the history
+	truncated uint64
+	// the lamport time of the last user event
+	ltime uint64
+	// the dispatcher for those listening to key events
+	key_listeners *dispatcher
+	// the dispatcher for those listening to node events
+	node_listeners *dispatcher
+	// those listening to user events
+	event_listeners *eventListeners
+	// a map of the prefix watches
+	subscriptions map[*keySubscription]bool
+	// takes the scheduled snapshots
+	snapshots *snapshotScheduler
+	// filters the records of the store below the log level
+	log_writer *levelWriter
+	// the services registered, keyed by id
+	services map[string]*memoryService
+	// the service watches and the service they are watching
+	service_subscriptions map[*serviceSubscription]*memoryServiceWatch
+	// closed when the store is shutting down
+	shutdown chan struct{}
+	// ensures the store is only closed once
+	close_once sync.Once
+}
+
+type memoryPair struct {
+	// the value of the key
+	value []byte
+	// the flags stored with the key
+	flags uint64
+	// the index the key was created at
+	createIndex uint64
+	// the index the key was last modified at
+	modifyIndex uint64
+	// the session holding the key, when set with a ttl
+	session string
+	// deletes the key once the ttl has passed
+	expiry *time.Timer
+}
+
+type memoryService struct {
+	// the service as registered
+	service *Service
+	// the checks on the service
+	checks []*memoryCheck
+	// the checks we are running for the service
+	runners []*checkRunner
+}
+
+type memoryCheck struct {
+	// the time the application has to report in, zero for the checks we run
+	ttl time.Duration
+	// the last status reported
+	status HealthStatus
+	// the time a ttl check goes critical
+	deadline time.Time
+}
+
+// Work out the status of the check, a ttl check goes critical once expired
+func (c *memoryCheck) current() HealthStatus {
+	if c.ttl > 0 && time.Now().After(c.deadline) {
+		return HealthCritical
+	}
+	return c.status
+}
+
+type memoryServiceWatch struct {
+	// the name of the service
+	name string
+	// the tag the instances must have, empty for all
+	tag string
+	// signalled when the service may have changed
+	changed chan struct{}
+}
+
+// Create an in-memory store with the default context, for unit tests
+func NewMemory() *MemoryDistroStore {
+	store, _ := NewMemoryStore(DefaultContext())
+	return store
+}
+
+// Create an in-memory store
+//  cfg:          the configuration for the store, the node is named after NodeName
+func NewMemoryStore(cfg *Context) (*MemoryDistroStore, error) {
+	if err := validateNodeTags(cfg.NodeTags); err != nil {
+		return nil, err
+	}
+	if err := validateSnapshotConfig(&cfg.Snapshots); err != nil {
+		return nil, err
+	}
+	output := cfg.LogOutput
+	if output == nil {
+		output = ioutil.Discard
+	}
+	logWriter, err := newLevelWriter(output, cfg.Logger, cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.NodeName
+	if name == "" {
+		name = DEFAULT_MEMORY_NODE
+	}
+	address := cfg.BindAdvertised
+	if address == "" {
+		address = "127.0.0.1"
+	}
+	service := &MemoryDistroStore{
+		context: cfg,
+		node: &Node{
+			ID:         name,
+			Address:    address,
+			Port:       cfg.PortsConfig.SerfLan,
+			Status:     NodeAlive,
+			Role:       NodeServer,
+			Datacenter: cfg.Datacenter,
+			Tags:       copyTags(cfg.NodeTags),
+			Build:      BackendMemory,
+			Leader:     true,
+		},
+		nodes:                 make(map[string]*Node, 0),
+		pairs:                 make(map[string]*memoryPair, 0),
+		history:               make([]*KeyAPIEvent, 0),
+		key_listeners:         newDispatcher("key"),
+		node_listeners:        newDispatcher("node"),
+		event_listeners:       newEventListeners(cfg.ListenerBuffer, cfg.ListenerPolicy),
+		subscriptions:         make(map[*keySubscription]bool, 0),
+		services:              make(map[string]*memoryService, 0),
+		service_subscriptions: make(map[*serviceSubscription]*memoryServiceWatch, 0),
+		shutdown:              make(chan struct{}),
+		log_writer:            logWriter,
+	}
+	// step: the memory store is always the leader
+	service.snapshots = newSnapshotScheduler(cfg.Snapshots, service.Snapshot, func() bool { return true })
+	service.snapshots.logger = logWriter
+	go service.snapshots.run(service.shutdown)
+
+	return service, nil
+}
+
+func (r *MemoryDistroStore) Config() *Context {
+	return r.context
+}
+
+// Close the store, closing the subscriptions and listeners
+func (r *MemoryDistroStore) Close() error {
+	r.close_once.Do(func() {
+		close(r.shutdown)
+		r.RLock()
+		subscriptions := make([]*keySubscription, 0, len(r.subscriptions))
+		for subscription := range r.subscriptions {
+			subscriptions = append(subscriptions, subscription)
+		}
+		services := make([]*serviceSubscription, 0, len(r.service_subscriptions))
+		for subscription := range r.service_subscriptions {
+			services = append(services, subscription)
+		}
+		r.RUnlock()
+
+		for _, subscription := range subscriptions {
+			subscription.Close()
+		}
+		for _, subscription := range services {
+			subscription.Close()
+		}
+		r.key_listeners.close(ErrStoreClosed)
+		r.node_listeners.close(ErrStoreClosed)
+		r.event_listeners.close(ErrStoreClosed)
+	})
+	return nil
+}
+
+// There is no cluster to leave, the same as Close
+//  ctx:		unused
+func (r *MemoryDistroStore) CloseWithContext(ctx context.Context) error {
+	return r.Close()
+}
+
+// There is no cluster to leave, the same as Close
+//  force:		unused
+func (r *MemoryDistroStore) Shutdown(force bool) error {
+	return r.Close()
+}
+
+// Add a simulated member at the endpoint to the cluster, named after the endpoint
+//  member: 	the endpoint address i.e. the <IPADDRESS>:<PORT>
+func (r *MemoryDistroStore) Join(member string) error {
+	if !isEndpoint(member) {
+		return ErrInvalidMemberAddress
+	}
+	host, port, _ := net.SplitHostPort(member)
+	number, _ := strconv.Atoi(port)
+	r.RLock()
+	_, found := r.nodes[member]
+	r.RUnlock()
+	if found {
+		return nil
+	}
+	return r.AddNode(&Node{ID: member, Address: host, Port: number})
+}
+
+// Add a simulated peer to the cluster, the peers see a joined event
+//  node:		the peer, an empty status, role and datacenter are filled in
+func (r *MemoryDistroStore) AddNode(node *Node) error {
+	if err := validateNodeTags(node.Tags); err != nil {
+		return err
+	}
+	peer := *node
+	peer.Tags = copyTags(node.Tags)
+	if peer.Status == 0 {
+		peer.Status = NodeAlive
+	}
+	if peer.Role == 0 {
+		peer.Role = NodeServer
+	}
+	if peer.Datacenter == "" {
+		peer.Datacenter = r.node.Datacenter
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.nodes[peer.ID] = &peer
+	r.node_listeners.publish(&NodeAPIEvent{Node: copyNode(&peer), Status: nodeEventStatus(peer.Status)})
+	return nil
+}
+
+// Change the status of a simulated peer i.e. to fail it
+//  id:			the name of the peer
+//  status:		the new status of the peer
+func (r *MemoryDistroStore) SetNodeStatus(id string, status NodeStatus) error {
+	r.Lock()
+	defer r.Unlock()
+	peer, found := r.nodes[id]
+	if !found {
+		return ErrUnknownNode
+	}
+	if peer.Status == status {
+		return nil
+	}
+	peer.Status = status
+	r.node_listeners.publish(&NodeAPIEvent{Node: copyNode(peer), Status: nodeEventStatus(status)})
+	return nil
+}
+
+// Remove a simulated peer from the cluster, the peers see a left event
+//  id:			the name of the peer
+func (r *MemoryDistroStore) RemoveNode(id string) error {
+	r.Lock()
+	defer r.Unlock()
+	peer, found := r.nodes[id]
+	if !found {
+		return ErrUnknownNode
+	}
+	delete(r.nodes, id)
+	peer.Status = NodeLeft
+	r.node_listeners.publish(&NodeAPIEvent{Node: copyNode(peer), Status: nodeEventStatus(NodeLeft)})
+	return nil
+}
+
+// Retrieve the node and the simulated peers, sorted by name
+func (r *MemoryDistroStore) Nodes() ([]*Node, error) {
+	r.RLock()
+	defer r.RUnlock()
+	list := make([]*Node, 0, len(r.nodes)+1)
+	list = append(list, copyNode(r.node))
+	for _, peer := range r.nodes {
+		list = append(list, copyNode(peer))
+	}
+	sort.Sort(byNodeID(list))
+	return list, nil
+}
+
+// Check to see if a key exists in the store
+// key:		the key you are looking for
+func (r *MemoryDistroStore) Exists(key string) (bool, error) {
+	_, found, err := r.Get(key)
+	return found, err
+}
+
+// Get a value from the store
+//  key:		the key you are looking for
+func (r *MemoryDistroStore) Get(key string) (string, bool, error) {
+	r.RLock()
+	defer r.RUnlock()
+	pair, found := r.pairs[key]
+	if !found {
+		return "", false, nil
+	}
+	return string(pair.value), true, nil
+}
+
+// Set a key/pair in the store
+//  key: 	the key you wish to set
+//  data:	the value of the key
+func (r *MemoryDistroStore) Set(key, data string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.setKey(key, []byte(data), 0)
+	return nil
+}
+
+// Delete a key from the store
+//  key:		the key you wish to delete
+func (r *MemoryDistroStore) Delete(key string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.deleteKey(key)
+	return nil
+}
+
+// Get the modify index of a key, used with CompareAndSet
+//  key:		the key you are looking for
+func (r *MemoryDistroStore) GetIndex(key string) (uint64, bool, error) {
+	r.RLock()
+	defer r.RUnlock()
+	pair, found := r.pairs[key]
+	if !found {
+		return 0, false, nil
+	}
+	return pair.modifyIndex, true, nil
+}
+
+// Set the key only if it has not been modified since the index
+//  key: 	the key you wish to set
+//  data:	the value of the key
+//  index:	the modify index from GetIndex, zero only sets the key if it does not exist
+func (r *MemoryDistroStore) CompareAndSet(key, data string, index uint64) (bool, error) {
+	return r.casPair(&KeyPair{Key: key, Value: []byte(data)}, index)
+}
+
+// Set a key which is deleted once the ttl has passed
+//  key: 	the key you wish to set
+//  data:	the value of the key
+//  ttl:	the time to live for the key
+func (r *MemoryDistroStore) SetWithTTL(key, data string, ttl time.Duration) error {
+	if err := validateKeyTTL(ttl); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if pair, found := r.pairs[key]; found && pair.session != "" {
+		return ErrKeyLocked
+	}
+	pair := r.pairs[key]
+	if pair == nil {
+		pair = &memoryPair{}
+	}
+	// step: the session is taken before the set, so the event carries it
+	pair.session = BackendMemory + ":" + newRandomID()
+	r.pairs[key] = pair
+	r.setKey(key, []byte(data), 0)
+	pair.expiry = time.AfterFunc(ttl, func() {
+		r.Lock()
+		defer r.Unlock()
+		if current, found := r.pairs[key]; found && current == pair {
+			r.deleteKey(key)
+		}
+	})
+	return nil
+}
+
+// Write a snapshot of the keys to the writer
+//  w:			the writer for the snapshot
+func (r *MemoryDistroStore) Snapshot(w io.Writer) (*SnapshotMeta, error) {
+	list, index, err := r.listPairs("")
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &SnapshotMeta{
+		Index:      index,
+		Time:       time.Now().UTC(),
+		Node:       r.node.ID,
+		Datacenter: r.node.Datacenter,
+	}
+	if err := writeSnapshot(w, snapshot, list); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Write the keys under the prefix to the writer
+//  prefix:		the prefix of the keys exported
+//  format:		the format of the export, json, yaml or tree
+//  w:			the writer for the export
+func (r *MemoryDistroStore) Export(prefix string, format ExportFormat, w io.Writer) error {
+	return exportKeys(r, prefix, format, w)
+}
+
+// Read the keys from an export into the store
+//  reader:		the reader for the export
+//  format:		the format of the export, json, yaml or tree
+//  options:	the options for the import, can be nil
+func (r *MemoryDistroStore) Import(reader io.Reader, format ExportFormat, options *ImportOptions) (*ImportSummary, error) {
+	return importKeys(r, reader, format, options)
+}
+
+// List the keys under the prefix
+//  prefix:		the prefix of the keys
+func (r *MemoryDistroStore) listPairs(prefix string) ([]*KeyPair, uint64, error) {
+	r.RLock()
+	defer r.RUnlock()
+	list := make([]*KeyPair, 0)
+	for key, pair := range r.pairs {
+		if strings.HasPrefix(key, prefix) {
+			list = append(list, &KeyPair{Key: key, Flags: pair.flags, Value: pair.value, ModifyIndex: pair.modifyIndex})
+		}
+	}
+	sort.Sort(byKeyPair(list))
+	return list, r.index, nil
+}
+
+// Set the key if it has not been modified since the index
+//  pair:		the key to set
+//  index:		the modify index, zero only creates the key
+func (r *MemoryDistroStore) casPair(pair *KeyPair, index uint64) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	current, found := r.pairs[pair.Key]
+	if (index == 0 && found) || (index > 0 && (!found || current.modifyIndex != index)) {
+		return false, nil
+	}
+	r.setKey(pair.Key, pair.Value, pair.Flags)
+	return true, nil
+}
+
+// The status of the scheduled snapshots
+func (r *MemoryDistroStore) SnapshotStatus() SnapshotStatus {
+	return r.snapshots.Status()
+}
+
+// Apply a new context to the store, as the consul backend does; the new members
+// are added as simulated peers, and the settings needing a restart are returned
+// in a RestartRequiredError
+//  cfg:		the new context
+func (r *MemoryDistroStore) Reload(cfg *Context) error {
+	if err := validateReload(cfg); err != nil {
+		return err
+	}
+	r.RLock()
+	current := *r.context
+	r.RUnlock()
+	live, restart := splitReloadable(diffContext(&current, cfg))
+
+	if live["LogLevel"] {
+		if err := r.log_writer.SetLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+	for _, member := range addedMembers(current.Members, cfg.Members) {
+		if err := r.Join(member); err != nil {
+			return err
+		}
+	}
+	if snapshotsChanged(live) {
+		r.snapshots.configure(cfg.Snapshots)
+	}
+
+	r.Lock()
+	r.context.LogLevel = cfg.LogLevel
+	r.context.ACLToken = cfg.ACLToken
+	r.context.Members = append([]string{}, cfg.Members...)
+	r.context.Snapshots = cfg.Snapshots
+	r.context.TLS = cfg.TLS
+	r.Unlock()
+
+	return reloadResult(restart)
+}
+
+// Replace the keys with those in a snapshot, once its checksum is verified
+//  reader:		the reader for the snapshot
+func (r *MemoryDistroStore) Restore(reader io.Reader) (*SnapshotMeta, error) {
+	meta, pairs, err := readSnapshot(reader)
+	if err != nil {
+		return nil, err
+	}
+	r.Lock()
+	defer r.Unlock()
+	wanted := make(map[string]bool, len(pairs))
+	// step: the keys are written before the extras are deleted, as the consul backend does
+	for _, pair := range pairs {
+		wanted[pair.Key] = true
+		if current, found := r.pairs[pair.Key]; found && current.flags == pair.Flags && bytes.Equal(current.value, pair.Value) {
+			continue
+		}
+		r.setKey(pair.Key, pair.Value, pair.Flags)
+	}
+	for key := range r.pairs {
+		if !wanted[key] {
+			r.deleteKey(key)
+		}
+	}
+	return meta, nil
+}
+
+// Set the key and publish the event, called with the lock held
+//  key: 	the key you wish to set
+//  value:	the value of the key
+//  flags:	the flags stored with the key
+func (r *MemoryDistroStore) setKey(key string, value []byte, flags uint64) {
+	r.index++
+	pair, found := r.pairs[key]
+	existed := found && pair.createIndex > 0
+	if !found {
+		pair = &memoryPair{}
+		r.pairs[key] = pair
+	}
+	if !existed {
+		pair.createIndex = r.index
+	}
+	event := &KeyAPIEvent{
+		Key:         key,
+		Status:      KeySet,
+		CreateIndex: pair.createIndex,
+		ModifyIndex: r.index,
+		Flags:       flags,
+		Session:     pair.session,
+	}
+	r.limitValues(event, value, pair.value, existed)
+	pair.value = value
+	pair.flags = flags
+	pair.modifyIndex = r.index
+	r.publishKeyEvent(event)
+}
+
+// Delete the key and publish the event, called with the lock held
+//  key:		the key you wish to delete
+func (r *MemoryDistroStore) deleteKey(key string) {
+	pair, found := r.pairs[key]
+	if !found {
+		return
+	}
+	if pair.expiry != nil {
+		pair.expiry.Stop()
+	}
+	delete(r.pairs, key)
+	r.index++
+	event := &KeyAPIEvent{
+		Key:         key,
+		Status:      KeyDeleted,
+		CreateIndex: pair.createIndex,
+		ModifyIndex: r.index,
+	}
+	r.limitValues(event, nil, pair.value, true)
+	r.publishKeyEvent(event)
+}
+
+// Fill in the values of a key event, omitting those over the EventValueLimit
+//  event:		the key event
+//  value:		the new value, nil on delete
+//  previous:	the previous value
+//  existed:	whether the key existed before the change
+func (r *MemoryDistroStore) limitValues(event *KeyAPIEvent, value, previous []byte, existed bool) {
+	limit := r.context.EventValueLimit
+	if value != nil {
+		if len(value) <= limit {
+			event.Value = value
+		} else {
+			event.ValueOmitted = true
+		}
+	}
+	if existed {
+		if event.Status == KeySet {
+			event.Status = KeyChanged
+		}
+		if len(previous) <= limit {
+			event.PrevValue = previous
+		} else {
+			event.ValueOmitted = true
+		}
+	}
+}
+
+// Record the key event and queue it to the listeners and watches, called with the lock held
+//  event:		the key event
+func (r *MemoryDistroStore) publishKeyEvent(event *KeyAPIEvent) {
+	r.history = append(r.history, event)
+	if len(r.history) > DEFAULT_MEMORY_HISTORY {
+		r.truncated = r.history[0].ModifyIndex
+		r.history = r.history[1:]
+	}
+	r.key_listeners.publish(event)
+	for subscription := range r.subscriptions {
+		subscription.send(event)
+	}
+}
+
+// Add a listener for node membership events
+//  channel: 	the channel to pass the events upon
+func (r *MemoryDistroStore) AddNodeListener(channel chan *NodeAPIEvent) Listener {
+	return r.node_listeners.add(channel, r.context.ListenerBuffer, r.context.ListenerPolicy,
+		nodeChannelDeliver(channel), nil)
+}
+
+// Remove a listener for node membership events
+//  channel: 	the channel which was passed to AddNodeListener
+func (r *MemoryDistroStore) RemoveNodeListener(channel chan *NodeAPIEvent) {
+	r.node_listeners.remove(channel)
+}
+
+// Add a listener for key events
+//  channel: 	the channel to pass the events upon
+func (r *MemoryDistroStore) AddKeyListener(channel chan *KeyAPIEvent) Listener {
+	return r.key_listeners.add(channel, r.context.ListenerBuffer, r.context.ListenerPolicy,
+		keyChannelDeliver(channel), nil)
+}
+
+// Remove a listener for key events
+//  channel: 	the channel which was passed to AddKeyListener
+func (r *MemoryDistroStore) RemoveKeyListener(channel chan *KeyAPIEvent) {
+	r.key_listeners.remove(channel)
+}
+
+// Watch for changes to the keys under a prefix
+//  prefix:		the prefix of the keys we are interested in
+//  options:	the filter and starting index for the watch, can be nil
+func (r *MemoryDistroStore) Watch(prefix string, options *WatchOptions) (Subscription, error) {
+	filter, err := newKeyFilter(prefix, options)
+	if err != nil {
+		return nil, err
+	}
+	var index uint64
+	if options != nil {
+		index = options.Index
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-r.shutdown:
+		return nil, ErrStoreClosed
+	default:
+	}
+
+	var subscription *keySubscription
+	subscription = newKeySubscription(filter, options, func() {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.subscriptions, subscription)
+	})
+	// step: replay the changes since the index, or resync if they have left the history
+	if index > 0 {
+		if index < r.truncated {
+			subscription.send(&KeyAPIEvent{Key: prefix, Status: KeyResync, ModifyIndex: r.index})
+		} else {
+			for _, event := range r.history {
+				if event.ModifyIndex > index {
+					subscription.send(event)
+				}
+			}
+		}
+	}
+	r.subscriptions[subscription] = true
+
+	return subscription, nil
+}
+
+// Broadcast a user event to the listeners, coalescing events are passed on
+// straight away as there is nothing to coalesce them with
+//  name:		the name of the event
+//  payload:	the payload of the event
+//  coalesce:	whether only the latest event of the name matters
+func (r *MemoryDistroStore) Broadcast(name string, payload []byte, coalesce bool) error {
+	if _, err := validateUserEvent(name, payload, coalesce); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.ltime++
+	r.event_listeners.publish(&UserEvent{
+		ID:       newRandomID(),
+		Name:     name,
+		Payload:  payload,
+		LTime:    r.ltime,
+		Coalesce: coalesce,
+	})
+	return nil
+}
+
+// Add a listener for the user events
+//  name:		the name of the events, empty for all of them
+//  channel:	the channel to pass the events upon
+func (r *MemoryDistroStore) AddEventListener(name string, channel chan *UserEvent) Listener {
+	return r.event_listeners.add(name, channel)
+}
+
+// Remove a listener for the user events
+//  channel:	the channel which was passed to AddEventListener
+func (r *MemoryDistroStore) RemoveEventListener(channel chan *UserEvent) {
+	r.event_listeners.remove(channel)
+}
+
+// Query the nodes, unsupported as with the consul store
+//  name:		the name of the query
+//  payload:	the payload passed to the handlers
+//  options:	the filters and timeout for the query, can be nil
+func (r *MemoryDistroStore) Query(name string, payload []byte, options *QueryOptions) (*QueryResponse, error) {
+	return nil, ErrQueryUnsupported
+}
+
+// Register the handler for queries of the given name, unsupported as with Query
+//  name:		the name of the query
+//  handler:	the handler which produces the response
+func (r *MemoryDistroStore) HandleQuery(name string, handler QueryHandler) error {
+	return ErrQueryUnsupported
+}
+
+// Register a service on the node, replacing any service with the same id; the
+// ttl checks start critical and the others are run by the store
+//  service:	the service to register
+//  checks:		the health checks for the service
+func (r *MemoryDistroStore) RegisterService(service *Service, checks ...*ServiceCheck) ([]*CheckHandle, error) {
+	service, err := validateService(service)
+	if err != nil {
+		return nil, err
+	}
+	for _, check := range checks {
+		if err := validateCheck(check); err != nil {
+			return nil, err
+		}
+	}
+	r.stopServiceChecks(service.ID)
+
+	entry := &memoryService{service: service}
+	handles := make([]*CheckHandle, 0, len(checks))
+	for index, check := range checks {
+		state := &memoryCheck{ttl: check.TTL, status: HealthCritical}
+		if check.Kind != CheckTTL {
+			state.ttl = 0
+		}
+		entry.checks = append(entry.checks, state)
+		handle := &CheckHandle{
+			ID:     "service:" + service.ID + ":" + strconv.Itoa(index+1),
+			update: r.checkUpdater(service.ID, state),
+		}
+		handles = append(handles, handle)
+		if check.Kind != CheckTTL {
+			entry.runners = append(entry.runners, newCheckRunner(check, reportCheck(handle)))
+		}
+	}
+
+	r.Lock()
+	r.services[service.ID] = entry
+	r.Unlock()
+	for _, runner := range entry.runners {
+		go runner.run(r.shutdown)
+	}
+	r.notifyServiceWatches()
+
+	return handles, nil
+}
+
+// Create the function used by a check handle to update the check
+//  id:			the id of the service
+//  state:		the check being updated
+func (r *MemoryDistroStore) checkUpdater(id string, state *memoryCheck) func(HealthStatus, string) error {
+	return func(status HealthStatus, note string) error {
+		r.Lock()
+		// step: the service may have been deregistered or registered again since
+		registered := false
+		if entry, found := r.services[id]; found {
+			for _, check := range entry.checks {
+				registered = registered || check == state
+			}
+		}
+		if registered {
+			state.status = status
+			state.deadline = time.Now().Add(state.ttl)
+		}
+		r.Unlock()
+		if !registered {
+			return ErrInvalidCheck
+		}
+		r.notifyServiceWatches()
+		return nil
+	}
+}
+
+// Remove a service and its health checks from the node
+//  id:			the id of the service
+func (r *MemoryDistroStore) DeregisterService(id string) error {
+	r.stopServiceChecks(id)
+	r.Lock()
+	delete(r.services, id)
+	r.Unlock()
+	r.notifyServiceWatches()
+	return nil
+}
+
+func (r *MemoryDistroStore) stopServiceChecks(id string) {
+	r.Lock()
+	defer r.Unlock()
+	if entry, found := r.services[id]; found {
+		for _, runner := range entry.runners {
+			runner.stop()
+		}
+		entry.runners = nil
+	}
+}
+
+// Retrieve the instances of a service on the node
+//  name:			the name of the service
+//  passingOnly:	only return the instances passing all their checks
+func (r *MemoryDistroStore) Services(name string, passingOnly bool) ([]*ServiceInstance, error) {
+	return r.serviceInstances(name, "", passingOnly), nil
+}
+
+func (r *MemoryDistroStore) serviceInstances(name, tag string, passingOnly bool) []*ServiceInstance {
+	r.RLock()
+	defer r.RUnlock()
+	list := make([]*ServiceInstance, 0)
+	for _, entry := range r.services {
+		if entry.service.Name != name || (tag != "" && !hasTag(entry.service.Tags, tag)) {
+			continue
+		}
+		statuses := make([]string, 0, len(entry.checks))
+		for _, check := range entry.checks {
+			statuses = append(statuses, string(check.current()))
+		}
+		status := worstHealthStatus(statuses)
+		if passingOnly && status != HealthPassing {
+			continue
+		}
+		service := *entry.service
+		service.Tags = append([]string{}, entry.service.Tags...)
+		service.Meta = copyTags(entry.service.Meta)
+		if service.Address == "" {
+			service.Address = r.node.Address
+		}
+		list = append(list, &ServiceInstance{Node: r.node.ID, Service: &service, Status: status})
+	}
+	sortInstances(list)
+	return list
+}
+
+// Watch the passing instances of a service, the full set is sent whenever it changes
+//  name:		the name of the service
+//  tag:		only include the instances with this tag, empty for all
+func (r *MemoryDistroStore) WatchService(name, tag string) (ServiceSubscription, error) {
+	if name == "" {
+		return nil, ErrInvalidService
+	}
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-r.shutdown:
+		return nil, ErrStoreClosed
+	default:
+	}
+
+	var subscription *serviceSubscription
+	subscription = newServiceSubscription(func() {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.service_subscriptions, subscription)
+	})
+	watch := &memoryServiceWatch{name: name, tag: tag, changed: make(chan struct{}, 1)}
+	r.service_subscriptions[subscription] = watch
+
+	window := r.context.ServiceDebounce
+	if window <= 0 {
+		window = DEFAULT_SERVICE_DEBOUNCE
+	}
+	go subscription.run(window)
+	go r.watchService(watch, subscription, window)
+
+	return subscription, nil
+}
+
+// Pass the instances of the service to the watch whenever they may have changed;
+// the ttl checks expire without a change, so we also look every window
+//  watch:			the service being watched
+//  subscription:	the watch the instances are passed to
+//  window:			the debounce window of the watch
+func (r *MemoryDistroStore) watchService(watch *memoryServiceWatch, subscription *serviceSubscription, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		if !subscription.update(r.serviceInstances(watch.name, watch.tag, true)) {
+			return
+		}
+		select {
+		case <-subscription.stopChannel:
+			return
+		case <-watch.changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *MemoryDistroStore) notifyServiceWatches() {
+	r.RLock()
+	defer r.RUnlock()
+	for _, watch := range r.service_subscriptions {
+		select {
+		case watch.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Copy a node, so the callers can't change the nodes we hold
+//  node:		the node to copy
+func copyNode(node *Node) *Node {
+	copied := *node
+	copied.Tags = copyTags(node.Tags)
+	return &copied
+}
+
+// Check if the tag is in the list
+//  tags:		the list of tags
+//  tag:		the tag we are looking for
+func hasTag(tags []string, tag string) bool {
+	for _, item := range tags {
+		if item == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type byNodeID []*Node
+
+func (b byNodeID) Len() int           { return len(b) }
+func (b byNodeID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byNodeID) Less(i, j int) bool { return b[i].ID < b[j].ID }
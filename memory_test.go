@@ -0,0 +1,149 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func recieveKeyEvent(t *testing.T, channel <-chan *KeyAPIEvent) *KeyAPIEvent {
+	select {
+	case event := <-channel:
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("we did not recieve the key event in time")
+	}
+	return nil
+}
+
+func TestMemoryBackend(t *testing.T) {
+	cfg := DefaultContext()
+	cfg.Backend = BackendMemory
+	store, err := New(cfg)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.NotNil(t, store, "we should have recieved a store")
+	defer store.Close()
+
+	cfg.Backend = "unknown"
+	_, err = New(cfg)
+	assert.Equal(t, ErrInvalidConfig, err)
+}
+
+func TestMemoryKeys(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	channel := make(chan *KeyAPIEvent, 10)
+	listener := store.AddKeyListener(channel)
+
+	assert.Nil(t, store.Set("test", "hello"))
+	assert.Nil(t, store.Set("test", "world"))
+	value, found, err := store.Get("test")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, found)
+	assert.Equal(t, "world", value)
+	found, _ = store.Exists("missing")
+	assert.False(t, found)
+
+	event := recieveKeyEvent(t, channel)
+	assert.Equal(t, KeySet, event.Status)
+	assert.Equal(t, uint64(1), event.ModifyIndex)
+	event = recieveKeyEvent(t, channel)
+	assert.Equal(t, KeyChanged, event.Status)
+	assert.Equal(t, []byte("hello"), event.PrevValue)
+	assert.Equal(t, uint64(1), event.CreateIndex)
+	assert.Equal(t, uint64(2), event.ModifyIndex)
+
+	store.Close()
+	<-listener.Done()
+	assert.Equal(t, ErrStoreClosed, listener.Err(), "the listener should be removed with the store")
+}
+
+func TestMemoryWatchResume(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	store.Set("jobs/1", "a")
+	store.Set("other/1", "b")
+	store.Set("jobs/2", "c")
+
+	subscription, err := store.Watch("jobs/", &WatchOptions{Index: 1})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	defer subscription.Close()
+	event := recieveKeyEvent(t, subscription.Events())
+	assert.Equal(t, "jobs/2", event.Key, "we should only replay the changes after the index")
+
+	store.Set("jobs/3", "d")
+	event = recieveKeyEvent(t, subscription.Events())
+	assert.Equal(t, "jobs/3", event.Key)
+	assert.Equal(t, uint64(4), subscription.LastIndex())
+}
+
+func TestMemoryWatchResync(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	for i := 0; i < DEFAULT_MEMORY_HISTORY+2; i++ {
+		store.Set("jobs/1", "a")
+	}
+	subscription, err := store.Watch("jobs/", &WatchOptions{Index: 1})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	defer subscription.Close()
+	event := recieveKeyEvent(t, subscription.Events())
+	assert.Equal(t, KeyResync, event.Status)
+	assert.Equal(t, uint64(DEFAULT_MEMORY_HISTORY+2), event.ModifyIndex)
+}
+
+func TestMemoryNodes(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	channel := make(chan *NodeAPIEvent, 10)
+	store.AddNodeListener(channel)
+
+	assert.Equal(t, ErrInvalidMemberAddress, store.Join("nowhere"))
+	assert.Nil(t, store.Join("127.0.0.2:8301"))
+	assert.Nil(t, store.SetNodeStatus("127.0.0.2:8301", NodeFailed))
+	assert.Equal(t, ErrUnknownNode, store.SetNodeStatus("missing", NodeFailed))
+
+	nodes, err := store.Nodes()
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, 2, len(nodes))
+	for _, expected := range []NodeEventStatus{NodeEventJoined, NodeEventFailed} {
+		select {
+		case event := <-channel:
+			assert.Equal(t, expected, event.Status)
+			assert.Equal(t, "127.0.0.2:8301", event.Node.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("we did not recieve the node event in time")
+		}
+	}
+}
+
+func TestMemoryServices(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	handles, err := store.RegisterService(&Service{Name: "web", Port: 8080},
+		&ServiceCheck{Kind: CheckTTL, TTL: time.Minute})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+
+	services, _ := store.Services("web", true)
+	assert.Empty(t, services, "the ttl check should start critical")
+	assert.Nil(t, handles[0].Pass(""))
+	services, _ = store.Services("web", true)
+	assert.Equal(t, 1, len(services))
+	assert.Equal(t, "127.0.0.1", services[0].Service.Address)
+
+	assert.Nil(t, store.DeregisterService("web"))
+	assert.NotNil(t, handles[0].Pass(""), "the check should have gone with the service")
+}
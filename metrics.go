@@ -0,0 +1,105 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// The store emits its metrics to the global go-metrics sink, alongside those of
+// consul, raft, serf and memberlist; nothing is kept unless a sink has been
+// installed, i.e. the prometheus collector in the metrics package. The keys are:
+//
+//	distrostore.kv.<operation>				the latency of get, set, cas and delete
+//	distrostore.kv.<operation>.errors		the operations which failed
+//	distrostore.kv.cas.conflicts			the cas which lost to another change
+//	distrostore.listener.<kind>.lag			the time an event waited for a key, node, event listener or watch
+//	distrostore.listener.<kind>.dropped		the events dropped with the listener's buffer full
+//	distrostore.members.<status>			the members of the cluster by status
+//	distrostore.leader.changes				the elections seen by the node, from the raft term
+//	distrostore.raft.applied_index			the last index applied to the store
+const metricsPrefix = "distrostore"
+
+// the statuses the members are counted by, zero counts are emitted as well
+var memberStatuses = []NodeStatus{NodeAlive, NodeLeaving, NodeLeft, NodeFailed}
+
+// Record the latency of an operation on the keys and count it if it failed
+//  operation:	the name of the operation i.e. get, set or cas
+//  start:		the time the operation started
+//  err:		the error from the operation, if any
+func measureKeyOperation(operation string, start time.Time, err error) {
+	metrics.MeasureSince([]string{metricsPrefix, "kv", operation}, start)
+	if err != nil {
+		metrics.IncrCounter([]string{metricsPrefix, "kv", operation, "errors"}, 1)
+	}
+}
+
+// Count a cas which was not applied as the key had been changed
+func countCASConflict() {
+	metrics.IncrCounter([]string{metricsPrefix, "kv", "cas", "conflicts"}, 1)
+}
+
+// Record the time an event waited in the buffer of a listener
+//  kind:		the kind of listener i.e. key, node, event or watch
+//  queued:		the time the event was queued
+func measureListenerLag(kind string, queued time.Time) {
+	metrics.MeasureSince([]string{metricsPrefix, "listener", kind, "lag"}, queued)
+}
+
+// Count an event dropped as the buffer of a listener was full
+//  kind:		the kind of listener i.e. key, node, event or watch
+func countListenerDrop(kind string) {
+	metrics.IncrCounter([]string{metricsPrefix, "listener", kind, "dropped"}, 1)
+}
+
+// Emit the number of members in each status
+//  nodes:		the members of the cluster
+func emitMemberCounts(nodes []*Node) {
+	counts := make(map[NodeStatus]int, len(memberStatuses))
+	for _, node := range nodes {
+		counts[node.Status]++
+	}
+	for _, status := range memberStatuses {
+		metrics.SetGauge([]string{metricsPrefix, "members", status.String()}, float32(counts[status]))
+	}
+}
+
+// Count the elections since the last raft term seen. Every election starts a
+// new term, so a change of leader and back between two checks is still counted,
+// as is a leader elected again after losing touch with the others
+//  previous:	the last raft term seen, zero if none
+//  term:		the current raft term, zero if unknown
+func countLeaderChange(previous, term uint64) uint64 {
+	if term == 0 {
+		return previous
+	}
+	if previous != 0 && term > previous {
+		metrics.IncrCounter([]string{metricsPrefix, "leader", "changes"}, float32(term-previous))
+	}
+	return term
+}
+
+// Emit the last index applied to the store, from the raft stats of the agent
+func (r *ConsulDistroStore) emitRaftMetrics() {
+	stats, found := r.consulAgent().Stats()["raft"]
+	if !found {
+		return
+	}
+	if index, err := strconv.ParseUint(stats["applied_index"], 10, 64); err == nil {
+		metrics.SetGauge([]string{metricsPrefix, "raft", "applied_index"}, float32(index))
+	}
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package metrics exports the metrics of a store to prometheus. The store emits
+them to the global go-metrics sink, alongside the embedded consul, raft, serf
+and memberlist, so the Collector is installed as that sink and bridges them:
+
+	collector := metrics.NewCollector()
+	if err := collector.Install(); err != nil {
+		...
+	}
+	prometheus.MustRegister(collector)
+	// or serve them on their own
+	http.Handle("/metrics", collector.Handler())
+
+The operations on the keys, the listeners, the membership, the leader changes,
+raft and gossip have their own metrics; anything else consul emits is kept under
+distrostore_consul_counter_total, distrostore_consul_gauge and
+distrostore_consul_sample, labelled by the go-metrics name.
+*/
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	gometrics "github.com/armon/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// the namespace of the prometheus metrics
+	namespace = "distrostore"
+)
+
+// the buckets for the latencies, in seconds
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Collector is a prometheus.Collector for the metrics of the store and the
+// embedded consul, which it receives as a go-metrics sink
+type Collector struct {
+	// the latency of the operations on the keys, by operation
+	kvDuration *prometheus.HistogramVec
+	// the failed operations on the keys, by operation
+	kvErrors *prometheus.CounterVec
+	// the cas which lost to another change
+	casConflicts prometheus.Counter
+	// the time the events waited for the listeners, by kind of listener
+	listenerLag *prometheus.HistogramVec
+	// the events dropped by the listeners, by kind of listener
+	listenerDropped *prometheus.CounterVec
+	// the members of the cluster, by status
+	members *prometheus.GaugeVec
+	// the elections seen by the node, from the raft term
+	leaderChanges prometheus.Counter
+	// the last index applied to the store
+	appliedIndex prometheus.Gauge
+	// the time taken to commit the raft log entries
+	raftCommit prometheus.Histogram
+	// the time since the leader last heard from the followers
+	raftLastContact prometheus.Histogram
+	// the time taken by each round of gossip
+	gossipDuration prometheus.Histogram
+	// the membership events seen by serf, by event
+	memberEvents *prometheus.CounterVec
+	// the other counters, gauges and samples from consul, by name
+	counters *prometheus.CounterVec
+	gauges   *prometheus.GaugeVec
+	samples  *prometheus.SummaryVec
+	// the registry used by the handler, created on first use
+	registry *prometheus.Registry
+	// guards the registry
+	registry_lock sync.Mutex
+}
+
+// NewCollector creates a collector, which receives nothing until it has been
+// installed as the go-metrics sink
+func NewCollector() *Collector {
+	return &Collector{
+		kvDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "kv", Name: "duration_seconds",
+			Help: "The latency of the operations on the keys", Buckets: latencyBuckets,
+		}, []string{"operation"}),
+		kvErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "kv", Name: "errors_total",
+			Help: "The operations on the keys which failed",
+		}, []string{"operation"}),
+		casConflicts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "kv", Name: "cas_conflicts_total",
+			Help: "The compare and sets not applied as the key had been changed",
+		}),
+		listenerLag: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "listener", Name: "lag_seconds",
+			Help: "The time the events waited for the listeners and watches", Buckets: latencyBuckets,
+		}, []string{"listener"}),
+		listenerDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "listener", Name: "dropped_total",
+			Help: "The events dropped as the buffer of the listener was full",
+		}, []string{"listener"}),
+		members: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "members",
+			Help: "The members of the cluster by status",
+		}, []string{"status"}),
+		leaderChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "leader_changes_total",
+			Help: "The elections seen by the node, from the raft term",
+		}),
+		appliedIndex: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "raft", Name: "applied_index",
+			Help: "The last index applied to the store",
+		}),
+		raftCommit: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "raft", Name: "commit_duration_seconds",
+			Help: "The time taken to commit the raft log entries, on the leader", Buckets: latencyBuckets,
+		}),
+		raftLastContact: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "raft", Name: "last_contact_seconds",
+			Help: "The time since the leader last heard from a follower", Buckets: latencyBuckets,
+		}),
+		gossipDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "gossip", Name: "duration_seconds",
+			Help: "The time taken by each round of gossip", Buckets: latencyBuckets,
+		}),
+		memberEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "gossip", Name: "member_events_total",
+			Help: "The membership events seen by serf i.e. join, failed, left, flap",
+		}, []string{"event"}),
+		counters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "consul", Name: "counter_total",
+			Help: "The other counters emitted by consul, by the go-metrics name",
+		}, []string{"name"}),
+		gauges: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "consul", Name: "gauge",
+			Help: "The other gauges emitted by consul, by the go-metrics name",
+		}, []string{"name"}),
+		samples: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: namespace, Subsystem: "consul", Name: "sample",
+			Help:       "The other samples emitted by consul, by the go-metrics name, timings are in milliseconds",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}, []string{"name"}),
+	}
+}
+
+// Install the collector as the global go-metrics sink, which the store and the
+// embedded consul emit to; the hostname is left out of the names and the runtime
+// metrics are left to prometheus. To keep another sink as well, install the two
+// in a go-metrics FanoutSink with an empty service name instead
+func (c *Collector) Install() error {
+	config := gometrics.DefaultConfig("")
+	config.EnableHostname = false
+	config.EnableRuntimeMetrics = false
+	_, err := gometrics.NewGlobal(config, c)
+	return err
+}
+
+// Handler serves the metrics of the collector, i.e. on /metrics, for when they
+// are not registered with the default prometheus registry
+func (c *Collector) Handler() http.Handler {
+	c.registry_lock.Lock()
+	defer c.registry_lock.Unlock()
+	if c.registry == nil {
+		c.registry = prometheus.NewRegistry()
+		c.registry.MustRegister(c)
+	}
+	return promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{})
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.kvDuration, c.kvErrors, c.casConflicts, c.listenerLag, c.listenerDropped,
+		c.members, c.leaderChanges, c.appliedIndex, c.raftCommit, c.raftLastContact,
+		c.gossipDuration, c.memberEvents, c.counters, c.gauges, c.samples,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// SetGauge implements the go-metrics sink
+func (c *Collector) SetGauge(key []string, value float32) {
+	switch {
+	case matches(key, "distrostore", "members", "*"):
+		c.members.WithLabelValues(key[2]).Set(float64(value))
+	case matches(key, "distrostore", "raft", "applied_index"):
+		c.appliedIndex.Set(float64(value))
+	default:
+		c.gauges.WithLabelValues(strings.Join(key, ".")).Set(float64(value))
+	}
+}
+
+// EmitKey implements the go-metrics sink, the keys have no prometheus equivalent
+func (c *Collector) EmitKey(key []string, value float32) {}
+
+// IncrCounter implements the go-metrics sink
+func (c *Collector) IncrCounter(key []string, value float32) {
+	switch {
+	case matches(key, "distrostore", "kv", "cas", "conflicts"):
+		c.casConflicts.Add(float64(value))
+	case matches(key, "distrostore", "kv", "*", "errors"):
+		c.kvErrors.WithLabelValues(key[2]).Add(float64(value))
+	case matches(key, "distrostore", "listener", "*", "dropped"):
+		c.listenerDropped.WithLabelValues(key[2]).Add(float64(value))
+	case matches(key, "distrostore", "leader", "changes"):
+		c.leaderChanges.Add(float64(value))
+	case matches(key, "serf", "member", "*"):
+		c.memberEvents.WithLabelValues(key[2]).Add(float64(value))
+	default:
+		c.counters.WithLabelValues(strings.Join(key, ".")).Add(float64(value))
+	}
+}
+
+// AddSample implements the go-metrics sink, the timings are in milliseconds
+func (c *Collector) AddSample(key []string, value float32) {
+	seconds := float64(value) / 1000
+	switch {
+	case matches(key, "distrostore", "kv", "*"):
+		c.kvDuration.WithLabelValues(key[2]).Observe(seconds)
+	case matches(key, "distrostore", "listener", "*", "lag"):
+		c.listenerLag.WithLabelValues(key[2]).Observe(seconds)
+	case matches(key, "raft", "commitTime"):
+		c.raftCommit.Observe(seconds)
+	case matches(key, "raft", "leader", "lastContact"):
+		c.raftLastContact.Observe(seconds)
+	case matches(key, "memberlist", "gossip"):
+		c.gossipDuration.Observe(seconds)
+	default:
+		c.samples.WithLabelValues(strings.Join(key, ".")).Observe(float64(value))
+	}
+}
+
+// SetGaugeWithLabels implements the labelled go-metrics sink, consul does not
+// label its metrics so the labels are dropped
+func (c *Collector) SetGaugeWithLabels(key []string, value float32, labels []gometrics.Label) {
+	c.SetGauge(key, value)
+}
+
+// IncrCounterWithLabels implements the labelled go-metrics sink
+func (c *Collector) IncrCounterWithLabels(key []string, value float32, labels []gometrics.Label) {
+	c.IncrCounter(key, value)
+}
+
+// AddSampleWithLabels implements the labelled go-metrics sink
+func (c *Collector) AddSampleWithLabels(key []string, value float32, labels []gometrics.Label) {
+	c.AddSample(key, value)
+}
+
+// Check the key against a pattern, where a "*" matches any one part
+//  key:		the go-metrics key
+//  pattern:	the parts to match
+func matches(key []string, pattern ...string) bool {
+	if len(key) != len(pattern) {
+		return false
+	}
+	for i, part := range pattern {
+		if part != "*" && part != key[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatches(t *testing.T) {
+	assert.True(t, matches([]string{"distrostore", "kv", "get"}, "distrostore", "kv", "*"))
+	assert.False(t, matches([]string{"distrostore", "kv", "get", "errors"}, "distrostore", "kv", "*"))
+	assert.False(t, matches([]string{"raft", "commitTime"}, "raft", "leader", "lastContact"))
+}
+
+func TestCollector(t *testing.T) {
+	collector := NewCollector()
+	collector.AddSample([]string{"distrostore", "kv", "get"}, 2)
+	collector.IncrCounter([]string{"distrostore", "kv", "set", "errors"}, 1)
+	collector.IncrCounter([]string{"distrostore", "kv", "cas", "conflicts"}, 1)
+	collector.AddSample([]string{"distrostore", "listener", "watch", "lag"}, 15)
+	collector.IncrCounter([]string{"distrostore", "listener", "key", "dropped"}, 3)
+	collector.SetGauge([]string{"distrostore", "members", "alive"}, 3)
+	collector.SetGauge([]string{"distrostore", "members", "failed"}, 1)
+	collector.IncrCounter([]string{"distrostore", "leader", "changes"}, 1)
+	collector.SetGauge([]string{"distrostore", "raft", "applied_index"}, 42)
+	collector.AddSample([]string{"raft", "commitTime"}, 4)
+	collector.AddSample([]string{"memberlist", "gossip"}, 1)
+	collector.IncrCounter([]string{"serf", "member", "join"}, 1)
+	collector.IncrCounter([]string{"consul", "kvs", "apply"}, 1)
+
+	recorder := httptest.NewRecorder()
+	collector.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`distrostore_kv_duration_seconds_count{operation="get"} 1`,
+		`distrostore_kv_duration_seconds_sum{operation="get"} 0.002`,
+		`distrostore_kv_errors_total{operation="set"} 1`,
+		`distrostore_kv_cas_conflicts_total 1`,
+		`distrostore_listener_lag_seconds_count{listener="watch"} 1`,
+		`distrostore_listener_dropped_total{listener="key"} 3`,
+		`distrostore_members{status="alive"} 3`,
+		`distrostore_members{status="failed"} 1`,
+		`distrostore_leader_changes_total 1`,
+		`distrostore_raft_applied_index 42`,
+		`distrostore_raft_commit_duration_seconds_count 1`,
+		`distrostore_gossip_duration_seconds_count 1`,
+		`distrostore_gossip_member_events_total{event="join"} 1`,
+		`distrostore_consul_counter_total{name="consul.kvs.apply"} 1`,
+	} {
+		assert.Contains(t, body, expected)
+	}
+}
+
+func TestCollectorInstall(t *testing.T) {
+	collector := NewCollector()
+	err := collector.Install()
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	gometrics.MeasureSince([]string{"raft", "commitTime"}, time.Now())
+	gometrics.SetGauge([]string{"distrostore", "raft", "applied_index"}, 7)
+
+	recorder := httptest.NewRecorder()
+	collector.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, recorder.Body.String(), "distrostore_raft_commit_duration_seconds_count 1")
+	assert.Contains(t, recorder.Body.String(), "distrostore_raft_applied_index 7")
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMetricsSink(t *testing.T) *metrics.InmemSink {
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	config := metrics.DefaultConfig("")
+	config.EnableHostname = false
+	config.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(config, sink)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	return sink
+}
+
+func TestCountLeaderChange(t *testing.T) {
+	sink := newTestMetricsSink(t)
+	nodes := []*Node{{ID: "node1", Status: NodeAlive, Leader: true}, {ID: "node2", Status: NodeFailed}}
+	term := countLeaderChange(0, 2)
+	assert.Equal(t, uint64(2), term, "the first term seen is not a change")
+	term = countLeaderChange(term, 0)
+	assert.Equal(t, uint64(2), term, "an unknown term should keep the last one")
+	// step: a change of leader and back between two checks is two elections
+	term = countLeaderChange(term, 4)
+	assert.Equal(t, uint64(4), term)
+	emitMemberCounts(nodes)
+
+	data := sink.Data()
+	if assert.NotEmpty(t, data) {
+		assert.Equal(t, float64(2), data[0].Counters["distrostore.leader.changes"].Sum)
+		assert.Equal(t, float32(1), data[0].Gauges["distrostore.members.alive"].Value)
+		assert.Equal(t, float32(1), data[0].Gauges["distrostore.members.failed"].Value)
+		assert.Equal(t, float32(0), data[0].Gauges["distrostore.members.left"].Value)
+	}
+}
+
+func TestListenerMetrics(t *testing.T) {
+	sink := newTestMetricsSink(t)
+	d := newDispatcher("key")
+	channel := make(chan *KeyAPIEvent)
+	d.add(channel, 1, DropNewest, keyChannelDeliver(channel), nil)
+	defer d.close(nil)
+	// step: the first is taken by the delivery goroutine, the second buffered and the third dropped
+	for i := 0; i < 3; i++ {
+		d.publish(&KeyAPIEvent{Key: "a"})
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	<-channel
+	<-channel
+
+	data := sink.Data()
+	if assert.NotEmpty(t, data) {
+		assert.Equal(t, 1, data[0].Counters["distrostore.listener.key.dropped"].Count)
+		assert.True(t, data[0].Samples["distrostore.listener.key.lag"].Count >= 1, "the delivered events should be measured")
+	}
+}
@@ -13,7 +13,89 @@ limitations under the License.
 
 package distrostore
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// the tag is used internally by the cluster and can't be set
+	ErrReservedNodeTag = errors.New("The node tag is reserved for use by the cluster")
+)
+
+// the tags set by consul itself which can't be overridden
+var reservedNodeTags = map[string]bool{
+	"role":      true,
+	"dc":        true,
+	"port":      true,
+	"vsn":       true,
+	"vsn_min":   true,
+	"vsn_max":   true,
+	"build":     true,
+	"bootstrap": true,
+	"expect":    true,
+}
+
+// Check the tags don't include any of the reserved ones
+//  tags:		the application tags for the node
+func validateNodeTags(tags map[string]string) error {
+	for key := range tags {
+		if reservedNodeTags[key] {
+			return fmt.Errorf("%s: %s", ErrReservedNodeTag, key)
+		}
+	}
+	return nil
+}
+
+// the membership status of a node
+type NodeStatus int
+
+const (
+	// the node is a healthy member of the cluster
+	NodeAlive NodeStatus = iota + 1
+	// the node is in the process of leaving
+	NodeLeaving
+	// the node has gracefully left the cluster
+	NodeLeft
+	// the node has stopped responding
+	NodeFailed
+)
+
+func (s NodeStatus) String() string {
+	switch s {
+	case NodeAlive:
+		return "alive"
+	case NodeLeaving:
+		return "leaving"
+	case NodeLeft:
+		return "left"
+	case NodeFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// the role the node plays in the cluster
+type NodeRole int
+
+const (
+	// the node takes part in the raft consensus
+	NodeServer NodeRole = iota + 1
+	// the node forwards requests onto the servers
+	NodeClient
+)
+
+func (r NodeRole) String() string {
+	switch r {
+	case NodeServer:
+		return "server"
+	case NodeClient:
+		return "client"
+	default:
+		return "unknown"
+	}
+}
 
 // a structure for defining a node
 type Node struct {
@@ -23,8 +105,47 @@ type Node struct {
 	Address string
 	// the port the node is running on
 	Port int
+	// the membership status of the node
+	Status NodeStatus
+	// whether the node is a server or client
+	Role NodeRole
+	// the datacenter the node is in
+	Datacenter string
+	// the serf tags advertised by the node, consul's own and the NodeTags it started with
+	Tags map[string]string
+	// the build version of the node
+	Build string
+	// the consul protocol version spoken by the node
+	Protocol int
+	// whether the node is the current raft leader
+	Leader bool
 }
 
 func (n Node) String() string {
-	return fmt.Sprintf("id: %s, node: %s:%d", n.ID, n.Address, n.Port)
+	return fmt.Sprintf("id: %s, node: %s:%d, status: %s, role: %s, leader: %t",
+		n.ID, n.Address, n.Port, n.Status, n.Role, n.Leader)
+}
+
+// Check if the node is an alive member of the cluster
+func (n Node) IsAlive() bool {
+	return n.Status == NodeAlive
+}
+
+// Check if anything other than the status has changed between the nodes
+//  other:		the node to compare against
+func (n Node) changed(other *Node) bool {
+	if n.Address != other.Address || n.Port != other.Port || n.Role != other.Role ||
+		n.Datacenter != other.Datacenter || n.Build != other.Build ||
+		n.Protocol != other.Protocol || n.Leader != other.Leader {
+		return true
+	}
+	if len(n.Tags) != len(other.Tags) {
+		return true
+	}
+	for key, value := range n.Tags {
+		if current, found := other.Tags[key]; !found || current != value {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,36 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateNodeTags(t *testing.T) {
+	assert.Nil(t, validateNodeTags(nil))
+	assert.Nil(t, validateNodeTags(map[string]string{"zone": "eu-west-1a", "shards": "1,2"}))
+	assert.NotNil(t, validateNodeTags(map[string]string{"role": "primary"}), "role is reserved by consul")
+}
+
+func TestNodeChanged(t *testing.T) {
+	node := Node{ID: "test1", Status: NodeAlive, Tags: map[string]string{"zone": "a"}}
+	assert.False(t, node.changed(&Node{ID: "test1", Status: NodeFailed, Tags: map[string]string{"zone": "a"}}),
+		"a status change is not a change to the node")
+	assert.True(t, node.changed(&Node{ID: "test1", Status: NodeAlive, Tags: map[string]string{"zone": "b"}}),
+		"the tags have changed")
+	assert.True(t, node.changed(&Node{ID: "test1", Status: NodeAlive, Leader: true, Tags: map[string]string{"zone": "a"}}),
+		"the leadership has changed")
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// the embedded consul has no api for making or answering serf queries
+	ErrQueryUnsupported = errors.New("Queries are not supported by the embedded consul, its agent does not expose serf queries")
+)
+
+// a handler for the queries of a given name
+//  payload:	the payload of the query
+type QueryHandler func(payload []byte) ([]byte, error)
+
+// the options for a query
+type QueryOptions struct {
+	// the names of the nodes which should respond, empty for all of them
+	FilterNodes []string
+	// the tags a node must have to respond, the values are regular expressions
+	FilterTags map[string]string
+	// how long to wait for the responses
+	Timeout time.Duration
+	// ask the nodes to acknowledge they have recieved the query
+	RequestAck bool
+}
+
+// a response from a node to a query
+type NodeResponse struct {
+	// the name of the node which responded
+	From string
+	// the payload of the response
+	Payload []byte
+	// the error returned by the handler, if any
+	Error string
+}
+
+func (n NodeResponse) String() string {
+	return fmt.Sprintf("from: %s, size: %d, error: %s", n.From, len(n.Payload), n.Error)
+}
+
+// the stream of acks and responses to a query
+type QueryResponse struct {
+	// the acks from the nodes, nil if they were not requested
+	acks chan string
+	// the responses from the nodes
+	responses chan NodeResponse
+}
+
+// The channel of the nodes which have acknowledged the query
+func (q *QueryResponse) AckCh() <-chan string {
+	return q.acks
+}
+
+// The channel of the responses from the nodes
+func (q *QueryResponse) ResponseCh() <-chan NodeResponse {
+	return q.responses
+}
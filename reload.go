@@ -0,0 +1,149 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"reflect"
+	"strings"
+)
+
+// the settings of the context which Reload can change on a running node
+var reloadableFields = map[string]bool{
+	"LogLevel":             true,
+	"Members":              true,
+	"ACLToken":             true,
+	"Snapshots.Interval":   true,
+	"Snapshots.Dir":        true,
+	"Snapshots.Retain":     true,
+	"Snapshots.LeaderOnly": true,
+	"Snapshots.Compress":   true,
+	"TLS.CAFile":           true,
+	"TLS.CertFile":         true,
+	"TLS.KeyFile":          true,
+	"TLS.VerifyIncoming":   true,
+	"TLS.VerifyOutgoing":   true,
+}
+
+// Returned by Reload when settings were changed which only take effect once the
+// node is restarted; the settings which can be changed live have been applied
+type RestartRequiredError struct {
+	// the settings which need a restart i.e. BindAddress, PortsConfig.Server
+	Fields []string
+}
+
+func (e *RestartRequiredError) Error() string {
+	return "The settings can only be changed with a restart: " + strings.Join(e.Fields, ", ")
+}
+
+// Work out the settings which differ between the contexts, nested settings are
+// dotted i.e. PortsConfig.HTTP; an empty list or map is the same as a nil one,
+// and a zero port the same as the port allocated for it
+//  current:	the context the node is running with
+//  updated:	the new context
+func diffContext(current, updated *Context) []string {
+	return diffFields("", reflect.ValueOf(current).Elem(), reflect.ValueOf(updated).Elem())
+}
+
+func diffFields(prefix string, current, updated reflect.Value) []string {
+	changed := make([]string, 0)
+	for i := 0; i < current.NumField(); i++ {
+		name := prefix + current.Type().Field(i).Name
+		before, after := current.Field(i), updated.Field(i)
+		switch before.Kind() {
+		case reflect.Struct:
+			changed = append(changed, diffFields(name+".", before, after)...)
+			continue
+		case reflect.Slice, reflect.Map:
+			if before.Len() == 0 && after.Len() == 0 {
+				continue
+			}
+		case reflect.Int:
+			// step: a zero port is allocated on startup, so it matches the port in use
+			if strings.HasPrefix(name, "PortsConfig.") && after.Int() == 0 {
+				continue
+			}
+		}
+		if !reflect.DeepEqual(before.Interface(), after.Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Split the changed settings into those applied live and those needing a restart
+//  changed:	the settings which differ
+func splitReloadable(changed []string) (map[string]bool, []string) {
+	live := make(map[string]bool, 0)
+	restart := make([]string, 0)
+	for _, name := range changed {
+		if reloadableFields[name] {
+			live[name] = true
+			continue
+		}
+		restart = append(restart, name)
+	}
+	return live, restart
+}
+
+// Check if any of the snapshot settings are in the changes
+//  live:		the settings changed live
+func snapshotsChanged(live map[string]bool) bool {
+	for name := range live {
+		if strings.HasPrefix(name, "Snapshots.") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the settings in a context which can be reloaded
+//  cfg:		the new context
+func validateReload(cfg *Context) error {
+	if cfg == nil {
+		return ErrInvalidConfig
+	}
+	if _, err := logLevelIndex(cfg.LogLevel); err != nil {
+		return err
+	}
+	if err := validateNodeTags(cfg.NodeTags); err != nil {
+		return err
+	}
+	return validateSnapshotConfig(&cfg.Snapshots)
+}
+
+// The members in the new list which were not in the old one
+//  current:	the members the node started with, or was last reloaded with
+//  updated:	the new members
+func addedMembers(current, updated []string) []string {
+	known := make(map[string]bool, len(current))
+	for _, member := range current {
+		known[member] = true
+	}
+	added := make([]string, 0)
+	for _, member := range updated {
+		if !known[member] {
+			added = append(added, member)
+		}
+	}
+	return added
+}
+
+// The result of a reload, a RestartRequiredError if any of the settings need a restart
+//  restart:	the settings which need a restart
+func reloadResult(restart []string) error {
+	if len(restart) > 0 {
+		return &RestartRequiredError{Fields: restart}
+	}
+	return nil
+}
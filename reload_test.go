@@ -0,0 +1,113 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffContext(t *testing.T) {
+	current := DefaultContext()
+	updated := DefaultContext()
+	updated.NodeTags = map[string]string{}
+	updated.PortsConfig.HTTP = 0
+	assert.Empty(t, diffContext(current, updated), "an empty map and an allocated port should not be changes")
+
+	updated.BindAddress = "10.0.0.1"
+	updated.PortsConfig.Server = 9300
+	updated.TLS.CertFile = "/etc/cert.pem"
+	updated.Snapshots.Retain = 10
+	updated.Members = []string{"10.0.0.2:8301"}
+	changed := diffContext(current, updated)
+	assert.Equal(t, []string{"Members", "BindAddress", "PortsConfig.Server", "Snapshots.Retain", "TLS.CertFile"}, changed)
+
+	live, restart := splitReloadable(changed)
+	assert.True(t, live["Members"])
+	assert.True(t, live["TLS.CertFile"], "the tls settings should be reloaded live")
+	assert.True(t, snapshotsChanged(live))
+	assert.Equal(t, []string{"BindAddress", "PortsConfig.Server"}, restart)
+	assert.Equal(t, []string{"10.0.0.3:8301"}, addedMembers([]string{"10.0.0.2:8301"}, []string{"10.0.0.2:8301", "10.0.0.3:8301"}))
+}
+
+func TestTLSDigest(t *testing.T) {
+	cert := filepath.Join(newTestSnapshotDir(t), "cert.pem")
+	assert.Nil(t, ioutil.WriteFile(cert, []byte("first"), 0600))
+	config := &TLSConfig{CertFile: cert, KeyFile: cert}
+	first, err := tlsDigest(config)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+
+	// step: a certificate replaced under the same path should change the digest
+	assert.Nil(t, ioutil.WriteFile(cert, []byte("second"), 0600))
+	second, err := tlsDigest(config)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.NotEqual(t, first, second, "the digest should cover the contents of the files")
+
+	assert.NotNil(t, validateTLS(config), "a file which isn't a certificate should be rejected")
+	assert.NotNil(t, validateTLS(&TLSConfig{CAFile: cert}), "a file which isn't a certificate authority should be rejected")
+	assert.Nil(t, validateTLS(&TLSConfig{}))
+	_, err = tlsDigest(&TLSConfig{CAFile: "/does/not/exist.pem"})
+	assert.NotNil(t, err, "a missing file should be an error")
+}
+
+func TestLevelWriter(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	writer, err := newLevelWriter(buffer, nil, "")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	writer.Write([]byte("2015/03/16 14:28:12 [DEBUG] raft: hidden\n"))
+	writer.Write([]byte("2015/03/16 14:28:12 [INFO] raft: shown\n"))
+	writer.Write([]byte("no level is always shown\n"))
+	assert.Equal(t, "2015/03/16 14:28:12 [INFO] raft: shown\nno level is always shown\n", buffer.String())
+
+	assert.Nil(t, writer.SetLevel("debug"))
+	writer.Write([]byte("[DEBUG] raft: now shown\n"))
+	assert.Contains(t, buffer.String(), "now shown")
+	assert.Equal(t, ErrInvalidLogLevel, writer.SetLevel("LOUD"))
+	_, err = newLevelWriter(buffer, nil, "LOUD")
+	assert.Equal(t, ErrInvalidLogLevel, err)
+}
+
+func TestMemoryReload(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	updated := *store.Config()
+	updated.Members = []string{"10.0.0.2:8301"}
+	updated.Snapshots = SnapshotConfig{Interval: time.Duration(20) * time.Millisecond, Dir: newTestSnapshotDir(t)}
+	updated.BindAddress = "10.0.0.1"
+	err := store.Reload(&updated)
+	if restart, ok := err.(*RestartRequiredError); assert.True(t, ok, "we should recieve a restart error: %v", err) {
+		assert.Equal(t, []string{"BindAddress"}, restart.Fields)
+		assert.Contains(t, restart.Error(), "BindAddress")
+	}
+	nodes, _ := store.Nodes()
+	assert.Equal(t, 2, len(nodes), "the new member should have been joined")
+
+	// step: the snapshots were disabled, the reload should have started them
+	deadline := time.Now().Add(time.Second)
+	for store.SnapshotStatus().LastSuccess.IsZero() && time.Now().Before(deadline) {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	assert.False(t, store.SnapshotStatus().LastSuccess.IsZero(), "a snapshot should have been taken")
+
+	// step: a second reload with the same settings changes nothing live
+	updated.BindAddress = store.Config().BindAddress
+	assert.Nil(t, store.Reload(&updated))
+	nodes, _ = store.Nodes()
+	assert.Equal(t, 2, len(nodes))
+}
@@ -0,0 +1,354 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// the prefix of the tags used to carry the service metadata
+	serviceMetaPrefix = "_meta:"
+	// the default interval between the checks we run
+	DEFAULT_CHECK_INTERVAL = (time.Duration(10) * time.Second)
+	// the default time we wait on a check we run
+	DEFAULT_CHECK_TIMEOUT = (time.Duration(5) * time.Second)
+)
+
+var (
+	// the service is missing a name or carries invalid metadata
+	ErrInvalidService = errors.New("The service must have a name and metadata keys without '='")
+	// the health check is missing the settings for its kind
+	ErrInvalidCheck = errors.New("The health check is missing the settings required by its kind")
+)
+
+// a service provided by the application on this node
+type Service struct {
+	// the id of the service, defaults to the name
+	ID string
+	// the name of the service
+	Name string
+	// the tags for the service
+	Tags []string
+	// the address of the service, defaults to the address of the node
+	Address string
+	// the port the service is listening on
+	Port int
+	// any metadata for the service
+	Meta map[string]string
+}
+
+func (s Service) String() string {
+	return fmt.Sprintf("id: %s, name: %s, address: %s, port: %d, tags: %v", s.ID, s.Name, s.Address, s.Port, s.Tags)
+}
+
+// the kind of health check
+type CheckKind int
+
+const (
+	// a check the application must report on before the ttl expires
+	CheckTTL CheckKind = iota
+	// a check which consul makes against a http endpoint
+	CheckHTTP
+	// a check which the store makes by connecting to a tcp endpoint
+	CheckTCP
+	// a check which the store makes by calling a function
+	CheckFunc
+)
+
+func (c CheckKind) String() string {
+	switch c {
+	case CheckTTL:
+		return "ttl"
+	case CheckHTTP:
+		return "http"
+	case CheckTCP:
+		return "tcp"
+	case CheckFunc:
+		return "func"
+	}
+	return "unknown"
+}
+
+// a health check on a service
+type ServiceCheck struct {
+	// the kind of check
+	Kind CheckKind
+	// the name of the check
+	Name string
+	// the time the application has to report in, for ttl checks
+	TTL time.Duration
+	// the url to check, for http checks
+	HTTP string
+	// the address to connect to, for tcp checks
+	TCP string
+	// the function to call, for func checks
+	Func func() error
+	// the interval between the checks
+	Interval time.Duration
+	// the time we wait on the check
+	Timeout time.Duration
+}
+
+// the health status of a service
+type HealthStatus string
+
+const (
+	HealthPassing  HealthStatus = "passing"
+	HealthWarning  HealthStatus = "warning"
+	HealthCritical HealthStatus = "critical"
+)
+
+// a handle on a health check, used to report on ttl checks
+type CheckHandle struct {
+	// the id of the check
+	ID string
+	// updates the status of the check in the backend
+	update func(status HealthStatus, note string) error
+}
+
+// Mark the check as passing
+//  note:		a note to go with the status
+func (c *CheckHandle) Pass(note string) error {
+	return c.update(HealthPassing, note)
+}
+
+// Mark the check as warning
+//  note:		a note to go with the status
+func (c *CheckHandle) Warn(note string) error {
+	return c.update(HealthWarning, note)
+}
+
+// Mark the check as failing
+//  note:		a note to go with the status
+func (c *CheckHandle) Fail(note string) error {
+	return c.update(HealthCritical, note)
+}
+
+// an instance of a service in the cluster
+type ServiceInstance struct {
+	// the name of the node providing the service
+	Node string
+	// the service, the address is filled in from the node if not set
+	Service *Service
+	// the worst status of the checks on the service
+	Status HealthStatus
+}
+
+func (s ServiceInstance) String() string {
+	return fmt.Sprintf("node: %s, status: %s, %s", s.Node, s.Status, s.Service)
+}
+
+// Check the service can be registered, returning a copy with the id filled in
+// if required; the caller's service is left as it is
+//  service:	the service to validate
+func validateService(service *Service) (*Service, error) {
+	if service == nil || service.Name == "" {
+		return nil, ErrInvalidService
+	}
+	for key := range service.Meta {
+		if key == "" || strings.Contains(key, "=") {
+			return nil, ErrInvalidService
+		}
+	}
+	validated := *service
+	validated.Tags = append([]string{}, service.Tags...)
+	validated.Meta = copyTags(service.Meta)
+	if validated.ID == "" {
+		validated.ID = validated.Name
+	}
+	return &validated, nil
+}
+
+// Check the health check has the settings required by its kind
+//  check:		the check to validate
+func validateCheck(check *ServiceCheck) error {
+	if check == nil {
+		return ErrInvalidCheck
+	}
+	switch check.Kind {
+	case CheckTTL:
+		if check.TTL <= 0 {
+			return ErrInvalidCheck
+		}
+	case CheckHTTP:
+		if check.HTTP == "" {
+			return ErrInvalidCheck
+		}
+	case CheckTCP:
+		if check.TCP == "" {
+			return ErrInvalidCheck
+		}
+	case CheckFunc:
+		if check.Func == nil {
+			return ErrInvalidCheck
+		}
+	default:
+		return ErrInvalidCheck
+	}
+	return nil
+}
+
+// Fill in the interval and timeout of the check
+//  check:		the check to fill in
+func checkTimings(check *ServiceCheck) (time.Duration, time.Duration) {
+	interval := check.Interval
+	if interval <= 0 {
+		interval = DEFAULT_CHECK_INTERVAL
+	}
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_CHECK_TIMEOUT
+	}
+	if timeout > interval {
+		timeout = interval
+	}
+	return interval, timeout
+}
+
+// Encode the service tags and metadata into the tags we register with consul
+//  service:	the service being registered
+func encodeServiceTags(service *Service) []string {
+	tags := make([]string, 0, len(service.Tags)+len(service.Meta))
+	tags = append(tags, service.Tags...)
+	for key, value := range service.Meta {
+		tags = append(tags, serviceMetaPrefix+key+"="+value)
+	}
+	return tags
+}
+
+// Decode the tags registered with consul back into the tags and metadata
+//  tags:		the tags from consul
+func decodeServiceTags(tags []string) ([]string, map[string]string) {
+	list := make([]string, 0, len(tags))
+	meta := make(map[string]string, 0)
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, serviceMetaPrefix) {
+			list = append(list, tag)
+			continue
+		}
+		items := strings.SplitN(strings.TrimPrefix(tag, serviceMetaPrefix), "=", 2)
+		if len(items) != 2 {
+			list = append(list, tag)
+			continue
+		}
+		meta[items[0]] = items[1]
+	}
+	return list, meta
+}
+
+// Work out the worst status from the statuses of the checks
+//  statuses:	the status of each check
+func worstHealthStatus(statuses []string) HealthStatus {
+	status := HealthPassing
+	for _, check := range statuses {
+		switch HealthStatus(check) {
+		case HealthPassing:
+		case HealthWarning:
+			if status == HealthPassing {
+				status = HealthWarning
+			}
+		default:
+			return HealthCritical
+		}
+	}
+	return status
+}
+
+// Run a http, tcp or func check once
+//  check:		the check to run
+//  timeout:	the time we wait on the check
+func probeCheck(check *ServiceCheck, timeout time.Duration) error {
+	switch check.Kind {
+	case CheckHTTP:
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(check.HTTP)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("the check returned status: %s", resp.Status)
+		}
+		return nil
+	case CheckTCP:
+		conn, err := net.DialTimeout("tcp", check.TCP, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case CheckFunc:
+		result := make(chan error, 1)
+		go func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					result <- fmt.Errorf("the check panicked: %v", recovered)
+				}
+			}()
+			result <- check.Func()
+		}()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(timeout):
+			return fmt.Errorf("the check timed out after %s", timeout)
+		}
+	}
+	return ErrInvalidCheck
+}
+
+// a check which the store runs, reporting the result into the backend
+type checkRunner struct {
+	// the check being run
+	check *ServiceCheck
+	// reports the result of the check
+	report func(err error)
+	// closed to stop the runner
+	stopChannel chan struct{}
+}
+
+func newCheckRunner(check *ServiceCheck, report func(err error)) *checkRunner {
+	return &checkRunner{
+		check:       check,
+		report:      report,
+		stopChannel: make(chan struct{}),
+	}
+}
+
+// Run the check until stopped
+//  shutdown:	closed when the store is shutting down
+func (c *checkRunner) run(shutdown chan struct{}) {
+	interval, timeout := checkTimings(c.check)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.report(probeCheck(c.check, timeout))
+		select {
+		case <-c.stopChannel:
+			return
+		case <-shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *checkRunner) stop() {
+	close(c.stopChannel)
+}
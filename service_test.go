@@ -0,0 +1,98 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateService(t *testing.T) {
+	for _, service := range []*Service{nil, {}, {Name: "web", Meta: map[string]string{"a=b": "c"}}} {
+		_, err := validateService(service)
+		assert.Equal(t, ErrInvalidService, err)
+	}
+	service := &Service{Name: "web", Tags: []string{"a"}}
+	validated, err := validateService(service)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, "web", validated.ID, "the id should default to the name")
+	assert.Empty(t, service.ID, "the caller's service should not be changed")
+	validated.Tags[0] = "b"
+	assert.Equal(t, "a", service.Tags[0], "the tags should have been copied")
+}
+
+func TestValidateCheck(t *testing.T) {
+	assert.Equal(t, ErrInvalidCheck, validateCheck(nil))
+	assert.Equal(t, ErrInvalidCheck, validateCheck(&ServiceCheck{Kind: CheckTTL}))
+	assert.Equal(t, ErrInvalidCheck, validateCheck(&ServiceCheck{Kind: CheckHTTP}))
+	assert.Equal(t, ErrInvalidCheck, validateCheck(&ServiceCheck{Kind: CheckTCP}))
+	assert.Equal(t, ErrInvalidCheck, validateCheck(&ServiceCheck{Kind: CheckFunc}))
+	assert.Nil(t, validateCheck(&ServiceCheck{Kind: CheckTTL, TTL: time.Second}))
+	assert.Nil(t, validateCheck(&ServiceCheck{Kind: CheckTCP, TCP: "127.0.0.1:80"}))
+}
+
+func TestServiceTags(t *testing.T) {
+	service := &Service{Name: "web", Tags: []string{"primary"}, Meta: map[string]string{"version": "1.0=rc1"}}
+	tags, meta := decodeServiceTags(encodeServiceTags(service))
+	assert.Equal(t, []string{"primary"}, tags)
+	assert.Equal(t, map[string]string{"version": "1.0=rc1"}, meta)
+}
+
+func TestWorstHealthStatus(t *testing.T) {
+	assert.Equal(t, HealthPassing, worstHealthStatus(nil))
+	assert.Equal(t, HealthWarning, worstHealthStatus([]string{"passing", "warning"}))
+	assert.Equal(t, HealthCritical, worstHealthStatus([]string{"warning", "critical", "passing"}))
+}
+
+func TestProbeCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	address := listener.Addr().String()
+	assert.Nil(t, probeCheck(&ServiceCheck{Kind: CheckTCP, TCP: address}, time.Second))
+	listener.Close()
+	assert.NotNil(t, probeCheck(&ServiceCheck{Kind: CheckTCP, TCP: address}, time.Second))
+
+	assert.Nil(t, probeCheck(&ServiceCheck{Kind: CheckFunc, Func: func() error { return nil }}, time.Second))
+	assert.NotNil(t, probeCheck(&ServiceCheck{Kind: CheckFunc, Func: func() error { return errors.New("down") }}, time.Second))
+	assert.NotNil(t, probeCheck(&ServiceCheck{Kind: CheckFunc, Func: func() error { panic("boom") }}, time.Second))
+	assert.NotNil(t, probeCheck(&ServiceCheck{Kind: CheckFunc, Func: func() error {
+		time.Sleep(time.Second)
+		return nil
+	}}, time.Duration(10)*time.Millisecond), "the check should have timed out")
+}
+
+func TestCheckRunner(t *testing.T) {
+	results := make(chan error, 10)
+	failing := false
+	runner := newCheckRunner(&ServiceCheck{
+		Kind:     CheckFunc,
+		Interval: time.Duration(10) * time.Millisecond,
+		Func: func() error {
+			if failing {
+				return errors.New("down")
+			}
+			failing = true
+			return nil
+		},
+	}, func(err error) { results <- err })
+	shutdown := make(chan struct{})
+	go runner.run(shutdown)
+	assert.Nil(t, <-results, "the first check should pass")
+	assert.NotNil(t, <-results, "the second check should fail")
+	runner.stop()
+}
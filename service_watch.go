@@ -0,0 +1,136 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// the default window changes to a service are gathered over before being passed on
+	DEFAULT_SERVICE_DEBOUNCE = (time.Duration(500) * time.Millisecond)
+)
+
+// a watch on the passing instances of a service
+type ServiceSubscription interface {
+	// the full set of passing instances, sent whenever it changes; only the
+	// latest set is held for a slow consumer
+	Instances() <-chan []*ServiceInstance
+	// stop watching the service, the instances channel is closed
+	Close()
+}
+
+type serviceSubscription struct {
+	// the channel the instances are passed to the consumer on
+	channel chan []*ServiceInstance
+	// the snapshots from the blocking queries
+	updates chan []*ServiceInstance
+	// closed when the watch is stopped
+	stopChannel chan struct{}
+	// ensures we only close once
+	once sync.Once
+	// called once the watch is closed
+	release func()
+}
+
+func newServiceSubscription(release func()) *serviceSubscription {
+	return &serviceSubscription{
+		channel:     make(chan []*ServiceInstance, 1),
+		updates:     make(chan []*ServiceInstance),
+		stopChannel: make(chan struct{}),
+		release:     release,
+	}
+}
+
+func (s *serviceSubscription) Instances() <-chan []*ServiceInstance {
+	return s.channel
+}
+
+func (s *serviceSubscription) Close() {
+	s.once.Do(func() {
+		close(s.stopChannel)
+		if s.release != nil {
+			s.release()
+		}
+	})
+}
+
+// Pass a snapshot from the blocking query to the watch, returns false once stopped
+//  instances:	the passing instances of the service
+func (s *serviceSubscription) update(instances []*ServiceInstance) bool {
+	select {
+	case s.updates <- instances:
+		return true
+	case <-s.stopChannel:
+		return false
+	}
+}
+
+// Gather the snapshots over the debounce window, passing on the latest if it
+// differs from the last one sent
+//  window:		the debounce window
+func (s *serviceSubscription) run(window time.Duration) {
+	defer close(s.channel)
+	var latest, sent []*ServiceInstance
+	var timer <-chan time.Time
+	emitted := false
+	for {
+		select {
+		case <-s.stopChannel:
+			return
+		case latest = <-s.updates:
+			// step: the window starts from the first change, so constant churn can't hold us off
+			if timer == nil {
+				timer = time.After(window)
+			}
+		case <-timer:
+			timer = nil
+			if emitted && reflect.DeepEqual(sent, latest) {
+				continue
+			}
+			sent, emitted = latest, true
+			s.replace(latest)
+		}
+	}
+}
+
+// Send the instances, replacing any the consumer has yet to read
+//  instances:	the passing instances of the service
+func (s *serviceSubscription) replace(instances []*ServiceInstance) {
+	select {
+	case <-s.channel:
+	default:
+	}
+	s.channel <- instances
+}
+
+// Sort the instances so identical sets compare as equal
+//  instances:	the instances to sort
+func sortInstances(instances []*ServiceInstance) {
+	sort.Sort(byInstance(instances))
+}
+
+type byInstance []*ServiceInstance
+
+func (b byInstance) Len() int      { return len(b) }
+func (b byInstance) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byInstance) Less(i, j int) bool {
+	if b[i].Node != b[j].Node {
+		return b[i].Node < b[j].Node
+	}
+	return b[i].Service.ID < b[j].Service.ID
+}
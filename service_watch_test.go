@@ -0,0 +1,75 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestInstance(node string, port int) *ServiceInstance {
+	return &ServiceInstance{
+		Node:    node,
+		Service: &Service{ID: "web", Name: "web", Port: port},
+		Status:  HealthPassing,
+	}
+}
+
+func TestServiceSubscriptionDebounce(t *testing.T) {
+	released := false
+	subscription := newServiceSubscription(func() { released = true })
+	go subscription.run(time.Duration(50) * time.Millisecond)
+
+	// step: the changes within the window are gathered into a single snapshot
+	subscription.update([]*ServiceInstance{newTestInstance("node1", 80)})
+	subscription.update([]*ServiceInstance{newTestInstance("node1", 80), newTestInstance("node2", 80)})
+	select {
+	case instances := <-subscription.Instances():
+		assert.Equal(t, 2, len(instances))
+	case <-time.After(time.Second):
+		t.Fatalf("we did not recieve the instances in time")
+	}
+
+	// step: an identical snapshot should not be sent again
+	subscription.update([]*ServiceInstance{newTestInstance("node1", 80), newTestInstance("node2", 80)})
+	subscription.update([]*ServiceInstance{newTestInstance("node1", 80)})
+	select {
+	case instances := <-subscription.Instances():
+		assert.Equal(t, 1, len(instances))
+	case <-time.After(time.Second):
+		t.Fatalf("we did not recieve the instances in time")
+	}
+	subscription.update([]*ServiceInstance{newTestInstance("node1", 80)})
+	select {
+	case <-subscription.Instances():
+		t.Fatalf("we should not have recieved an identical set of instances")
+	case <-time.After(time.Duration(200) * time.Millisecond):
+	}
+
+	subscription.Close()
+	subscription.Close()
+	assert.True(t, released, "the subscription should have been released")
+	_, found := <-subscription.Instances()
+	assert.False(t, found, "the instances channel should be closed")
+	assert.False(t, subscription.update(nil), "the update should fail once closed")
+}
+
+func TestSortInstances(t *testing.T) {
+	instances := []*ServiceInstance{newTestInstance("node2", 80), newTestInstance("node1", 80)}
+	sortInstances(instances)
+	assert.Equal(t, "node1", instances[0].Node)
+	assert.Equal(t, "node2", instances[1].Node)
+}
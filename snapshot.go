@@ -0,0 +1,160 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+const (
+	// the version of the snapshot format we write
+	SnapshotVersion = 1
+	// the prefix of the checksum in the snapshot metadata
+	snapshotChecksumPrefix = "sha256:"
+	// the number of times the keys are listed to read them within a single raft term
+	DEFAULT_SNAPSHOT_ATTEMPTS = 3
+)
+
+var (
+	// the snapshot could not be read
+	ErrInvalidSnapshot = errors.New("The snapshot is not in a format we understand")
+	// the contents of the snapshot do not match the checksum
+	ErrSnapshotChecksum = errors.New("The snapshot checksum does not match its contents")
+	// a key was changed by another client while the snapshot was being restored
+	ErrRestoreConflict = errors.New("The key was changed by another client during the restore")
+)
+
+// Returned by Restore when a write or delete failed partway through. The keys
+// of the snapshot are written before those missing from it are deleted, so the
+// store still holds every key it had, with those written so far updated. Each
+// write is made against the index the key was listed at, so a key changed by
+// another client during the restore stops it with ErrRestoreConflict
+type RestoreError struct {
+	// the keys of the snapshot written or updated before the failure
+	Written int
+	// the keys missing from the snapshot deleted before the failure
+	Deleted int
+	// the key the restore stopped at
+	Key string
+	// the error from the store
+	Err error
+}
+
+func (e *RestoreError) Error() string {
+	return fmt.Sprintf("The restore stopped at the key: %s, after writing %d and deleting %d keys, error: %s",
+		e.Key, e.Written, e.Deleted, e.Err)
+}
+
+// the metadata written at the head of a snapshot
+type SnapshotMeta struct {
+	// the version of the snapshot format
+	Version int `json:"version"`
+	// the index of the store the snapshot was taken at
+	Index uint64 `json:"index"`
+	// the raft term the snapshot was taken in, zero when the backend has no raft
+	Term uint64 `json:"term"`
+	// the time the snapshot was taken
+	Time time.Time `json:"time"`
+	// the node the snapshot was taken on
+	Node string `json:"node"`
+	// the datacenter of the node
+	Datacenter string `json:"datacenter"`
+	// the number of keys in the snapshot
+	Keys int `json:"keys"`
+	// the size in bytes of the keys in the snapshot
+	Size int64 `json:"size"`
+	// the checksum of the keys in the snapshot
+	Checksum string `json:"checksum"`
+}
+
+// Write a snapshot: a line of metadata followed by the keys, the checksum
+// covering the keys
+//  w:			the writer for the snapshot
+//  meta:		the metadata, the version, keys, size and checksum are filled in
+//  pairs:		the keys in the snapshot
+func writeSnapshot(w io.Writer, meta *SnapshotMeta, pairs []*KeyPair) error {
+	sort.Sort(byKeyPair(pairs))
+	body, err := json.Marshal(pairs)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	meta.Version = SnapshotVersion
+	meta.Keys = len(pairs)
+	meta.Size = int64(len(body))
+	meta.Checksum = snapshotChecksumPrefix + hex.EncodeToString(sum[:])
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	for _, data := range [][]byte{header, []byte("\n"), body, []byte("\n")} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read and verify a snapshot
+//  r:			the reader for the snapshot
+func readSnapshot(r io.Reader) (*SnapshotMeta, []*KeyPair, error) {
+	reader := bufio.NewReader(r)
+	header, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	meta := new(SnapshotMeta)
+	if err := json.Unmarshal(header, meta); err != nil || meta.Version != SnapshotVersion {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	body = bytes.TrimSuffix(body, []byte("\n"))
+	// step: check the keys are the ones the snapshot was taken with
+	sum := sha256.Sum256(body)
+	if int64(len(body)) != meta.Size || meta.Checksum != snapshotChecksumPrefix+hex.EncodeToString(sum[:]) {
+		return nil, nil, ErrSnapshotChecksum
+	}
+	pairs := make([]*KeyPair, 0)
+	if err := json.Unmarshal(body, &pairs); err != nil {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	// step: check every key before any of them are written
+	if len(pairs) != meta.Keys {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	seen := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		if pair.Key == "" || seen[pair.Key] {
+			return nil, nil, ErrInvalidSnapshot
+		}
+		seen[pair.Key] = true
+		if pair.Value == nil {
+			pair.Value = []byte{}
+		}
+	}
+	return meta, pairs, nil
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the default number of snapshots kept in the directory
+	DEFAULT_SNAPSHOT_RETAIN = 5
+	// the prefix of the snapshot files
+	snapshotFilePrefix = "snapshot-"
+	// the extension of the snapshot files
+	snapshotFileSuffix = ".snap"
+	// the extension added to the compressed snapshot files
+	snapshotGzipSuffix = ".gz"
+)
+
+// the settings for the scheduled snapshots
+type SnapshotConfig struct {
+	// the interval between the snapshots, zero disables them
+	Interval time.Duration
+	// the directory the snapshots are written to
+	Dir string
+	// the number of snapshots kept, zero uses the default
+	Retain int
+	// only take the snapshots on the leader, so a cluster keeps a single set
+	LeaderOnly bool
+	// compress the snapshots with gzip
+	Compress bool
+}
+
+// the status of the scheduled snapshots
+type SnapshotStatus struct {
+	// the last time a snapshot was attempted
+	LastAttempt time.Time
+	// the last time a snapshot was written
+	LastSuccess time.Time
+	// the error from the last snapshot, nil if it was written
+	LastError error
+	// the path of the last snapshot written
+	Path string
+	// the size in bytes of the last snapshot written
+	Size int64
+	// the metadata of the last snapshot written
+	Meta *SnapshotMeta
+}
+
+// takes the snapshots on an interval, writing them into the directory
+type snapshotScheduler struct {
+	sync.RWMutex
+	// the settings for the snapshots
+	config SnapshotConfig
+	// writes a snapshot of the store
+	snapshot func(w io.Writer) (*SnapshotMeta, error)
+	// whether this node is the leader
+	leader func() bool
+	// the status of the snapshots
+	status SnapshotStatus
+	// signalled when the settings have been changed
+	reset chan struct{}
+	// logs the snapshots taken and the failures, nil if not logged
+	logger Logger
+}
+
+// Check the snapshot settings and create the directory
+//  config:		the snapshot settings
+func validateSnapshotConfig(config *SnapshotConfig) error {
+	if config.Interval <= 0 {
+		return nil
+	}
+	if config.Dir == "" {
+		return ErrInvalidConfig
+	}
+	if config.Retain <= 0 {
+		config.Retain = DEFAULT_SNAPSHOT_RETAIN
+	}
+	return os.MkdirAll(config.Dir, 0700)
+}
+
+func newSnapshotScheduler(config SnapshotConfig, snapshot func(io.Writer) (*SnapshotMeta, error), leader func() bool) *snapshotScheduler {
+	return &snapshotScheduler{
+		config:   config,
+		snapshot: snapshot,
+		leader:   leader,
+		reset:    make(chan struct{}, 1),
+	}
+}
+
+// Take the snapshots until the store is shutdown
+//  shutdown:	closed when the store is shutting down
+func (s *snapshotScheduler) run(shutdown chan struct{}) {
+	for s.schedule(shutdown) {
+	}
+}
+
+// Take the snapshots on the current settings until they are changed, returns
+// false once the store is shutdown
+//  shutdown:	closed when the store is shutting down
+func (s *snapshotScheduler) schedule(shutdown chan struct{}) bool {
+	config := s.settings()
+	// step: a nil channel never fires, so the snapshots are disabled without an interval
+	var tick <-chan time.Time
+	if config.Interval > 0 {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-shutdown:
+			return false
+		case <-s.reset:
+			return true
+		case <-tick:
+			if config.LeaderOnly && !s.leader() {
+				continue
+			}
+			s.take()
+		}
+	}
+}
+
+// Change the settings of the snapshots, the interval restarts from now
+//  config:		the new settings, already validated
+func (s *snapshotScheduler) configure(config SnapshotConfig) {
+	s.Lock()
+	s.config = config
+	s.Unlock()
+	select {
+	case s.reset <- struct{}{}:
+	default:
+	}
+}
+
+// The current settings of the snapshots
+func (s *snapshotScheduler) settings() SnapshotConfig {
+	s.RLock()
+	defer s.RUnlock()
+	return s.config
+}
+
+// The status of the snapshots
+func (s *snapshotScheduler) Status() SnapshotStatus {
+	s.RLock()
+	defer s.RUnlock()
+	return s.status
+}
+
+// Take a snapshot into the directory and remove the oldest beyond the retain
+func (s *snapshotScheduler) take() error {
+	now := time.Now().UTC()
+	path, size, meta, err := s.write(now)
+	if err == nil {
+		err = s.rotate()
+	}
+	if s.logger != nil {
+		if err != nil {
+			s.logger.Log(LogWarn, "unable to take the snapshot", "error", err)
+		} else {
+			s.logger.Log(LogDebug, "took a snapshot", "path", path, "index", meta.Index, "size", size)
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.status.LastAttempt = now
+	s.status.LastError = err
+	if path != "" {
+		s.status.LastSuccess = now
+		s.status.Path = path
+		s.status.Size = size
+		s.status.Meta = meta
+	}
+	return err
+}
+
+// Write the snapshot to a temporary file, renaming it into place once it has
+// been synced, so a partial snapshot is never left under the snapshot name
+//  now:		the time of the snapshot
+func (s *snapshotScheduler) write(now time.Time) (string, int64, *SnapshotMeta, error) {
+	config := s.settings()
+	file, err := ioutil.TempFile(config.Dir, ".snapshot")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	// step: the temporary file is removed unless it was renamed
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	var writer io.Writer = file
+	var compressor *gzip.Writer
+	if config.Compress {
+		compressor = gzip.NewWriter(file)
+		writer = compressor
+	}
+	meta, err := s.snapshot(writer)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return "", 0, nil, err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return "", 0, nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if err := file.Close(); err != nil {
+		return "", 0, nil, err
+	}
+	name := fmt.Sprintf("%s%s-%d%s", snapshotFilePrefix, now.Format("20060102T150405.000000000Z"), meta.Index, snapshotFileSuffix)
+	if config.Compress {
+		name += snapshotGzipSuffix
+	}
+	path := filepath.Join(config.Dir, name)
+	if err := os.Rename(file.Name(), path); err != nil {
+		return "", 0, nil, err
+	}
+	return path, stat.Size(), meta, nil
+}
+
+// Remove the oldest snapshots beyond the number we retain
+func (s *snapshotScheduler) rotate() error {
+	config := s.settings()
+	names, err := listSnapshots(config.Dir)
+	if err != nil {
+		return err
+	}
+	for len(names) > config.Retain {
+		if err := os.Remove(filepath.Join(config.Dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// List the snapshots in the directory, oldest first
+//  dir:		the directory of the snapshots
+func listSnapshots(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, snapshotFilePrefix) {
+			continue
+		}
+		if strings.HasSuffix(name, snapshotFileSuffix) || strings.HasSuffix(name, snapshotFileSuffix+snapshotGzipSuffix) {
+			names = append(names, name)
+		}
+	}
+	// step: the names carry the time of the snapshot, so they sort by age
+	sort.Strings(names)
+	return names, nil
+}
+
+// Open a snapshot written by the scheduler, decompressing it if required
+//  path:		the path of the snapshot
+func OpenSnapshot(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, snapshotGzipSuffix) {
+		return file, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipSnapshot{Reader: reader, file: file}, nil
+}
+
+// a compressed snapshot, closing the file with the reader
+type gzipSnapshot struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipSnapshot) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSnapshotDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatalf("unable to create the directory, error: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestValidateSnapshotConfig(t *testing.T) {
+	assert.Nil(t, validateSnapshotConfig(&SnapshotConfig{}))
+	assert.Equal(t, ErrInvalidConfig, validateSnapshotConfig(&SnapshotConfig{Interval: time.Minute}))
+	config := &SnapshotConfig{Interval: time.Minute, Dir: newTestSnapshotDir(t) + "/nested"}
+	assert.Nil(t, validateSnapshotConfig(config))
+	assert.Equal(t, DEFAULT_SNAPSHOT_RETAIN, config.Retain)
+	_, err := os.Stat(config.Dir)
+	assert.Nil(t, err, "the directory should have been created")
+}
+
+func TestSnapshotSchedulerRotation(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	assert.Nil(t, store.Set("a", "1"))
+	dir := newTestSnapshotDir(t)
+	scheduler := newSnapshotScheduler(SnapshotConfig{Interval: time.Minute, Dir: dir, Retain: 2, Compress: true},
+		store.Snapshot, func() bool { return true })
+	for i := 0; i < 4; i++ {
+		err := scheduler.take()
+		assert.Nil(t, err, "we should not recieve an error: %s", err)
+		time.Sleep(time.Millisecond)
+	}
+	names, err := listSnapshots(dir)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, 2, len(names), "only the retained snapshots should be kept")
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 2, len(files), "the temporary files should have been removed")
+
+	status := scheduler.Status()
+	assert.Nil(t, status.LastError)
+	assert.True(t, strings.HasSuffix(status.Path, names[1]))
+	assert.True(t, status.Size > 0)
+	assert.Equal(t, 1, status.Meta.Keys)
+
+	// step: the compressed snapshot can be restored
+	assert.Nil(t, store.Set("a", "changed"))
+	reader, err := OpenSnapshot(status.Path)
+	if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+		t.FailNow()
+	}
+	defer reader.Close()
+	_, err = store.Restore(reader)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	value, _, _ := store.Get("a")
+	assert.Equal(t, "1", value)
+}
+
+func TestSnapshotSchedulerError(t *testing.T) {
+	dir := newTestSnapshotDir(t)
+	failure := errors.New("failed")
+	scheduler := newSnapshotScheduler(SnapshotConfig{Interval: time.Minute, Dir: dir, Retain: 2},
+		func(w io.Writer) (*SnapshotMeta, error) { return nil, failure }, func() bool { return true })
+	assert.Equal(t, failure, scheduler.take())
+	status := scheduler.Status()
+	assert.Equal(t, failure, status.LastError)
+	assert.True(t, status.LastSuccess.IsZero())
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files, "a failed snapshot should leave nothing behind")
+}
+
+func TestMemorySnapshotSchedule(t *testing.T) {
+	cfg := DefaultContext()
+	cfg.Snapshots = SnapshotConfig{Interval: time.Duration(20) * time.Millisecond, Dir: newTestSnapshotDir(t)}
+	store, err := NewMemoryStore(cfg)
+	if !assert.Nil(t, err, "we should not recieve an error: %s", err) {
+		t.FailNow()
+	}
+	defer store.Close()
+	deadline := time.Now().Add(time.Second)
+	for store.SnapshotStatus().LastSuccess.IsZero() && time.Now().Before(deadline) {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	assert.False(t, store.SnapshotStatus().LastSuccess.IsZero(), "a snapshot should have been taken")
+}
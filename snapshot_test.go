@@ -0,0 +1,68 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	pairs := []*KeyPair{
+		{Key: "b", Value: []byte{0, 1, 2}},
+		{Key: "a", Flags: 42, Value: []byte("value")},
+		{Key: "empty", Value: []byte{}},
+	}
+	err := writeSnapshot(buffer, &SnapshotMeta{Index: 10, Node: "test"}, pairs)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+
+	meta, restored, err := readSnapshot(buffer)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.Equal(t, SnapshotVersion, meta.Version)
+	assert.Equal(t, uint64(10), meta.Index)
+	assert.Equal(t, "test", meta.Node)
+	assert.Equal(t, 3, meta.Keys)
+	assert.True(t, strings.HasPrefix(meta.Checksum, snapshotChecksumPrefix))
+	if assert.Equal(t, 3, len(restored)) {
+		assert.Equal(t, "a", restored[0].Key)
+		assert.Equal(t, uint64(42), restored[0].Flags)
+		assert.Equal(t, []byte{0, 1, 2}, restored[1].Value)
+		assert.Equal(t, []byte{}, restored[2].Value)
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	err := writeSnapshot(buffer, &SnapshotMeta{}, []*KeyPair{{Key: "a", Value: []byte("value")}})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	corrupted := bytes.Replace(buffer.Bytes(), []byte(`"key":"a"`), []byte(`"key":"b"`), 1)
+	_, _, err = readSnapshot(bytes.NewReader(corrupted))
+	assert.Equal(t, ErrSnapshotChecksum, err)
+
+	_, _, err = readSnapshot(strings.NewReader("not a snapshot"))
+	assert.Equal(t, ErrInvalidSnapshot, err)
+	_, _, err = readSnapshot(strings.NewReader("{\"version\":99}\n[]\n"))
+	assert.Equal(t, ErrInvalidSnapshot, err)
+
+	// step: the keys are checked before anything is written
+	buffer.Reset()
+	err = writeSnapshot(buffer, &SnapshotMeta{}, []*KeyPair{{Key: "a"}, {Key: "a"}})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	_, _, err = readSnapshot(buffer)
+	assert.Equal(t, ErrInvalidSnapshot, err, "a duplicate key should be rejected")
+}
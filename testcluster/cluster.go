@@ -0,0 +1,327 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testcluster starts a cluster of embedded distrostore nodes inside a
+// test, on free ports and in temporary directories, and tears it down with the test.
+package testcluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/gambol99/distrostore"
+	"github.com/gambol99/distrostore/faultnet"
+)
+
+const (
+	// the default time we wait on the cluster to form
+	DEFAULT_TIMEOUT = (time.Duration(30) * time.Second)
+	// the interval between checking the state of the cluster
+	DEFAULT_POLL_INTERVAL = (time.Duration(250) * time.Millisecond)
+)
+
+// the options for the cluster
+type Options struct {
+	// the time we wait on the cluster to form, zero uses the default
+	Timeout time.Duration
+	// called on the context of each node before it is started
+	Configure func(index int, cfg *ds.Context)
+	// place the nodes behind a faultnet network, so the tests can partition them
+	Faults bool
+	// the seed for the faults injected by the network
+	Seed int64
+}
+
+// a cluster of embedded nodes
+type Cluster struct {
+	sync.RWMutex
+	// the test the cluster belongs to
+	t testing.TB
+	// the options for the cluster
+	options *Options
+	// the context of each node, kept for restarts
+	contexts []*ds.Context
+	// the store of each node, nil when the node has been killed
+	stores []ds.DistroStore
+	// the network between the nodes, nil unless faults are enabled
+	network *faultnet.Network
+}
+
+// Start a cluster of n nodes and wait until a leader is elected and every
+// node has joined; the cluster is shutdown when the test finishes
+//
+//	t:			the test the cluster belongs to
+//	n:			the number of nodes in the cluster
+//	options:	the options for the cluster, can be nil
+func New(t testing.TB, n int, options *Options) *Cluster {
+	if n <= 0 {
+		t.Fatalf("the cluster must have at least one node")
+	}
+	if options == nil {
+		options = &Options{}
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_TIMEOUT
+	}
+	c := &Cluster{
+		t:        t,
+		options:  options,
+		contexts: make([]*ds.Context, n),
+		stores:   make([]ds.DistroStore, n),
+	}
+	if options.Faults {
+		if n > faultnet.MaxNodes {
+			t.Fatalf("the network can have at most %d nodes", faultnet.MaxNodes)
+		}
+		c.network = faultnet.New(options.Seed)
+	}
+	t.Cleanup(c.shutdown)
+
+	for i := 0; i < n; i++ {
+		dir, err := ioutil.TempDir("", "testcluster")
+		if err != nil {
+			t.Fatalf("unable to create the data directory, error: %s", err)
+		}
+		cfg := ds.DefaultContext()
+		cfg.NodeName = fmt.Sprintf("node%d", i)
+		cfg.BindAddress = "127.0.0.1"
+		cfg.BindAdvertised = "127.0.0.1"
+		cfg.ClientAddress = "127.0.0.1"
+		cfg.DataDir = dir
+		cfg.PortsConfig = ds.PortConfig{}
+		// step: the first node bootstraps the cluster and the rest join it
+		if i == 0 {
+			cfg.Bootstrap = true
+		} else {
+			cfg.Members = []string{c.serfAddress(0)}
+		}
+		if options.Configure != nil {
+			options.Configure(i, cfg)
+		}
+		if c.network != nil {
+			c.addNetworkNode(i, cfg)
+		}
+		c.contexts[i] = cfg
+		c.start(i)
+	}
+	c.WaitForCluster()
+
+	return c
+}
+
+// The network between the nodes, nil unless the cluster was started with faults
+func (c *Cluster) Network() *faultnet.Network {
+	return c.network
+}
+
+// The number of nodes in the cluster, including those killed
+func (c *Cluster) Size() int {
+	return len(c.contexts)
+}
+
+// The store of a node, nil if the node has been killed
+//
+//	i:			the index of the node
+func (c *Cluster) Store(i int) ds.DistroStore {
+	c.RLock()
+	defer c.RUnlock()
+	return c.stores[i]
+}
+
+// The index of the node which is the leader, -1 if there isn't one
+func (c *Cluster) Leader() int {
+	c.RLock()
+	defer c.RUnlock()
+	for _, store := range c.stores {
+		if store == nil {
+			continue
+		}
+		nodes, err := store.Nodes()
+		if err != nil {
+			continue
+		}
+		for _, node := range nodes {
+			if !node.Leader {
+				continue
+			}
+			for i, cfg := range c.contexts {
+				if cfg.NodeName == node.ID && c.stores[i] != nil {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// Kill a node without leaving the cluster, the peers see it as failed
+//
+//	i:			the index of the node
+func (c *Cluster) Kill(i int) {
+	c.Lock()
+	store := c.stores[i]
+	c.stores[i] = nil
+	c.Unlock()
+	if store == nil {
+		c.t.Fatalf("the node %d has already been killed", i)
+	}
+	if err := store.Shutdown(true); err != nil {
+		c.t.Logf("killing node %d returned an error: %s", i, err)
+	}
+}
+
+// Restart a killed node with its data and ports, waiting for it to rejoin
+//
+//	i:			the index of the node
+func (c *Cluster) Restart(i int) {
+	c.Lock()
+	if c.stores[i] != nil {
+		c.Unlock()
+		c.t.Fatalf("the node %d is still running", i)
+	}
+	// step: rejoin the running nodes, only bootstrapping if there are none
+	cfg := c.contexts[i]
+	cfg.Bootstrap = true
+	cfg.Members = make([]string, 0)
+	for j, store := range c.stores {
+		if store != nil {
+			cfg.Bootstrap = false
+			cfg.Members = append(cfg.Members, c.serfAddressLocked(j))
+		}
+	}
+	c.Unlock()
+
+	c.start(i)
+	c.WaitForCluster()
+}
+
+// Wait until a leader is elected and every running node sees the others as alive
+func (c *Cluster) WaitForCluster() {
+	Eventually(c.t, c.options.Timeout, func() bool {
+		return c.Leader() >= 0 && c.joined()
+	}, "the cluster did not form within %s", c.options.Timeout)
+}
+
+// Poll the condition until it holds, failing the test if it doesn't within the timeout
+//
+//	t:			the test waiting on the condition
+//	timeout:	the time we wait, zero uses the default
+//	condition:	returns true once the condition holds
+//	format:		the message the test fails with
+func Eventually(t testing.TB, timeout time.Duration, condition func() bool, format string, args ...interface{}) {
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(DEFAULT_POLL_INTERVAL)
+	}
+}
+
+// Check every running node sees the other running nodes as alive
+func (c *Cluster) joined() bool {
+	c.RLock()
+	defer c.RUnlock()
+	for _, store := range c.stores {
+		if store == nil {
+			continue
+		}
+		nodes, err := store.Nodes()
+		if err != nil {
+			return false
+		}
+		alive := make(map[string]bool, 0)
+		for _, node := range nodes {
+			alive[node.ID] = node.IsAlive()
+		}
+		for i, cfg := range c.contexts {
+			if c.stores[i] != nil && !alive[cfg.NodeName] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *Cluster) start(i int) {
+	store, err := ds.New(c.contexts[i])
+	if err != nil {
+		c.t.Fatalf("unable to start node %d, error: %s", i, err)
+	}
+	c.Lock()
+	c.stores[i] = store
+	c.Unlock()
+}
+
+// Place the node behind the network, binding to its own loopback address and
+// advertising the address the proxies listen on
+//
+//	i:			the index of the node
+//	cfg:		the context of the node
+func (c *Cluster) addNetworkNode(i int, cfg *ds.Context) {
+	cfg.BindAddress = faultnet.BindAddress(i)
+	cfg.BindAdvertised = faultnet.AdvertiseAddress(i)
+	if i > 0 {
+		cfg.Members = []string{c.serfAddress(0)}
+	}
+	// step: the proxies need the ports before the node is started
+	if err := cfg.PortsConfig.AllocateFree(); err != nil {
+		c.t.Fatalf("unable to allocate the ports for node %d, error: %s", i, err)
+	}
+	ports := cfg.PortsConfig
+	if err := c.network.AddNode(i, []int{ports.SerfLan, ports.SerfWan}, ports.Server); err != nil {
+		c.t.Fatalf("unable to add node %d to the network, error: %s", i, err)
+	}
+}
+
+func (c *Cluster) serfAddress(i int) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.serfAddressLocked(i)
+}
+
+func (c *Cluster) serfAddressLocked(i int) string {
+	address := c.contexts[i].BindAddress
+	if c.contexts[i].BindAdvertised != "" {
+		address = c.contexts[i].BindAdvertised
+	}
+	return fmt.Sprintf("%s:%d", address, c.contexts[i].PortsConfig.SerfLan)
+}
+
+// Shutdown the nodes and remove their data
+func (c *Cluster) shutdown() {
+	c.Lock()
+	stores := c.stores
+	c.stores = make([]ds.DistroStore, len(stores))
+	c.Unlock()
+	for _, store := range stores {
+		if store != nil {
+			store.Shutdown(true)
+		}
+	}
+	if c.network != nil {
+		c.network.Close()
+	}
+	for _, cfg := range c.contexts {
+		if cfg != nil {
+			os.RemoveAll(cfg.DataDir)
+		}
+	}
+}
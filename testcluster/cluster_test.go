@@ -0,0 +1,67 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testcluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster(t *testing.T) {
+	cluster := New(t, 3, nil)
+	assert.Equal(t, 3, cluster.Size())
+	leader := cluster.Leader()
+	assert.True(t, leader >= 0, "the cluster should have a leader")
+
+	// step: kill and restart one of the followers
+	follower := (leader + 1) % cluster.Size()
+	cluster.Kill(follower)
+	assert.Nil(t, cluster.Store(follower), "the store should be gone once killed")
+	err := cluster.Store(leader).Set("testcluster", "written")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+
+	cluster.Restart(follower)
+	value, found, err := cluster.Store(follower).Get("testcluster")
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, found, "the restarted node should see the key")
+	assert.Equal(t, "written", value)
+}
+
+func TestClusterPartition(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the partition test in short mode")
+	}
+	cluster := New(t, 3, &Options{Faults: true})
+	leader := cluster.Leader()
+	assert.True(t, leader >= 0, "the cluster should have a leader")
+	majority := []int{(leader + 1) % 3, (leader + 2) % 3}
+
+	// step: isolate the leader, the majority should elect another and take writes
+	cluster.Network().Partition([]int{leader}, majority)
+	Eventually(t, DEFAULT_TIMEOUT, func() bool {
+		return cluster.Store(majority[0]).Set("partitioned", "majority") == nil
+	}, "the majority did not take a write within %s", DEFAULT_TIMEOUT)
+	// step: the isolated node has lost quorum, so it must not take a write
+	err := cluster.Store(leader).Set("partitioned", "minority")
+	assert.Error(t, err, "a write through the isolated node should fail")
+
+	// step: heal the network, the old leader should catch up
+	cluster.Network().Heal()
+	cluster.WaitForCluster()
+	Eventually(t, DEFAULT_TIMEOUT, func() bool {
+		value, _, err := cluster.Store(leader).Get("partitioned")
+		return err == nil && value == "majority"
+	}, "the old leader did not catch up within %s", DEFAULT_TIMEOUT)
+}
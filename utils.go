@@ -14,8 +14,18 @@ limitations under the License.
 package distrostore
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"regexp"
+	"time"
+)
+
+const (
+	// the number of ports we try before giving up on finding a free one
+	freePortAttempts = 32
 )
 
 var (
@@ -33,3 +43,62 @@ func temporyDirectory() (string, error) {
 func isEndpoint(str string) bool {
 	return endpointRegex.MatchString(str)
 }
+
+// Wait an exponentially increasing amount of time, returns false if we were stopped
+//  failures:		the number of consecutive failures
+//  stopChannel:	closed when we should give up waiting
+func backoff(failures int, stopChannel chan struct{}) bool {
+	wait := time.Duration(1<<uint(failures)) * (time.Duration(100) * time.Millisecond)
+	if wait > DEFAULT_MAX_BACKOFF || wait <= 0 {
+		wait = DEFAULT_MAX_BACKOFF
+	}
+	select {
+	case <-stopChannel:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// Find a port which is free on both tcp and udp
+//  taken:		the ports already allocated
+func freePort(taken map[int]bool) (int, error) {
+	for i := 0; i < freePortAttempts; i++ {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
+		if err != nil {
+			return 0, err
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		// step: serf and dns need the udp port as well
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		listener.Close()
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		if taken[port] {
+			continue
+		}
+		return port, nil
+	}
+	return 0, ErrNoFreePort
+}
+
+// Generate a random identifier, i.e. for an event or a session
+func newRandomID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Copy a set of tags
+//  tags:		the tags to copy
+func copyTags(tags map[string]string) map[string]string {
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	return copied
+}
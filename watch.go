@@ -0,0 +1,201 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// the glob and regex filters are mutually exclusive
+	ErrInvalidWatchFilter = errors.New("You can only specify a glob or a regex filter, not both")
+)
+
+// the options for a prefix scoped watch
+type WatchOptions struct {
+	// a glob pattern the full key must match i.e. services/*/config
+	Glob string
+	// a regular expression the full key must match
+	Regex string
+	// the index to resume the watch from, i.e. a previous LastIndex(); changes since
+	// are replayed and a KeyResync event is sent if they can't be worked out, zero means from now
+	Index uint64
+	// the number of events buffered for the subscriber, zero uses the default
+	Buffer int
+	// what to do when the buffer is full
+	Policy OverflowPolicy
+	// when set the events are passed to the handler rather than the channel
+	Handler func(*KeyAPIEvent)
+}
+
+// a subscription to key events under a prefix
+type Subscription interface {
+	// the channel the events are passed upon
+	Events() <-chan *KeyAPIEvent
+	// the index of the last event passed to the consumer, used to resume the watch
+	LastIndex() uint64
+	// the number of events dropped because the buffer was full
+	Dropped() uint64
+	// the reason the subscription was closed i.e. ErrSlowConsumer, nil otherwise
+	Err() error
+	// unregister the subscription and close the channel
+	Close() error
+}
+
+// a filter used to decide if a key is of interest to a watch
+type keyFilter struct {
+	// the prefix the key must have
+	prefix string
+	// the glob the key must match
+	glob string
+	// the regex the key must match
+	regex *regexp.Regexp
+}
+
+func newKeyFilter(prefix string, options *WatchOptions) (*keyFilter, error) {
+	filter := &keyFilter{prefix: prefix}
+	if options == nil {
+		return filter, nil
+	}
+	if options.Glob != "" && options.Regex != "" {
+		return nil, ErrInvalidWatchFilter
+	}
+	if options.Glob != "" {
+		// step: check the pattern is valid before we accept it
+		if _, err := path.Match(options.Glob, ""); err != nil {
+			return nil, err
+		}
+		filter.glob = options.Glob
+	}
+	if options.Regex != "" {
+		regex, err := regexp.Compile(options.Regex)
+		if err != nil {
+			return nil, err
+		}
+		filter.regex = regex
+	}
+	return filter, nil
+}
+
+// Check if the key passes the filter
+//  key:		the full key name
+func (f *keyFilter) matches(key string) bool {
+	if !strings.HasPrefix(key, f.prefix) {
+		return false
+	}
+	if f.glob != "" {
+		if matched, _ := path.Match(f.glob, key); !matched {
+			return false
+		}
+	}
+	if f.regex != nil && !f.regex.MatchString(key) {
+		return false
+	}
+	return true
+}
+
+// the implementation of a subscription
+type keySubscription struct {
+	// the channel the events are passed on
+	channel chan *KeyAPIEvent
+	// the filter for the keys
+	filter *keyFilter
+	// closed when the watcher should stop
+	stopChannel chan struct{}
+	// the buffered delivery of the events
+	subscriber *subscriber
+	// the index of the last event delivered
+	lastIndex uint64
+	// ensure we only close once
+	once sync.Once
+	// called on close to unregister from the store
+	release func()
+}
+
+func newKeySubscription(filter *keyFilter, options *WatchOptions, release func()) *keySubscription {
+	s := &keySubscription{
+		channel:     make(chan *KeyAPIEvent),
+		filter:      filter,
+		stopChannel: make(chan struct{}),
+		release:     release,
+	}
+	if options == nil {
+		options = &WatchOptions{}
+	}
+	s.lastIndex = options.Index
+	deliver := keyChannelDeliver(s.channel)
+	if handler := options.Handler; handler != nil {
+		deliver = func(event interface{}, done chan struct{}) bool {
+			handler(event.(*KeyAPIEvent))
+			return true
+		}
+	}
+	s.subscriber = newSubscriber("watch", options.Buffer, options.Policy, func(event interface{}, done chan struct{}) bool {
+		if !deliver(event, done) {
+			return false
+		}
+		// step: the index only moves on once the consumer has the event
+		e := event.(*KeyAPIEvent)
+		if e.Status == KeyResync || e.ModifyIndex > s.LastIndex() {
+			atomic.StoreUint64(&s.lastIndex, e.ModifyIndex)
+		}
+		return true
+	}, func(error) {
+		close(s.channel)
+		// step: a disconnected subscription still needs to be released
+		s.Close()
+	})
+	return s
+}
+
+func (s *keySubscription) Events() <-chan *KeyAPIEvent {
+	return s.channel
+}
+
+// Queue the event for the subscriber, returns false if the subscription has been closed
+//  event:		the key event to pass on
+func (s *keySubscription) send(event *KeyAPIEvent) bool {
+	if event.Status != KeyResync && !s.filter.matches(event.Key) {
+		return true
+	}
+	return s.subscriber.push(event)
+}
+
+func (s *keySubscription) LastIndex() uint64 {
+	return atomic.LoadUint64(&s.lastIndex)
+}
+
+func (s *keySubscription) Dropped() uint64 {
+	return s.subscriber.Dropped()
+}
+
+func (s *keySubscription) Err() error {
+	return s.subscriber.Err()
+}
+
+func (s *keySubscription) Close() error {
+	s.once.Do(func() {
+		close(s.stopChannel)
+		s.subscriber.close()
+		if s.release != nil {
+			s.release()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package distrostore
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyFilter(t *testing.T) {
+	filter, err := newKeyFilter("services/", nil)
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, filter.matches("services/web"), "the key should have matched the prefix")
+	assert.False(t, filter.matches("config/web"), "the key should not have matched the prefix")
+
+	filter, err = newKeyFilter("services/", &WatchOptions{Glob: "services/*/config"})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, filter.matches("services/web/config"), "the key should have matched the glob")
+	assert.False(t, filter.matches("services/web/port"), "the key should not have matched the glob")
+
+	filter, err = newKeyFilter("", &WatchOptions{Regex: "^jobs/[0-9]+$"})
+	assert.Nil(t, err, "we should not recieve an error: %s", err)
+	assert.True(t, filter.matches("jobs/12"), "the key should have matched the regex")
+	assert.False(t, filter.matches("jobs/abc"), "the key should not have matched the regex")
+}
+
+func TestKeyFilterInvalid(t *testing.T) {
+	_, err := newKeyFilter("", &WatchOptions{Glob: "*", Regex: ".*"})
+	assert.Equal(t, ErrInvalidWatchFilter, err, "we should have recieved an invalid filter error")
+	_, err = newKeyFilter("", &WatchOptions{Regex: "(["})
+	assert.NotNil(t, err, "we should have recieved an error for the bad regex")
+	_, err = newKeyFilter("", &WatchOptions{Glob: "["})
+	assert.NotNil(t, err, "we should have recieved an error for the bad glob")
+}
+
+func TestDiffKeys(t *testing.T) {
+	keys, events := diffKeys(nil, api.KVPairs{
+		{Key: "a", CreateIndex: 1, ModifyIndex: 1, Value: []byte("1")},
+		{Key: "b", CreateIndex: 2, ModifyIndex: 2, Value: []byte("2")},
+	}, 0, 2, 10)
+	assert.Equal(t, 2, len(keys), "we should have two keys in the listing")
+	assert.Empty(t, events, "the first listing should not generate any events")
+
+	keys, events = diffKeys(keys, api.KVPairs{
+		{Key: "b", CreateIndex: 2, ModifyIndex: 4, Value: []byte("4"), Flags: 8},
+		{Key: "c", CreateIndex: 3, ModifyIndex: 3, Value: []byte("3"), Session: "abc"},
+	}, 0, 5, 10)
+	assert.Equal(t, 2, len(keys), "we should have two keys in the listing")
+	if assert.Equal(t, 3, len(events), "we should have three events") {
+		assert.Equal(t, "c", events[0].Key)
+		assert.Equal(t, KeySet, events[0].Status)
+		assert.Equal(t, []byte("3"), events[0].Value)
+		assert.Nil(t, events[0].PrevValue)
+		assert.Equal(t, "abc", events[0].Session)
+		assert.Equal(t, "b", events[1].Key)
+		assert.Equal(t, KeyChanged, events[1].Status)
+		assert.Equal(t, []byte("4"), events[1].Value)
+		assert.Equal(t, []byte("2"), events[1].PrevValue)
+		assert.Equal(t, uint64(2), events[1].CreateIndex)
+		assert.Equal(t, uint64(4), events[1].ModifyIndex)
+		assert.Equal(t, uint64(8), events[1].Flags)
+		assert.Equal(t, "a", events[2].Key)
+		assert.Equal(t, KeyDeleted, events[2].Status)
+		assert.Equal(t, []byte("1"), events[2].PrevValue)
+		assert.Equal(t, uint64(5), events[2].ModifyIndex)
+	}
+}
+
+func TestDiffKeysSinceIndex(t *testing.T) {
+	_, events := diffKeys(nil, api.KVPairs{
+		{Key: "a", CreateIndex: 1, ModifyIndex: 1},
+		{Key: "b", CreateIndex: 2, ModifyIndex: 6},
+		{Key: "c", CreateIndex: 7, ModifyIndex: 7},
+	}, 5, 7, 10)
+	if assert.Equal(t, 2, len(events), "we should have two events") {
+		assert.Equal(t, "b", events[0].Key)
+		assert.Equal(t, KeyChanged, events[0].Status)
+		assert.Equal(t, "c", events[1].Key)
+		assert.Equal(t, KeySet, events[1].Status)
+	}
+}
+
+func TestDiffKeysValueLimit(t *testing.T) {
+	keys, _ := diffKeys(nil, api.KVPairs{
+		{Key: "a", CreateIndex: 1, ModifyIndex: 1, Value: []byte("small")},
+	}, 0, 1, 5)
+	_, events := diffKeys(keys, api.KVPairs{
+		{Key: "a", CreateIndex: 1, ModifyIndex: 2, Value: []byte("much too large")},
+	}, 0, 2, 5)
+	if assert.Equal(t, 1, len(events), "we should have one event") {
+		assert.Nil(t, events[0].Value, "the value should have been omitted")
+		assert.True(t, events[0].ValueOmitted, "the value should be marked as omitted")
+		assert.Equal(t, []byte("small"), events[0].PrevValue)
+	}
+}
+
+func TestNeedsResync(t *testing.T) {
+	pairs := api.KVPairs{
+		{Key: "a", CreateIndex: 1, ModifyIndex: 1},
+		{Key: "b", CreateIndex: 2, ModifyIndex: 6},
+	}
+	assert.False(t, needsResync(nil, pairs, 0, 0, 6), "a fresh watch never needs a resync")
+	assert.False(t, needsResync(nil, pairs, 4, 0, 6), "the changes since the index can be replayed")
+	assert.False(t, needsResync(nil, pairs, 6, 0, 6), "nothing has changed since the index")
+	assert.True(t, needsResync(nil, pairs, 4, 0, 8), "a key has been deleted since the index")
+	assert.True(t, needsResync(nil, pairs, 10, 0, 6), "the store is behind the index")
+	assert.True(t, needsResync(nil, pairs, 5, 0, 8), "a key has been deleted since the changes")
+	assert.False(t, needsResync(nil, pairs, 5, 0, 6), "the changes since the index can be replayed")
+	assert.False(t, needsResync(nil, nil, 0, 0, 20), "a fresh watch of an empty prefix never needs a resync")
+	assert.True(t, needsResync(nil, nil, 6, 0, 20), "the keys under the prefix may have been deleted")
+	assert.False(t, needsResync(nil, nil, 20, 0, 20), "nothing has changed since the index")
+	assert.True(t, needsResync(map[string]*keyState{}, pairs, 0, 8, 6), "the store index went backwards")
+	assert.False(t, needsResync(map[string]*keyState{}, pairs, 0, 5, 6), "the store index moved forward")
+}
+
+func TestKeySubscriptionLastIndex(t *testing.T) {
+	filter, _ := newKeyFilter("", nil)
+	subscription := newKeySubscription(filter, &WatchOptions{Index: 3}, nil)
+	defer subscription.Close()
+	assert.Equal(t, uint64(3), subscription.LastIndex(), "the index should start from the options")
+	subscription.send(&KeyAPIEvent{Key: "a", Status: KeySet, ModifyIndex: 5})
+	event := <-subscription.Events()
+	assert.Equal(t, "a", event.Key)
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	assert.Equal(t, uint64(5), subscription.LastIndex(), "the index should have moved on")
+}
+
+func TestDiffNodes(t *testing.T) {
+	members, events := diffNodes(nil, []*Node{
+		{ID: "test1", Address: "127.0.0.1", Port: 8301, Status: NodeAlive},
+		{ID: "test3", Address: "127.0.0.1", Port: 8321, Status: NodeAlive},
+	})
+	assert.Empty(t, events, "the first check should not generate any events")
+	members, events = diffNodes(members, []*Node{
+		{ID: "test2", Address: "127.0.0.1", Port: 8311, Status: NodeAlive},
+		{ID: "test3", Address: "127.0.0.1", Port: 8321, Status: NodeFailed},
+	})
+	assert.Equal(t, 2, len(members), "we should have two members")
+	if assert.Equal(t, 3, len(events), "we should have three events") {
+		assert.Equal(t, "test2", events[0].Node.ID)
+		assert.Equal(t, NodeEventJoined, events[0].Status)
+		assert.Equal(t, "test3", events[1].Node.ID)
+		assert.Equal(t, NodeEventFailed, events[1].Status)
+		assert.Equal(t, "test1", events[2].Node.ID)
+		assert.Equal(t, NodeEventLeft, events[2].Status)
+	}
+	_, events = diffNodes(members, []*Node{
+		{ID: "test2", Address: "127.0.0.1", Port: 8311, Status: NodeAlive, Leader: true},
+	})
+	if assert.Equal(t, 1, len(events), "we should have one event") {
+		assert.Equal(t, "test2", events[0].Node.ID)
+		assert.Equal(t, NodeEventUpdated, events[0].Status)
+	}
+}
+
+func TestMemberToNode(t *testing.T) {
+	member := serf.Member{
+		Name:   "test1",
+		Addr:   net.ParseIP("127.0.0.1"),
+		Port:   8301,
+		Status: serf.StatusAlive,
+		Tags: map[string]string{
+			"role":  "consul",
+			"dc":    "dc1",
+			"port":  "8300",
+			"vsn":   "2",
+			"build": "0.5.0:",
+		},
+	}
+	node := memberToNode(member, "127.0.0.1:8300")
+	assert.Equal(t, "test1", node.ID)
+	assert.Equal(t, NodeAlive, node.Status)
+	assert.Equal(t, NodeServer, node.Role)
+	assert.Equal(t, "dc1", node.Datacenter)
+	assert.Equal(t, "0.5.0:", node.Build)
+	assert.Equal(t, 2, node.Protocol)
+	assert.True(t, node.Leader, "the node should be the leader")
+	assert.Equal(t, "8300", node.Tags["port"])
+
+	member.Status = serf.StatusFailed
+	member.Tags["role"] = "node"
+	node = memberToNode(member, "127.0.0.1:8300")
+	assert.Equal(t, NodeFailed, node.Status)
+	assert.Equal(t, NodeClient, node.Role)
+	assert.False(t, node.Leader, "a client can never be the leader")
+}